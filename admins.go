@@ -0,0 +1,39 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/paulrosania/registrar/storage"
+)
+
+// adminsCommand implements `registrar admins`, which grants or revokes the
+// admin role. Only admins can be issued the admin scope, so this is the only
+// way to bootstrap access to the admin endpoints.
+func adminsCommand(cfg *Config, args []string) error {
+	if len(args) != 2 {
+		return errors.New("usage: registrar admins grant|revoke <email>")
+	}
+
+	store, err := storage.NewClient(&storage.Config{
+		Database: cfg.Database,
+	})
+	if err != nil {
+		return err
+	}
+	defer store.Close()
+
+	user, err := store.Users.FindByEmail(args[1])
+	if err != nil {
+		return fmt.Errorf("unknown user %q", args[1])
+	}
+
+	switch args[0] {
+	case "grant":
+		return store.Users.SetAdmin(user, true)
+	case "revoke":
+		return store.Users.SetAdmin(user, false)
+	default:
+		return fmt.Errorf("unknown admins command %q", args[0])
+	}
+}
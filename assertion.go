@@ -0,0 +1,321 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"encoding/json"
+	"net/http"
+
+	"github.com/dgrijalva/jwt-go"
+	"github.com/gorilla/context"
+
+	"github.com/paulrosania/go-validation"
+	"github.com/paulrosania/registrar/storage"
+)
+
+// JWT assertions (RFC 7523) are signed by clients with keys from their
+// registered JWK set, and may be used either to authenticate the client or
+// as an authorization grant.
+const (
+	clientAssertionType = "urn:ietf:params:oauth:client-assertion-type:jwt-bearer"
+	jwtBearerGrantType  = "urn:ietf:params:oauth:grant-type:jwt-bearer"
+)
+
+// Assertions are meant to be used immediately. Capping their lifetime also
+// caps how long we need to remember their ids to prevent replays.
+const maxAssertionLifetime = time.Hour
+
+// audienceMatches reports whether a JWT aud claim (a string or an array of
+// strings) contains any of the given audiences.
+func audienceMatches(aud interface{}, audiences ...string) bool {
+	var values []interface{}
+	switch aud := aud.(type) {
+	case string:
+		values = []interface{}{aud}
+	case []interface{}:
+		values = aud
+	}
+
+	for _, v := range values {
+		for _, a := range audiences {
+			if v == a {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// verifyAssertion checks the signature and claims of a JWT assertion, and
+// records its id so that it can't be used again. If app is nil, the assertion
+// may have been issued by any client; otherwise it must have been issued by
+// app. The issuing client is returned.
+func verifyAssertion(ctx *Context, assertion string, app *storage.Application) (*jwt.Token, *storage.Application, error) {
+	t, err := jwt.Parse(assertion, func(t *jwt.Token) (interface{}, error) {
+		if _, ok := t.Method.(*jwt.SigningMethodRSA); !ok {
+			return nil, fmt.Errorf("unexpected signing method: %v", t.Header["alg"])
+		}
+
+		iss, _ := t.Claims["iss"].(string)
+		if app == nil {
+			found, err := ctx.Server.store.Apps.FindByClientId(iss)
+			if err != nil {
+				return nil, fmt.Errorf("unknown issuer %q", iss)
+			}
+			app = found
+		} else if iss != app.ClientId {
+			return nil, errors.New("assertion was issued by another client")
+		}
+
+		if app.Jwks == "" {
+			return nil, errors.New("client has no registered keys")
+		}
+
+		ks, err := ParseJWKSet(app.Jwks)
+		if err != nil {
+			return nil, errors.New("client has invalid registered keys")
+		}
+
+		kid, _ := t.Header["kid"].(string)
+		key := ks.Find(kid)
+		if key == nil {
+			return nil, fmt.Errorf("unknown signing key: %v", kid)
+		}
+		return key.PublicKey()
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// jwt-go checks exp when it is present, but assertions must have one.
+	exp, ok := t.Claims["exp"].(float64)
+	if !ok {
+		return nil, nil, errors.New("assertion has no expiry")
+	}
+
+	expiresAt := time.Unix(int64(exp), 0)
+	if expiresAt.After(time.Now().Add(maxAssertionLifetime)) {
+		return nil, nil, errors.New("assertion expires too far in the future")
+	}
+
+	baseUrl := ctx.Server.config.Server.BaseUrl
+	if !audienceMatches(t.Claims["aud"], baseUrl+"/token", baseUrl, ctx.Server.config.OpenID.Issuer) {
+		return nil, nil, errors.New("assertion is intended for another audience")
+	}
+
+	if _, ok := t.Claims["sub"].(string); !ok {
+		return nil, nil, errors.New("assertion has no subject")
+	}
+
+	jti, ok := t.Claims["jti"].(string)
+	if !ok || jti == "" {
+		return nil, nil, errors.New("assertion has no id")
+	}
+
+	err = ctx.Server.store.Apps.RecordAssertion(app, jti, expiresAt)
+	if err == storage.ErrNotUnique {
+		return nil, nil, errors.New("assertion has already been used")
+	} else if err != nil {
+		return nil, nil, err
+	}
+
+	return t, app, nil
+}
+
+// findClientByAssertion authenticates a client using the private_key_jwt
+// method: the client presents an assertion about itself, signed with one of
+// its registered keys.
+func findClientByAssertion(ctx *Context) (*storage.Application, error) {
+	r := ctx.Request
+
+	typ, err := readOneFormValue(r, "client_assertion_type")
+	if err != nil {
+		return nil, err
+	}
+	if typ != clientAssertionType {
+		return nil, NewOAuthError("invalid_client", fmt.Sprintf("unsupported client_assertion_type %q", typ))
+	}
+
+	assertion, err := readOneFormValue(r, "client_assertion")
+	if err != nil {
+		return nil, err
+	}
+
+	// client_id is optional, since the assertion identifies the client, but
+	// the two must agree if it is given.
+	clientId, err := readOneFormValueOptional(r, "client_id")
+	if err != nil {
+		return nil, err
+	}
+
+	var app *storage.Application
+	if clientId != "" {
+		app, err = ctx.Server.store.Apps.FindByClientId(clientId)
+		if err != nil {
+			return nil, NewOAuthError("invalid_client", "unknown client")
+		}
+	}
+
+	t, app, err := verifyAssertion(ctx, assertion, app)
+	if err != nil {
+		return nil, NewOAuthError("invalid_client", err.Error())
+	}
+
+	if t.Claims["sub"] != app.ClientId {
+		return nil, NewOAuthError("invalid_client", "assertion subject must be the client")
+	}
+
+	return app, nil
+}
+
+// jwtBearerGrantHandler issues an access token for the user named by the
+// subject of an assertion the client has signed. Clients can register their
+// own keys, so holding keys isn't enough: an admin must also have listed the
+// subject among those the client may assert.
+func jwtBearerGrantHandler(ctx *Context, w http.ResponseWriter) error {
+	r := ctx.Request
+	app := context.Get(r, CurrentPrincipal).(*storage.Application)
+
+	assertion, err := readOneFormValue(r, "assertion")
+	if err != nil {
+		return err
+	}
+
+	scope, err := readOneFormValueOptional(r, "scope")
+	if err != nil {
+		return err
+	}
+
+	t, _, err := verifyAssertion(ctx, assertion, app)
+	if err != nil {
+		return NewOAuthError("invalid_grant", err.Error())
+	}
+
+	sub := t.Claims["sub"].(string)
+	subjects, err := ctx.Server.store.Apps.AssertionSubjects(app)
+	if err != nil {
+		return NewOAuthError("internal_server_error", "could not authorize client")
+	}
+	if !hasScope(subjects, sub) {
+		return NewOAuthError("invalid_grant", "client may not assert this subject")
+	}
+
+	user, err := ctx.Server.store.Users.FindByEmail(sub)
+	if err != nil {
+		return NewOAuthError("invalid_grant", "unknown subject")
+	}
+
+	permitted, err := ctx.Server.store.Apps.PermittedScopes(app)
+	if err != nil {
+		return NewOAuthError("internal_server_error", "could not authorize client")
+	}
+
+	requested := parseScope(scope)
+	granted := formatScope(intersectScopes(requested, permitted))
+	if len(requested) > 0 && granted == "" {
+		return NewOAuthError("invalid_scope", "none of the requested scopes are permitted")
+	}
+
+	// No refresh token: the client can always sign a fresh assertion.
+	signedAccessToken, token, err := signUserAccessToken(ctx, app, user, granted, nil)
+	if err != nil {
+		return NewOAuthError("internal_server_error", "could not authorize client")
+	}
+
+	writeJson(w, TokenResponse{
+		AccessToken: signedAccessToken,
+		TokenType:   "bearer",
+		ExpiresIn:   int(storage.AccessTokenLifetime / time.Second),
+		Scope:       token.Scope,
+	})
+	return nil
+}
+
+// AssertionSubject names a user that a client may assert with the JWT bearer
+// grant.
+type AssertionSubject struct {
+	Subject string `json:"subject"`
+}
+
+// GET /admin/clients/{client_id}/assertion_subjects
+func AssertionSubjectsHandler(ctx *Context, w http.ResponseWriter) error {
+	app, err := findAdminClient(ctx)
+	if err != nil {
+		return err
+	}
+
+	subjects, err := ctx.Server.store.Apps.AssertionSubjects(app)
+	if err != nil {
+		return NewOAuthError("internal_server_error", "could not load assertion subjects")
+	}
+
+	resp := []*AssertionSubject{}
+	for _, s := range subjects {
+		resp = append(resp, &AssertionSubject{s})
+	}
+
+	writeJson(w, resp)
+	return nil
+}
+
+func readAssertionSubject(r *http.Request) (*AssertionSubject, error) {
+	subject := &AssertionSubject{}
+	err := json.NewDecoder(r.Body).Decode(subject)
+	if err != nil {
+		return nil, NewOAuthError("invalid_request", err.Error())
+	}
+
+	v := validation.NewMultiValidator()
+	v.Assert(subject.Subject != "", "subject", "must not be empty")
+	if !v.Valid() {
+		err := NewOAuthError("invalid_request", "validation failed")
+		err.Meta["fields"] = v.Errors()
+		return nil, err
+	}
+
+	return subject, nil
+}
+
+// POST /admin/clients/{client_id}/assertion_subjects
+func AddAssertionSubjectHandler(ctx *Context, w http.ResponseWriter) error {
+	app, err := findAdminClient(ctx)
+	if err != nil {
+		return err
+	}
+
+	subject, err := readAssertionSubject(ctx.Request)
+	if err != nil {
+		return err
+	}
+
+	err = ctx.Server.store.Apps.AddAssertionSubject(app, subject.Subject)
+	if err != nil {
+		return NewOAuthError("internal_server_error", "could not add assertion subject")
+	}
+
+	writeJson(w, subject)
+	return nil
+}
+
+// DELETE /admin/clients/{client_id}/assertion_subjects
+func RemoveAssertionSubjectHandler(ctx *Context, w http.ResponseWriter) error {
+	app, err := findAdminClient(ctx)
+	if err != nil {
+		return err
+	}
+
+	subject, err := readAssertionSubject(ctx.Request)
+	if err != nil {
+		return err
+	}
+
+	err = ctx.Server.store.Apps.RemoveAssertionSubject(app, subject.Subject)
+	if err != nil {
+		return NewOAuthError("internal_server_error", "could not remove assertion subject")
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+	return nil
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/json"
+	"net/http"
+	"net/url"
+
+	"github.com/dgrijalva/jwt-go"
+
+	"github.com/paulrosania/registrar/storage"
+)
+
+func TestJwtBearerGrant(t *testing.T) {
+	s := newTestServer(t)
+	newTestUser(t, s, "paul@example.com")
+	newTestUser(t, s, "eve@example.com")
+
+	key, err := rsa.GenerateKey(rand.Reader, keySize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := rsa.GenerateKey(rand.Reader, keySize)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	jwks, err := json.Marshal(&JWKSet{Keys: []*JWK{NewSigningJWK(&key.PublicKey)}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	app := newTestApp(t, s, &storage.ApplicationParams{
+		Name:       "Batch",
+		GrantTypes: []string{jwtBearerGrantType},
+		Scope:      "openid email",
+		Jwks:       string(jwks),
+	})
+
+	err = s.store.Apps.AddAssertionSubject(app, "paul@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Only admins may let a client assert more subjects.
+	admin := newTestUser(t, s, "admin@example.com")
+	err = s.store.Users.SetAdmin(admin, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	console := newTestApp(t, s, &storage.ApplicationParams{
+		Name:       "Console",
+		GrantTypes: []string{"password"},
+		Scope:      "openid admin",
+	})
+
+	for _, user := range []struct {
+		email string
+		err   string
+	}{
+		{"paul@example.com", "access_denied"},
+		{"admin@example.com", ""},
+	} {
+		token := passwordGrant(t, s, console, user.email, "openid admin").AccessToken
+		req, _ := http.NewRequest("POST", "/admin/clients/"+app.ClientId+"/assertion_subjects", strings.NewReader(`{"subject": "admin@example.com"}`))
+		bearer(token)(req)
+
+		if typ := errorType(t, serve(s, req)); typ != user.err {
+			t.Errorf("%s adding a subject: expected error %q, got %q", user.email, user.err, typ)
+		}
+	}
+
+	cases := []struct {
+		name    string
+		key     *rsa.PrivateKey
+		issuer  string
+		subject string
+		aud     string
+		expires time.Duration
+		jti     string
+		err     string
+	}{
+		{"allowed subject", key, app.ClientId, "paul@example.com", "https://api.example.com/token", time.Minute, "1", ""},
+		{"replayed", key, app.ClientId, "paul@example.com", "https://api.example.com/token", time.Minute, "1", "invalid_grant"},
+		{"issuer as audience", key, app.ClientId, "paul@example.com", "https://example.com", time.Minute, "2", ""},
+		{"subject not allowed", key, app.ClientId, "eve@example.com", "https://api.example.com/token", time.Minute, "3", "invalid_grant"},
+		{"subject allowed by an admin", key, app.ClientId, "admin@example.com", "https://api.example.com/token", time.Minute, "4", ""},
+		{"another audience", key, app.ClientId, "paul@example.com", "https://other.example.com", time.Minute, "5", "invalid_grant"},
+		{"another issuer", key, "someone-else", "paul@example.com", "https://api.example.com/token", time.Minute, "6", "invalid_grant"},
+		{"expired", key, app.ClientId, "paul@example.com", "https://api.example.com/token", -time.Minute, "7", "invalid_grant"},
+		{"long-lived", key, app.ClientId, "paul@example.com", "https://api.example.com/token", 2 * time.Hour, "8", "invalid_grant"},
+		{"unregistered key", other, app.ClientId, "paul@example.com", "https://api.example.com/token", time.Minute, "9", "invalid_grant"},
+		{"no id", key, app.ClientId, "paul@example.com", "https://api.example.com/token", time.Minute, "", "invalid_grant"},
+	}
+
+	for _, c := range cases {
+		assertion := jwt.New(jwt.SigningMethodRS256)
+		assertion.Header["kid"] = keyThumbprint(&c.key.PublicKey)
+		assertion.Claims["iss"] = c.issuer
+		assertion.Claims["sub"] = c.subject
+		assertion.Claims["aud"] = c.aud
+		assertion.Claims["exp"] = time.Now().Add(c.expires).Unix()
+		if c.jti != "" {
+			assertion.Claims["jti"] = c.jti
+		}
+
+		signed, err := assertion.SignedString(c.key)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		w := postForm(s, "/token", url.Values{
+			"grant_type": {jwtBearerGrantType},
+			"assertion":  {signed},
+			"scope":      {"openid email profile"},
+		}, app.ClientId, app.ClientSecret)
+		if typ := errorType(t, w); typ != c.err {
+			t.Errorf("%s: expected error %q, got %q", c.name, c.err, typ)
+			continue
+		}
+		if c.err != "" {
+			continue
+		}
+
+		var resp TokenResponse
+		decodeJson(t, w, &resp)
+		if resp.Scope != "openid email" || resp.RefreshToken != "" {
+			t.Errorf("%s: expected an access token with scope %q and no refresh token, got %+v", c.name, "openid email", resp)
+		}
+	}
+}
@@ -1,17 +1,25 @@
 package main
 
 import (
+	"fmt"
+	"strings"
+
 	"encoding/base64"
 	"net/http"
-	"strings"
 
 	"github.com/gorilla/context"
+
+	"github.com/paulrosania/registrar/storage"
 )
 
 type key int
 
 var CurrentPrincipal key = 0
 
+// CurrentAccessToken is the recorded access token (if any) the principal
+// presented as a bearer token.
+var CurrentAccessToken key = 1
+
 func parseBasicAuth(data64 string) (email, password string, err error) {
 	codec := base64.StdEncoding
 	data, err := codec.DecodeString(data64)
@@ -33,7 +41,21 @@ func findUserByBearerAuth(ctx *Context, s string) (interface{}, error) {
 		return nil, err
 	}
 
-	return ctx.Server.store.Users.FindByEmail(token.Claims["sub"].(string))
+	// Only access tokens are bearer credentials. They carry a jti, are
+	// recorded when issued, and must not have since been revoked. Anything
+	// else we sign (ID tokens, userinfo responses) is turned away.
+	jti, ok := token.Claims["jti"].(string)
+	if !ok {
+		return nil, NewOAuthError("access_denied", "not an access token")
+	}
+
+	t, err := ctx.Server.store.Tokens.FindByValue("access_token", jti)
+	if err != nil || t.UserId == 0 {
+		return nil, NewOAuthError("access_denied", "token is invalid or has been revoked")
+	}
+	context.Set(ctx.Request, CurrentAccessToken, t)
+
+	return ctx.Server.store.Users.FindById(t.UserId)
 }
 
 func findUserByBasicAuth(ctx *Context, token string) (user interface{}, err error) {
@@ -49,7 +71,22 @@ func findClientByBasicAuth(ctx *Context, token string) (client interface{}, err
 	if err != nil {
 		return nil, NewOAuthError("invalid_request", "invalid basic credentials")
 	}
-	return ctx.Server.store.Apps.FindByCredentials(id, secret)
+
+	app, err := ctx.Server.store.Apps.FindByCredentials(id, secret)
+	if err != nil {
+		return nil, err
+	}
+
+	return app, checkAuthMethod(app, "client_secret_basic")
+}
+
+// checkAuthMethod makes sure a client authenticated the way it registered to
+// (its token_endpoint_auth_method).
+func checkAuthMethod(app *storage.Application, method string) error {
+	if app.TokenEndpointAuthMethod != method {
+		return NewOAuthError("invalid_client", fmt.Sprintf("client must authenticate with %s", app.TokenEndpointAuthMethod))
+	}
+	return nil
 }
 
 func detectBasicUser(handler HandlerFunc) HandlerFunc {
@@ -97,7 +134,7 @@ func parseInlineClientAuth(r *http.Request) (clientId, clientSecret string, err
 		return
 	}
 
-	clientSecret, err = readOneFormValue(r, "client_secret")
+	clientSecret, err = readOneFormValueOptional(r, "client_secret")
 	if err != nil {
 		return
 	}
@@ -105,25 +142,67 @@ func parseInlineClientAuth(r *http.Request) (clientId, clientSecret string, err
 	return
 }
 
+// findPublicClient identifies a client by id alone. Only public clients may
+// do this; confidential clients must always present their secret.
+func findPublicClient(ctx *Context, clientId string) (*storage.Application, error) {
+	client, err := ctx.Server.store.Apps.FindByClientId(clientId)
+	if err != nil {
+		return nil, err
+	}
+
+	if !client.IsPublic() {
+		return nil, NewOAuthError("invalid_client", "client authentication required")
+	}
+
+	return client, nil
+}
+
 func detectInlineClientAuth(handler HandlerFunc) HandlerFunc {
 	return HandlerFunc(func(ctx *Context, w http.ResponseWriter) error {
 		r := ctx.Request
-		if _, ok := context.GetOk(r, CurrentPrincipal); !ok {
+		defer context.Clear(r)
+
+		if _, ok := context.GetOk(r, CurrentPrincipal); !ok && isAssertionClientAuth(r) {
+			// As with basic auth, a client that presents an assertion gets
+			// booted if it fails.
+			client, err := findClientByAssertion(ctx)
+			if err != nil {
+				return err
+			}
+			if err := checkAuthMethod(client, "private_key_jwt"); err != nil {
+				return err
+			}
+			context.Set(r, CurrentPrincipal, client)
+		} else if !ok {
 			clientId, clientSecret, err := parseInlineClientAuth(r)
 
 			if err == nil {
-				client, err := ctx.Server.store.Apps.FindByCredentials(clientId, clientSecret)
+				var client *storage.Application
+				if clientSecret == "" {
+					client, err = findPublicClient(ctx, clientId)
+				} else {
+					client, err = ctx.Server.store.Apps.FindByCredentials(clientId, clientSecret)
+					if err == nil {
+						if err := checkAuthMethod(client, "client_secret_post"); err != nil {
+							return err
+						}
+					}
+				}
 				if err == nil {
 					context.Set(r, CurrentPrincipal, client)
 				}
 			}
 		}
 
-		defer context.Clear(r)
 		return handler(ctx, w)
 	})
 }
 
+func isAssertionClientAuth(r *http.Request) bool {
+	err := r.ParseForm()
+	return err == nil && r.PostForm.Get("client_assertion_type") != ""
+}
+
 func detectAuthWithFinders(handler HandlerFunc, finders map[string]AuthFinder) HandlerFunc {
 	return HandlerFunc(func(ctx *Context, w http.ResponseWriter) error {
 		r := ctx.Request
@@ -154,7 +233,6 @@ func detectAuthWithFinders(handler HandlerFunc, finders map[string]AuthFinder) H
 						default:
 							return NewOAuthError("access_denied", "invalid credentials")
 						}
-						return err
 					}
 
 					if principal != nil {
@@ -169,6 +247,52 @@ func detectAuthWithFinders(handler HandlerFunc, finders map[string]AuthFinder) H
 	})
 }
 
+// requireAdmin must be wrapped in detectUser and requireAuth. The user must
+// be an admin, and have presented an access token carrying the admin scope.
+func requireAdmin(handler HandlerFunc) HandlerFunc {
+	return HandlerFunc(func(ctx *Context, w http.ResponseWriter) error {
+		user, ok := context.Get(ctx.Request, CurrentPrincipal).(*storage.User)
+		if !ok || !user.Admin {
+			return NewOAuthError("access_denied", "admin role required")
+		}
+
+		t, ok := context.Get(ctx.Request, CurrentAccessToken).(*storage.Token)
+		if !ok || !hasScope(parseScope(t.Scope), "admin") {
+			return NewOAuthError("access_denied", "admin scope required")
+		}
+
+		return handler(ctx, w)
+	})
+}
+
+// requireFrontend must be wrapped in detectUser. It guards actions only users
+// themselves should take, such as approving clients: the user must have
+// presented their own credentials, or an access token issued to the
+// first-party frontend. Other clients' tokens never qualify, whatever their
+// scope.
+func requireFrontend(handler HandlerFunc) HandlerFunc {
+	return HandlerFunc(func(ctx *Context, w http.ResponseWriter) error {
+		if !fromFrontend(ctx) {
+			return NewOAuthError("access_denied", "only the frontend may do this on the user's behalf")
+		}
+
+		return handler(ctx, w)
+	})
+}
+
+// fromFrontend reports whether a request detected by detectUser was made by
+// the user with their own credentials, or by the first-party frontend.
+func fromFrontend(ctx *Context) bool {
+	t, ok := context.Get(ctx.Request, CurrentAccessToken).(*storage.Token)
+	if !ok {
+		return true
+	}
+
+	frontend := ctx.Server.config.Server.FrontendClientId
+	app, err := ctx.Server.store.Apps.FindById(t.ClientId)
+	return err == nil && frontend != "" && app.ClientId == frontend
+}
+
 // Doesn't check auth type since CurrentPrincipal can only be of a detected type
 // anyway. If you wrap your handler in a detector for the wrong type, things
 // will break.
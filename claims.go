@@ -0,0 +1,45 @@
+package main
+
+import (
+	"github.com/paulrosania/registrar/storage"
+)
+
+// The standard claims each scope releases, per OpenID Connect Core section
+// 5.4. These must be kept in sync with claims_supported in discovery.
+var scopeClaims = map[string][]string{
+	"email":   {"email", "email_verified"},
+	"profile": {"name", "given_name", "family_name", "locale", "picture"},
+}
+
+// userClaims returns sub, plus the claims about user that the given scopes
+// release. Claims we hold no value for are omitted.
+func userClaims(user *storage.User, scopes []string) map[string]interface{} {
+	available := map[string]interface{}{
+		"email":          user.Email,
+		"email_verified": user.EmailVerified,
+	}
+	for name, v := range map[string]string{
+		"name":        user.Name,
+		"given_name":  user.GivenName,
+		"family_name": user.FamilyName,
+		"locale":      user.Locale,
+		"picture":     user.Picture,
+	} {
+		if v != "" {
+			available[name] = v
+		}
+	}
+
+	claims := map[string]interface{}{
+		"sub": user.Email,
+	}
+	for _, scope := range scopes {
+		for _, name := range scopeClaims[scope] {
+			if v, ok := available[name]; ok {
+				claims[name] = v
+			}
+		}
+	}
+
+	return claims
+}
@@ -4,9 +4,17 @@ type AccountsService struct {
 	client *Client
 }
 
+// Account holds the claims userinfo releases for the scopes the access token
+// was granted; profile claims are only present with the profile scope.
 type Account struct {
-	Id    int    `json:"id"`
-	Email string `json:"email"`
+	Sub           string `json:"sub"`
+	Email         string `json:"email"`
+	EmailVerified bool   `json:"email_verified"`
+	Name          string `json:"name,omitempty"`
+	GivenName     string `json:"given_name,omitempty"`
+	FamilyName    string `json:"family_name,omitempty"`
+	Locale        string `json:"locale,omitempty"`
+	Picture       string `json:"picture,omitempty"`
 }
 
 type AccountParams struct {
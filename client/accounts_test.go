@@ -38,6 +38,7 @@ func TestAccountsCurrent(t *testing.T) {
 	endpoint := RegisterResponder("GET", "http://api.example.com/auth/userinfo",
 		func(req *http.Request) (*http.Response, error) {
 			account := Account{
+				Sub:   "paul@example.com",
 				Email: "paul@example.com",
 			}
 			return httpmock.NewJsonResponse(200, account)
@@ -57,6 +58,10 @@ func TestAccountsCurrent(t *testing.T) {
 		t.Fatalf("expected account, got nil")
 	}
 
+	if account.Sub != "paul@example.com" {
+		t.Errorf("expected sub to be \"paul@example.com\", got %q", account.Sub)
+	}
+
 	if account.Email != "paul@example.com" {
 		t.Errorf("expected email to be \"paul@example.com\", got %q", account.Email)
 	}
@@ -8,6 +8,24 @@ type Config struct {
 	Server struct {
 		Bind    string
 		BaseUrl string `toml:"base-url"`
+
+		// The frontend page where users enter device user codes. Defaults to
+		// /device under the OpenID issuer.
+		DeviceVerificationUrl string `toml:"device-verification-url"`
+
+		// The frontend page that relying parties' logout requests are sent on
+		// to, to be confirmed by the signed-in user. Defaults to /logout under
+		// the OpenID issuer.
+		EndSessionUrl string `toml:"end-session-url"`
+
+		// The client id of the first-party frontend. Only its access tokens
+		// (or a user's own password) may approve authorization and device
+		// requests or edit the user's profile. If unset, only passwords may.
+		FrontendClientId string `toml:"frontend-client-id"`
+
+		// If set, metrics are served at /debug/vars on this address, which
+		// should not be reachable from outside.
+		MetricsBind string `toml:"metrics-bind"`
 	}
 
 	OpenID struct {
@@ -15,8 +33,28 @@ type Config struct {
 	}
 
 	JWT struct {
-		PublicKey  string `toml:"public-key"`  // openssl genrsa -out registrar.rsa <key-size>
-		PrivateKey string `toml:"private-key"` // openssl rsa -in registrar.rsa -pubout > registrar.rsa.pub
+		PublicKey   string   `toml:"public-key"`   // openssl genrsa -out registrar.rsa <key-size>
+		PrivateKey  string   `toml:"private-key"`  // openssl rsa -in registrar.rsa -pubout > registrar.rsa.pub
+		RetiredKeys []string `toml:"retired-keys"` // public keys still accepted for verification
+
+		// If set, keys are loaded from this directory (managed with `registrar
+		// keys`) instead of from the settings above.
+		KeyDir string `toml:"key-dir"`
+	}
+
+	Registration struct {
+		// Bearer tokens that allow clients to be registered at /clients.
+		// Admins holding access tokens with the admin scope may always
+		// register clients.
+		InitialAccessTokens []string `toml:"initial-access-tokens"`
+	}
+
+	// Expired and revoked tokens, and codes that were never redeemed, are
+	// deleted in the background. Times are in seconds.
+	Janitor struct {
+		Interval  int // defaults to an hour; negative disables cleanup
+		Retention int // how long to keep tokens after they expire or are revoked; defaults to 0
+		BatchSize int `toml:"batch-size"` // rows deleted per statement; defaults to 1000
 	}
 
 	Log struct {
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"net/http"
+
+	"github.com/gorilla/context"
+	"github.com/gorilla/mux"
+
+	"github.com/paulrosania/registrar/storage"
+)
+
+// ConsentPrompt is returned by the authorization endpoint when the user must
+// approve a request before it can proceed. The frontend shows it to the user,
+// then repeats the request with their decision.
+type ConsentPrompt struct {
+	ConsentRequired bool             `json:"consent_required"`
+	Client          ConsentClient    `json:"client"`
+	Scopes          []*storage.Scope `json:"scopes"`
+}
+
+type ConsentClient struct {
+	ClientId    string `json:"client_id"`
+	Name        string `json:"name"`
+	Description string `json:"description"`
+	Website     string `json:"website"`
+	Logo        string `json:"logo"`
+}
+
+func writeConsentPrompt(ctx *Context, w http.ResponseWriter, app *storage.Application, scopes []string) error {
+	details, err := ctx.Server.store.Apps.FindScopes(scopes)
+	if err != nil {
+		return NewOAuthError("internal_server_error", "could not load scopes")
+	}
+
+	if details == nil {
+		details = []*storage.Scope{}
+	}
+
+	writeJson(w, ConsentPrompt{
+		ConsentRequired: true,
+		Client: ConsentClient{
+			ClientId:    app.ClientId,
+			Name:        app.Name,
+			Description: app.Description,
+			Website:     app.Website,
+			Logo:        app.Logo,
+		},
+		Scopes: details,
+	})
+	return nil
+}
+
+// GET /accounts/me/authorizations
+func AuthorizationsHandler(ctx *Context, w http.ResponseWriter) error {
+	user := context.Get(ctx.Request, CurrentPrincipal).(*storage.User)
+
+	auths, err := ctx.Server.store.Users.Authorizations(user.Id)
+	if err != nil {
+		return NewOAuthError("internal_server_error", "could not load authorizations")
+	}
+
+	if auths == nil {
+		auths = []*storage.Authorization{}
+	}
+
+	writeJson(w, auths)
+	return nil
+}
+
+// DELETE /accounts/me/authorizations/{client_id}
+func RevokeAuthorizationHandler(ctx *Context, w http.ResponseWriter) error {
+	user := context.Get(ctx.Request, CurrentPrincipal).(*storage.User)
+
+	app, err := ctx.Server.store.Apps.FindByClientId(mux.Vars(ctx.Request)["client_id"])
+	if err != nil {
+		return NewOAuthError("invalid_request", "unknown client")
+	}
+
+	err = ctx.Server.store.Users.RevokeAuthorization(user.Id, app.Id)
+	if err != nil {
+		return NewOAuthError("internal_server_error", "could not revoke authorization")
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+	return nil
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"testing"
+
+	"net/http"
+	"net/url"
+
+	"github.com/paulrosania/registrar/storage"
+)
+
+func TestConsent(t *testing.T) {
+	s := newTestServer(t)
+	newTestUser(t, s, "paul@example.com")
+	frontendToken := newFrontend(t, s, "paul@example.com")
+
+	app := newTestApp(t, s, &storage.ApplicationParams{
+		Name:          "Web",
+		GrantTypes:    []string{"authorization_code", "password"},
+		ResponseTypes: []string{"code"},
+		RedirectUris:  []string{"https://app.example.com/cb"},
+		Scope:         "openid email profile",
+	})
+	appToken := passwordGrant(t, s, app, "paul@example.com", "openid").AccessToken
+
+	// Cases run in order, each seeing the consent recorded (or revoked) by
+	// the ones before. want is "prompt" for a consent prompt, "code" for an
+	// authorization code, or the error the client is sent.
+	cases := []struct {
+		name     string
+		method   string
+		auth     func(*http.Request)
+		scope    string
+		prompt   string
+		decision string
+		revoke   bool
+		want     string
+	}{
+		{"first request", "GET", basicUser, "openid email", "", "", false, "prompt"},
+		{"no prompt allowed", "GET", basicUser, "openid email", "none", "", false, "consent_required"},
+		{"denied", "POST", basicUser, "openid email", "", "deny", false, "access_denied"},
+		{"approved by a client", "POST", bearer(appToken), "openid email", "", "approve", false, "access_denied"},
+		{"approved", "POST", basicUser, "openid email", "", "approve", false, "code"},
+		{"remembered", "GET", basicUser, "openid email", "", "", false, "code"},
+		{"remembered, no prompt allowed", "GET", basicUser, "openid", "none", "", false, "code"},
+		{"prompt requested", "GET", basicUser, "openid email", "consent", "", false, "prompt"},
+		{"new scope", "GET", basicUser, "openid email profile", "", "", false, "prompt"},
+		{"approved by the frontend", "POST", bearer(frontendToken), "openid email profile", "", "approve", false, "code"},
+		{"revoked", "GET", basicUser, "openid", "", "", true, "prompt"},
+	}
+
+	for _, c := range cases {
+		if c.revoke {
+			req, _ := http.NewRequest("DELETE", "/accounts/me/authorizations/"+app.ClientId, nil)
+			basicUser(req)
+			if w := serve(s, req); w.Code != http.StatusNoContent {
+				t.Fatalf("%s: expected 204 revoking the authorization, got %d: %s", c.name, w.Code, w.Body)
+			}
+		}
+
+		w := authorize(s, c.method, url.Values{
+			"client_id":     {app.ClientId},
+			"redirect_uri":  {"https://app.example.com/cb"},
+			"response_type": {"code"},
+			"scope":         {c.scope},
+			"prompt":        {c.prompt},
+			"decision":      {c.decision},
+		}, c.auth)
+
+		// Only the user may record a decision; the request never gets as
+		// far as the client.
+		if w.Code == http.StatusUnauthorized {
+			if typ := errorType(t, w); typ != c.want {
+				t.Errorf("%s: expected %s, got %q", c.name, c.want, typ)
+			}
+			continue
+		}
+
+		var got string
+		if c.want == "prompt" {
+			var prompt ConsentPrompt
+			decodeJson(t, w, &prompt)
+			if prompt.ConsentRequired {
+				got = "prompt"
+			}
+			if len(prompt.Scopes) != len(parseScope(c.scope)) {
+				t.Errorf("%s: expected a prompt for %q, got %+v", c.name, c.scope, prompt.Scopes)
+			}
+		} else {
+			q := authorizeRedirect(t, w).Query()
+			got = q.Get("error")
+			if q.Get("code") != "" {
+				got = "code"
+			}
+		}
+
+		if got != c.want {
+			t.Errorf("%s: expected %s, got %q", c.name, c.want, got)
+		}
+	}
+
+	// Clients holding the user's token may neither see which other clients
+	// the user has authorized, nor revoke them.
+	for _, c := range []struct {
+		method string
+		path   string
+		auth   func(*http.Request)
+		err    string
+	}{
+		{"GET", "/accounts/me/authorizations", bearer(appToken), "access_denied"},
+		{"DELETE", "/accounts/me/authorizations/" + app.ClientId, bearer(appToken), "access_denied"},
+		{"GET", "/accounts/me/authorizations", bearer(frontendToken), ""},
+		{"DELETE", "/accounts/me/authorizations/" + app.ClientId, bearer(frontendToken), ""},
+	} {
+		req, _ := http.NewRequest(c.method, c.path, nil)
+		c.auth(req)
+		if typ := errorType(t, serve(s, req)); typ != c.err {
+			t.Errorf("%s %s: expected error %q, got %q", c.method, c.path, c.err, typ)
+		}
+	}
+}
@@ -4,10 +4,16 @@ import (
 	"errors"
 	"fmt"
 	"log"
+	"regexp"
+	"strings"
+	"time"
 
 	"encoding/json"
 	"net/http"
+	"net/url"
+	"unicode/utf8"
 
+	"github.com/dgrijalva/jwt-go"
 	"github.com/gorilla/context"
 
 	"github.com/paulrosania/go-validation"
@@ -51,7 +57,26 @@ func readOneFormValue(r *http.Request, key string) (val string, err error) {
 }
 
 func readOneFormValueOptional(r *http.Request, key string) (val string, err error) {
-	vals := r.PostForm[key]
+	return readOneValueOptional(r.PostForm, key)
+}
+
+// readOneParam is like readOneFormValue, but also accepts values passed in the
+// URL query string.
+func readOneParam(r *http.Request, key string) (val string, err error) {
+	val, err = readOneParamOptional(r, key)
+	if val == "" && err == nil {
+		return "", NewOAuthError("invalid_request", fmt.Sprintf("missing required parameter %q", key))
+	}
+
+	return
+}
+
+func readOneParamOptional(r *http.Request, key string) (val string, err error) {
+	return readOneValueOptional(r.Form, key)
+}
+
+func readOneValueOptional(form url.Values, key string) (val string, err error) {
+	vals := form[key]
 
 	switch len(vals) {
 	case 1:
@@ -67,30 +92,40 @@ func readOneFormValueOptional(r *http.Request, key string) (val string, err erro
 func OpenIdConfigurationHandler(ctx *Context, w http.ResponseWriter) error {
 	baseUrl := ctx.Server.config.Server.BaseUrl
 	cfg := map[string]interface{}{
-		"issuer":                 baseUrl,
-		"authorization_endpoint": baseUrl + "/auth",
-		"token_endpoint":         baseUrl + "/token",
-		"userinfo_endpoint":      baseUrl + "/userinfo",
-		"revocation_endpoint":    baseUrl + "/revoke",
-		"jwks_uri":               baseUrl + "/certs",
+		"issuer":                        baseUrl,
+		"authorization_endpoint":        baseUrl + "/authorize",
+		"token_endpoint":                baseUrl + "/token",
+		"userinfo_endpoint":             baseUrl + "/userinfo",
+		"revocation_endpoint":           baseUrl + "/revoke",
+		"end_session_endpoint":          baseUrl + "/end_session",
+		"introspection_endpoint":        baseUrl + "/introspect",
+		"device_authorization_endpoint": baseUrl + "/device_authorization",
+		"jwks_uri":                      baseUrl + "/certs",
+		"registration_endpoint":         baseUrl + "/clients",
 		"scopes_supported": []string{
 			"openid",
 			"email",
 			"profile"},
-		"response_types_supported": []string{
-			"code",
-			"token",
-			"id_token",
-			"code token",
-			"code id_token",
-			"code token id_token",
-			"none"},
+		"response_types_supported":              []string{"code"},
 		"id_token_signing_alg_values_supported": []string{"RS256"},
-		"token_endpoint_auth_methods_supported": []string{"client_secret_basic"},
-		"subject_types_supported":               []string{"public"},
+		"userinfo_signing_alg_values_supported": userinfoSigningAlgs,
+		"token_endpoint_auth_methods_supported": []string{
+			"client_secret_basic",
+			"client_secret_post",
+			"private_key_jwt",
+			"none",
+		},
+		"token_endpoint_auth_signing_alg_values_supported": []string{"RS256"},
+		"code_challenge_methods_supported":                 []string{"S256", "plain"},
+		"backchannel_logout_supported":                     true,
+		"subject_types_supported":                          []string{"public"},
 		"grant_types_supported": []string{
 			"authorization_code",
-			"implicit",
+			"client_credentials",
+			"refresh_token",
+			deviceCodeGrantType,
+			tokenExchangeGrantType,
+			jwtBearerGrantType,
 		},
 		"claims_supported": []string{
 			"aud",
@@ -111,22 +146,290 @@ func OpenIdConfigurationHandler(ctx *Context, w http.ResponseWriter) error {
 	return nil
 }
 
-// GET /userinfo
+// Relying parties should pick up new keys within this many seconds.
+const certsMaxAge = 3600
+
+// GET /certs
+func CertsHandler(ctx *Context, w http.ResponseWriter) error {
+	keys := &JWKSet{}
+	for _, k := range ctx.Server.Keys().Keys() {
+		keys.Keys = append(keys.Keys, NewSigningJWK(k.Public))
+	}
+
+	w.Header().Set("Cache-Control", fmt.Sprintf("public, max-age=%d", certsMaxAge))
+	writeJson(w, keys)
+	return nil
+}
+
+// GET, POST /userinfo
+//
+// Only the claims released by the scopes granted to the presented access
+// token are returned. Clients that registered for signed responses receive a
+// JWT instead of plain JSON.
 func UserinfoHandler(ctx *Context, w http.ResponseWriter) error {
-	// TODO: return valid userinfo response (sub is required)
-	if u, ok := context.GetOk(ctx.Request, CurrentPrincipal); ok {
-		writeJson(w, u)
-	} else {
+	r := ctx.Request
+	u, ok := context.GetOk(r, CurrentPrincipal)
+	if !ok {
 		return errors.New("failed to retrieve user")
 	}
+	user := u.(*storage.User)
+
+	var scopes []string
+	var app *storage.Application
+	if t, ok := context.GetOk(r, CurrentAccessToken); ok {
+		token := t.(*storage.Token)
+		scopes = parseScope(token.Scope)
+
+		var err error
+		app, err = ctx.Server.store.Apps.FindById(token.ClientId)
+		if err != nil {
+			return NewOAuthError("internal_server_error", "could not load client")
+		}
+	}
+
+	claims := userClaims(user, scopes)
+	if app == nil || app.UserinfoSignedResponseAlg == "" {
+		writeJson(w, claims)
+		return nil
+	}
+
+	seconds := int(storage.AccessTokenLifetime / time.Second)
+	token := NewJWT(ctx.Server.config.OpenID.Issuer, app.ClientId, user.Email, seconds)
+	for k, v := range claims {
+		if _, ok := token.Claims[k]; !ok {
+			token.Claims[k] = v
+		}
+	}
+	signed, err := ctx.Server.SignJWT(token)
+	if err != nil {
+		return NewOAuthError("internal_server_error", "could not sign response")
+	}
+
+	w.Header().Set("Content-Type", "application/jwt")
+	fmt.Fprintln(w, signed)
+	return nil
+}
+
+// isValidCodeVerifier checks that s is 43-128 characters from the unreserved
+// set, as RFC 7636 requires of both verifiers and challenges.
+func isValidCodeVerifier(s string) bool {
+	if len(s) < 43 || len(s) > 128 {
+		return false
+	}
+
+	for _, c := range s {
+		switch {
+		case 'A' <= c && c <= 'Z', 'a' <= c && c <= 'z', '0' <= c && c <= '9':
+		case c == '-', c == '.', c == '_', c == '~':
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// redirectWithParams returns uri with params merged into its query string.
+func redirectWithParams(uri *url.URL, params url.Values) string {
+	u := *uri
+	q := u.Query()
+	for k, vs := range params {
+		for _, v := range vs {
+			if v != "" {
+				q.Add(k, v)
+			}
+		}
+	}
+	u.RawQuery = q.Encode()
+	return u.String()
+}
+
+// GET, POST /authorize
+//
+// The frontend calls this on behalf of a signed-in user. Rather than
+// redirecting, it responds with the URI the user agent should be sent to,
+// which carries either the authorization code or an error.
+func AuthorizeHandler(ctx *Context, w http.ResponseWriter) error {
+	r := ctx.Request
+	user := context.Get(r, CurrentPrincipal).(*storage.User)
+
+	err := r.ParseForm()
+	if err != nil {
+		return NewOAuthError("invalid_request", err.Error())
+	}
+
+	clientId, err := readOneParam(r, "client_id")
+	if err != nil {
+		return err
+	}
+
+	rawRedirectUri, err := readOneParam(r, "redirect_uri")
+	if err != nil {
+		return err
+	}
+
+	app, err := ctx.Server.store.Apps.FindByClientId(clientId)
+	if err != nil {
+		return NewOAuthError("invalid_request", "unknown client")
+	}
 
+	// Until the redirect URI is known to be good, errors go to the frontend
+	// rather than the client.
+	redirectUri, err := url.Parse(rawRedirectUri)
+	if err != nil || !redirectUri.IsAbs() || redirectUri.Fragment != "" {
+		return NewOAuthError("invalid_request", "invalid redirect_uri")
+	}
+
+	registered, err := findRegisteredRedirect(ctx, app, rawRedirectUri, "")
+	if err != nil {
+		return NewOAuthError("internal_server_error", "could not load registered redirects")
+	} else if registered == nil {
+		return NewOAuthError("invalid_request", "redirect_uri is not registered for this client")
+	}
+
+	state, err := readOneParamOptional(r, "state")
+	if err != nil {
+		return err
+	}
+
+	redirectError := func(typ, desc string) error {
+		writeJson(w, map[string]string{
+			"redirect_uri": redirectWithParams(redirectUri, url.Values{
+				"error":             {typ},
+				"error_description": {desc},
+				"state":             {state},
+			}),
+		})
+		return nil
+	}
+
+	responseType, err := readOneParam(r, "response_type")
+	if err != nil {
+		return redirectError("invalid_request", err.(*OAuthError).Description)
+	}
+	if responseType != "code" {
+		return redirectError("unsupported_response_type", fmt.Sprintf("unsupported response type %q", responseType))
+	}
+
+	registered, err = findRegisteredRedirect(ctx, app, rawRedirectUri, responseType)
+	if err != nil {
+		return NewOAuthError("internal_server_error", "could not load registered redirects")
+	} else if registered == nil {
+		return NewOAuthError("invalid_request", "redirect_uri is not registered for this response type")
+	}
+
+	scope, err := readOneParamOptional(r, "scope")
+	if err != nil {
+		return redirectError("invalid_request", err.(*OAuthError).Description)
+	}
+
+	permitted, err := ctx.Server.store.Apps.PermittedScopes(app)
+	if err != nil {
+		return redirectError("server_error", "could not load permitted scopes")
+	}
+
+	requested := parseScope(scope)
+	granted := intersectScopes(requested, permitted)
+	if len(requested) > 0 && len(granted) == 0 {
+		return redirectError("invalid_scope", "none of the requested scopes are permitted")
+	}
+
+	codeChallenge, err := readOneParamOptional(r, "code_challenge")
+	if err != nil {
+		return redirectError("invalid_request", err.(*OAuthError).Description)
+	}
+
+	codeChallengeMethod, err := readOneParamOptional(r, "code_challenge_method")
+	if err != nil {
+		return redirectError("invalid_request", err.(*OAuthError).Description)
+	}
+
+	if codeChallenge == "" {
+		if app.IsPublic() {
+			return redirectError("invalid_request", "public clients must provide a code_challenge")
+		}
+		if codeChallengeMethod != "" {
+			return redirectError("invalid_request", "code_challenge_method provided without code_challenge")
+		}
+	} else {
+		if codeChallengeMethod == "" {
+			codeChallengeMethod = "plain"
+		}
+		if codeChallengeMethod != "S256" && codeChallengeMethod != "plain" {
+			return redirectError("invalid_request", fmt.Sprintf("unsupported code_challenge_method %q", codeChallengeMethod))
+		}
+		if !isValidCodeVerifier(codeChallenge) {
+			return redirectError("invalid_request", "invalid code_challenge")
+		}
+	}
+
+	nonce, err := readOneParamOptional(r, "nonce")
+	if err != nil {
+		return redirectError("invalid_request", err.(*OAuthError).Description)
+	}
+
+	prompt, err := readOneParamOptional(r, "prompt")
+	if err != nil {
+		return redirectError("invalid_request", err.(*OAuthError).Description)
+	}
+
+	// The frontend passes the user's decision once they have been shown the
+	// consent prompt. Decisions must be POSTed.
+	decision, err := readOneFormValueOptional(r, "decision")
+	if err != nil {
+		return redirectError("invalid_request", err.(*OAuthError).Description)
+	}
+
+	switch decision {
+	case "approve":
+		err = ctx.Server.store.Users.RememberConsent(user.Id, app.Id, formatScope(granted))
+		if err != nil {
+			return redirectError("server_error", "could not record consent")
+		}
+	case "deny":
+		return redirectError("access_denied", "the user denied the request")
+	case "":
+		consented, err := ctx.Server.store.Users.Consent(user.Id, app.Id)
+		if err != nil {
+			return redirectError("server_error", "could not load consent")
+		}
+
+		if prompt == "consent" || !containsAll(parseScope(consented), granted) {
+			if prompt == "none" {
+				return redirectError("consent_required", "the user has not consented to the requested scopes")
+			}
+			return writeConsentPrompt(ctx, w, app, granted)
+		}
+	default:
+		return redirectError("invalid_request", fmt.Sprintf("unsupported decision %q", decision))
+	}
+
+	// The user is present and approving the request, so treat this as the
+	// moment they authenticated.
+	code, err := ctx.Server.store.Apps.NewAuthCode(app, user.Id, &storage.AuthCodeParams{
+		RedirectUri:         rawRedirectUri,
+		Scope:               formatScope(granted),
+		CodeChallenge:       codeChallenge,
+		CodeChallengeMethod: codeChallengeMethod,
+		Nonce:               nonce,
+		AuthTime:            time.Now(),
+	})
+	if err != nil {
+		return redirectError("server_error", "could not issue authorization code")
+	}
+
+	writeJson(w, map[string]string{
+		"redirect_uri": redirectWithParams(redirectUri, url.Values{
+			"code":  {code.Code},
+			"state": {state},
+		}),
+	})
 	return nil
 }
 
 func setCORSHeaders(w http.ResponseWriter) {
 	w.Header().Set("Access-Control-Allow-Origin", "*") // TODO: this is a security flaw (needs to be fixed to wherever the proxy lives)
-	w.Header().Set("Access-Control-Allow-Methods", "POST, GET, OPTIONS")
-	w.Header().Set("Access-Control-Allow-Headers", "Content-Type")
+	w.Header().Set("Access-Control-Allow-Methods", "POST, GET, PATCH, OPTIONS")
+	w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization")
 	w.Header().Set("Access-Control-Max-Age", "3600") // (seconds)
 }
 
@@ -148,6 +451,7 @@ func CreateAccountHandler(ctx *Context, w http.ResponseWriter) error {
 	v := validation.NewMultiValidator()
 	v.Assert(params.Email != "", "email", "must provide a email")
 	v.Assert(params.Password != "", "password", "must provide a password")
+	validateProfile(v, params)
 	if v.Valid() {
 		user, err := ctx.Server.store.Users.New(params)
 		if err == storage.ErrNotUnique {
@@ -169,6 +473,94 @@ func CreateAccountHandler(ctx *Context, w http.ResponseWriter) error {
 	return nil
 }
 
+const maxProfileNameLength = 255
+
+var localePattern = regexp.MustCompile(`^[a-zA-Z]{2,3}(-[a-zA-Z0-9]{2,8})*$`)
+
+// validateProfile checks the profile fields of params, which may be empty.
+func validateProfile(v *validation.MultiValidator, params *storage.UserParams) {
+	v.Assert(utf8.RuneCountInString(params.Name) <= maxProfileNameLength, "name", "too long")
+	v.Assert(utf8.RuneCountInString(params.GivenName) <= maxProfileNameLength, "given_name", "too long")
+	v.Assert(utf8.RuneCountInString(params.FamilyName) <= maxProfileNameLength, "family_name", "too long")
+	v.Assert(params.Locale == "" || localePattern.MatchString(params.Locale), "locale", "must be a BCP 47 language tag, like en-US")
+	v.Assert(params.Picture == "" || isWebUrl(params.Picture), "picture", "must be an http or https URL")
+}
+
+func isWebUrl(s string) bool {
+	u, err := url.Parse(s)
+	return err == nil && (u.Scheme == "http" || u.Scheme == "https") && u.Host != ""
+}
+
+// ProfilePatch holds the profile fields a user is changing. Fields left out
+// of the request are left as they are.
+type ProfilePatch struct {
+	Name       *string `json:"name"`
+	GivenName  *string `json:"given_name"`
+	FamilyName *string `json:"family_name"`
+	Locale     *string `json:"locale"`
+	Picture    *string `json:"picture"`
+}
+
+// GET /accounts/me
+func ProfileHandler(ctx *Context, w http.ResponseWriter) error {
+	setCORSHeaders(w)
+
+	user := context.Get(ctx.Request, CurrentPrincipal).(*storage.User)
+	writeJson(w, user)
+	return nil
+}
+
+// PATCH /accounts/me
+func UpdateProfileHandler(ctx *Context, w http.ResponseWriter) error {
+	setCORSHeaders(w)
+
+	user := context.Get(ctx.Request, CurrentPrincipal).(*storage.User)
+
+	patch := new(ProfilePatch)
+	err := json.NewDecoder(ctx.Request.Body).Decode(patch)
+	if err != nil {
+		return NewOAuthError("invalid_request", err.Error())
+	}
+
+	params := &storage.UserParams{
+		Name:       user.Name,
+		GivenName:  user.GivenName,
+		FamilyName: user.FamilyName,
+		Locale:     user.Locale,
+		Picture:    user.Picture,
+	}
+	for _, f := range []struct {
+		patch *string
+		param *string
+	}{
+		{patch.Name, &params.Name},
+		{patch.GivenName, &params.GivenName},
+		{patch.FamilyName, &params.FamilyName},
+		{patch.Locale, &params.Locale},
+		{patch.Picture, &params.Picture},
+	} {
+		if f.patch != nil {
+			*f.param = strings.TrimSpace(*f.patch)
+		}
+	}
+
+	v := validation.NewMultiValidator()
+	validateProfile(v, params)
+	if !v.Valid() {
+		err := NewOAuthError("invalid_request", "validation failed")
+		err.Meta["fields"] = v.Errors()
+		return err
+	}
+
+	updated, err := ctx.Server.store.Users.Update(user, params)
+	if err != nil {
+		return NewOAuthError("internal_server_error", "could not update profile")
+	}
+
+	writeJson(w, updated)
+	return nil
+}
+
 // GET /client
 func ClientHandler(ctx *Context, w http.ResponseWriter) error {
 	if c, ok := context.GetOk(ctx.Request, CurrentPrincipal); ok {
@@ -180,26 +572,141 @@ func ClientHandler(ctx *Context, w http.ResponseWriter) error {
 	return nil
 }
 
-// POST /clients
-func NewClientHandler(ctx *Context, w http.ResponseWriter) error {
+const deviceCodeGrantType = "urn:ietf:params:oauth:grant-type:device_code"
+
+// POST /device_authorization
+func DeviceAuthorizationHandler(ctx *Context, w http.ResponseWriter) error {
 	r := ctx.Request
+	app := context.Get(r, CurrentPrincipal).(*storage.Application)
 
 	err := r.ParseForm()
 	if err != nil {
 		return NewOAuthError("invalid_request", err.Error())
 	}
 
-	name, err := readOneFormValue(r, "name")
+	scope, err := readOneFormValueOptional(r, "scope")
 	if err != nil {
 		return err
 	}
 
-	client, err := ctx.Server.store.Apps.New(name, "", "", "", "secret")
+	permitted, err := ctx.Server.store.Apps.PermittedScopes(app)
+	if err != nil {
+		return NewOAuthError("internal_server_error", "could not load permitted scopes")
+	}
+
+	requested := parseScope(scope)
+	granted := intersectScopes(requested, permitted)
+	if len(requested) > 0 && len(granted) == 0 {
+		return NewOAuthError("invalid_scope", "none of the requested scopes are permitted")
+	}
+
+	code, err := ctx.Server.store.Apps.NewDeviceCode(app, formatScope(granted))
+	if err != nil {
+		return NewOAuthError("internal_server_error", "could not issue device code")
+	}
+
+	verificationUrl := ctx.Server.config.Server.DeviceVerificationUrl
+	if verificationUrl == "" {
+		verificationUrl = ctx.Server.config.OpenID.Issuer + "/device"
+	}
+
+	// verification_uri_complete is meant to be shown as a QR code, sparing
+	// the user from typing the code in.
+	complete, err := url.Parse(verificationUrl)
+	if err != nil {
+		return NewOAuthError("internal_server_error", "invalid device verification URL")
+	}
+
+	writeJson(w, DeviceAuthorizationResponse{
+		DeviceCode:              code.DeviceCode,
+		UserCode:                code.UserCode,
+		VerificationUri:         verificationUrl,
+		VerificationUriComplete: redirectWithParams(complete, url.Values{"user_code": {code.UserCode}}),
+		ExpiresIn:               int(storage.DeviceCodeLifetime / time.Second),
+		Interval:                code.PollInterval,
+	})
+	return nil
+}
+
+// GET /device
+//
+// The frontend calls this to show the user what they are being asked to
+// approve once they have entered a user code.
+func DeviceHandler(ctx *Context, w http.ResponseWriter) error {
+	r := ctx.Request
+
+	err := r.ParseForm()
 	if err != nil {
 		return NewOAuthError("invalid_request", err.Error())
 	}
 
-	writeJson(w, client)
+	userCode, err := readOneParam(r, "user_code")
+	if err != nil {
+		return err
+	}
+
+	code, err := ctx.Server.store.Apps.FindDeviceCode(userCode)
+	if err != nil {
+		return NewOAuthError("invalid_request", "unknown or expired user code")
+	}
+
+	app, err := ctx.Server.store.Apps.FindById(code.ClientId)
+	if err != nil {
+		return NewOAuthError("internal_server_error", "could not load client")
+	}
+
+	writeJson(w, map[string]interface{}{
+		"user_code":   code.UserCode,
+		"scope":       code.Scope,
+		"expires_at":  code.ExpiresAt,
+		"client_name": app.Name,
+		"description": app.Description,
+		"website":     app.Website,
+		"logo":        app.Logo,
+	})
+	return nil
+}
+
+// POST /device
+//
+// The frontend calls this with the signed-in user's decision (action=approve
+// or action=deny) on a device authorization request.
+func ApproveDeviceHandler(ctx *Context, w http.ResponseWriter) error {
+	r := ctx.Request
+	user := context.Get(r, CurrentPrincipal).(*storage.User)
+
+	err := r.ParseForm()
+	if err != nil {
+		return NewOAuthError("invalid_request", err.Error())
+	}
+
+	userCode, err := readOneFormValue(r, "user_code")
+	if err != nil {
+		return err
+	}
+
+	action, err := readOneFormValue(r, "action")
+	if err != nil {
+		return err
+	}
+
+	var approved bool
+	switch action {
+	case "approve":
+		approved = true
+	case "deny":
+		approved = false
+	default:
+		return NewOAuthError("invalid_request", fmt.Sprintf("unsupported action %q", action))
+	}
+
+	err = ctx.Server.store.Apps.ApproveDeviceCode(userCode, user.Id, approved)
+	if err == storage.ErrInvalidGrant {
+		return NewOAuthError("invalid_request", "unknown or expired user code")
+	} else if err != nil {
+		return NewOAuthError("internal_server_error", "could not record decision")
+	}
+
 	return nil
 }
 
@@ -217,6 +724,18 @@ func TokenHandler(ctx *Context, w http.ResponseWriter) error {
 		return err
 	}
 
+	// Public clients are identified but not authenticated, so they may only
+	// use grants that carry some other proof of authorization.
+	app := context.Get(r, CurrentPrincipal).(*storage.Application)
+	if app.IsPublic() && grantType != "authorization_code" && grantType != "refresh_token" && grantType != deviceCodeGrantType {
+		return NewOAuthError("unauthorized_client", fmt.Sprintf("public clients may not use grant type %q", grantType))
+	}
+
+	// Clients may only use the grants they registered for.
+	if hasScope(supportedGrantTypes, grantType) && !hasScope(strings.Fields(app.GrantTypes), grantType) {
+		return NewOAuthError("unauthorized_client", fmt.Sprintf("client is not registered for grant type %q", grantType))
+	}
+
 	switch grantType {
 	case "authorization_code":
 		return authorizationCodeGrantHandler(ctx, w)
@@ -226,11 +745,80 @@ func TokenHandler(ctx *Context, w http.ResponseWriter) error {
 		return passwordGrantHandler(ctx, w)
 	case "refresh_token":
 		return refreshTokenGrantHandler(ctx, w)
+	case deviceCodeGrantType:
+		return deviceCodeGrantHandler(ctx, w)
+	case tokenExchangeGrantType:
+		return tokenExchangeGrantHandler(ctx, w)
+	case jwtBearerGrantType:
+		return jwtBearerGrantHandler(ctx, w)
 	}
 
 	return NewOAuthError("unsupported_grant_type", fmt.Sprintf("unsupported grant type %q", grantType))
 }
 
+// signUserAccessToken issues an access token to app on behalf of user. The
+// token is recorded (by its jti) so that it can be revoked, either directly or
+// along with the refresh token it was issued alongside. The returned record
+// holds the scopes actually attached, which may be narrower than scope.
+func signUserAccessToken(ctx *Context, app *storage.Application, user *storage.User, scope string, parent *storage.Token) (string, *storage.Token, error) {
+	token, err := ctx.Server.store.Tokens.NewAccessToken(app.Id, user.Id, scope, parent)
+	if err != nil {
+		return "", nil, err
+	}
+
+	seconds := int(storage.AccessTokenLifetime / time.Second)
+	issuer := ctx.Server.config.OpenID.Issuer
+	accessToken := NewJWT(issuer, app.ClientId, user.Email, seconds)
+	accessToken.Claims["jti"] = token.Token
+	accessToken.Claims["scope"] = token.Scope
+	signed, err := ctx.Server.SignJWT(accessToken)
+	return signed, token, err
+}
+
+// signIdToken issues an OpenID Connect ID token to app describing user, along
+// with whichever of their claims the granted scopes release.
+func signIdToken(ctx *Context, app *storage.Application, user *storage.User, scopes []string, authTime *time.Time, nonce, accessToken string) (string, error) {
+	seconds := int(storage.AccessTokenLifetime / time.Second)
+	issuer := ctx.Server.config.OpenID.Issuer
+	idToken := NewIdToken(issuer, app.ClientId, user.Email, seconds, authTime, nonce, accessToken)
+	for k, v := range userClaims(user, scopes) {
+		if _, ok := idToken.Claims[k]; !ok {
+			idToken.Claims[k] = v
+		}
+	}
+
+	return ctx.Server.SignJWT(idToken)
+}
+
+// newUserTokenResponse issues an access token to app on behalf of user,
+// alongside refreshToken. The response describes the scopes the access token
+// was actually issued with, and if they include openid, it also carries an ID
+// token.
+func newUserTokenResponse(ctx *Context, app *storage.Application, user *storage.User, refreshToken *storage.Token, scope, nonce string) (*TokenResponse, error) {
+	signedAccessToken, token, err := signUserAccessToken(ctx, app, user, scope, refreshToken)
+	if err != nil {
+		return nil, err
+	}
+
+	resp := &TokenResponse{
+		AccessToken:  signedAccessToken,
+		RefreshToken: refreshToken.Token,
+		ExpiresIn:    int(storage.AccessTokenLifetime / time.Second),
+		Scope:        token.Scope,
+		TokenType:    "bearer",
+	}
+
+	scopes := parseScope(token.Scope)
+	if hasScope(scopes, "openid") {
+		resp.IdToken, err = signIdToken(ctx, app, user, scopes, refreshToken.AuthTime, nonce, signedAccessToken)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return resp, nil
+}
+
 func authorizationCodeGrantHandler(ctx *Context, w http.ResponseWriter) error {
 	r := ctx.Request
 	app := context.Get(r, CurrentPrincipal).(*storage.Application)
@@ -245,34 +833,287 @@ func authorizationCodeGrantHandler(ctx *Context, w http.ResponseWriter) error {
 		return err
 	}
 
-	resp, err := ctx.Server.store.Apps.ExchangeAuthCode(app, code, redirectUri)
+	codeVerifier, err := readOneFormValueOptional(r, "code_verifier")
+	if err != nil {
+		return err
+	}
+	if codeVerifier != "" && !isValidCodeVerifier(codeVerifier) {
+		return NewOAuthError("invalid_request", "invalid code_verifier")
+	}
+
+	authCode, refreshToken, err := ctx.Server.store.Apps.ExchangeAuthCode(app, code, redirectUri, codeVerifier)
+	if err == storage.ErrInvalidGrant {
+		return NewOAuthError("invalid_grant", "authorization code is invalid or expired")
+	} else if err != nil {
+		return NewOAuthError("internal_server_error", "could not authorize client")
+	}
+
+	user, err := ctx.Server.store.Users.FindById(refreshToken.UserId)
+	if err != nil {
+		return NewOAuthError("internal_server_error", "could not authorize client")
+	}
+
+	resp, err := newUserTokenResponse(ctx, app, user, refreshToken, authCode.Scope, authCode.Nonce)
+	if err != nil {
+		return NewOAuthError("internal_server_error", "could not authorize client")
+	}
+
+	writeJson(w, resp)
+	return nil
+}
+
+func deviceCodeGrantHandler(ctx *Context, w http.ResponseWriter) error {
+	r := ctx.Request
+	app := context.Get(r, CurrentPrincipal).(*storage.Application)
+
+	deviceCode, err := readOneFormValue(r, "device_code")
 	if err != nil {
 		return err
 	}
 
+	code, refreshToken, err := ctx.Server.store.Apps.ExchangeDeviceCode(app, deviceCode)
+	switch err {
+	case nil:
+	case storage.ErrAuthorizationPending:
+		return NewOAuthError("authorization_pending", "the user has not yet approved the request")
+	case storage.ErrSlowDown:
+		return NewOAuthError("slow_down", "polling too frequently")
+	case storage.ErrExpiredToken:
+		return NewOAuthError("expired_token", "device code has expired")
+	case storage.ErrAccessDenied:
+		return NewOAuthError("access_denied", "the user denied the request")
+	case storage.ErrInvalidGrant:
+		return NewOAuthError("invalid_grant", "device code is invalid")
+	default:
+		return NewOAuthError("internal_server_error", "could not authorize client")
+	}
+
+	user, err := ctx.Server.store.Users.FindById(refreshToken.UserId)
+	if err != nil {
+		return NewOAuthError("internal_server_error", "could not authorize client")
+	}
+
+	resp, err := newUserTokenResponse(ctx, app, user, refreshToken, code.Scope, "")
+	if err != nil {
+		return NewOAuthError("internal_server_error", "could not authorize client")
+	}
+
 	writeJson(w, resp)
 	return nil
 }
 
-func clientCredentialsGrantHandler(ctx *Context, w http.ResponseWriter) error {
+const (
+	tokenExchangeGrantType = "urn:ietf:params:oauth:grant-type:token-exchange"
+	accessTokenType        = "urn:ietf:params:oauth:token-type:access_token"
+	jwtTokenType           = "urn:ietf:params:oauth:token-type:jwt"
+)
+
+// parseExchangeToken validates a subject or actor token presented for token
+// exchange. Only live access tokens issued by this server are accepted.
+func parseExchangeToken(ctx *Context, token, typ string) (*jwt.Token, *storage.Token, error) {
+	if typ != accessTokenType && typ != jwtTokenType {
+		return nil, nil, NewOAuthError("invalid_request", fmt.Sprintf("unsupported token type %q", typ))
+	}
+
+	t, err := ctx.Server.ParseJWT(token)
+	if err != nil {
+		return nil, nil, NewOAuthError("invalid_grant", "token is invalid or expired")
+	}
+
+	jti, ok := t.Claims["jti"].(string)
+	if !ok {
+		return nil, nil, NewOAuthError("invalid_grant", "token is invalid or expired")
+	}
+
+	if _, ok := t.Claims["sub"].(string); !ok {
+		return nil, nil, NewOAuthError("invalid_grant", "token has no subject")
+	}
+
+	stored, err := ctx.Server.store.Tokens.FindByValue("access_token", jti)
+	if err != nil {
+		return nil, nil, NewOAuthError("invalid_grant", "token is invalid or expired")
+	}
+
+	return t, stored, nil
+}
+
+// tokenExchangeGrantHandler lets a client (e.g. an API gateway) swap a token
+// it has been handed for a narrower one targeted at a downstream service. The
+// audiences a client may target, and the scopes it may carry to each, are set
+// by its token exchange policies.
+func tokenExchangeGrantHandler(ctx *Context, w http.ResponseWriter) error {
 	r := ctx.Request
 	app := context.Get(r, CurrentPrincipal).(*storage.Application)
 
+	subjectToken, err := readOneFormValue(r, "subject_token")
+	if err != nil {
+		return err
+	}
+
+	subjectTokenType, err := readOneFormValue(r, "subject_token_type")
+	if err != nil {
+		return err
+	}
+
+	actorToken, err := readOneFormValueOptional(r, "actor_token")
+	if err != nil {
+		return err
+	}
+
+	actorTokenType, err := readOneFormValueOptional(r, "actor_token_type")
+	if err != nil {
+		return err
+	}
+
+	audience, err := readOneFormValue(r, "audience")
+	if err != nil {
+		return err
+	}
+
 	scope, err := readOneFormValueOptional(r, "scope")
 	if err != nil {
 		return err
 	}
 
-	token, err := ctx.Server.store.Apps.Authorize(app, scope)
+	requestedTokenType, err := readOneFormValueOptional(r, "requested_token_type")
+	if err != nil {
+		return err
+	}
+	if requestedTokenType != "" && requestedTokenType != accessTokenType {
+		return NewOAuthError("invalid_request", fmt.Sprintf("unsupported requested_token_type %q", requestedTokenType))
+	}
+
+	subject, subjectRecord, err := parseExchangeToken(ctx, subjectToken, subjectTokenType)
+	if err != nil {
+		return err
+	}
+
+	policy, err := ctx.Server.store.Apps.FindExchangePolicy(app, audience)
+	if err != nil {
+		return NewOAuthError("invalid_target", fmt.Sprintf("client may not exchange tokens for audience %q", audience))
+	}
+
+	// The new token can never carry more than the subject token did.
+	granted := intersectScopes(parseScope(subjectRecord.Scope), parseScope(policy.Scope))
+	if requested := parseScope(scope); len(requested) > 0 {
+		granted = intersectScopes(requested, granted)
+		if len(granted) == 0 {
+			return NewOAuthError("invalid_scope", "none of the requested scopes are permitted")
+		}
+	}
+
+	// Each exchange with an actor token records the actor as the current
+	// actor, nesting any previous actors inside it (RFC 8693 section 4.1).
+	act, _ := subject.Claims["act"].(map[string]interface{})
+	if actorToken != "" {
+		if actorTokenType == "" {
+			return NewOAuthError("invalid_request", "actor_token_type is required with actor_token")
+		}
+
+		actor, _, err := parseExchangeToken(ctx, actorToken, actorTokenType)
+		if err != nil {
+			return err
+		}
+
+		actorAct := map[string]interface{}{"sub": actor.Claims["sub"]}
+		if act != nil {
+			actorAct["act"] = act
+		}
+		act = actorAct
+	} else if actorTokenType != "" {
+		return NewOAuthError("invalid_request", "actor_token_type provided without actor_token")
+	}
+
+	// Deriving the new token from the subject token means that revoking the
+	// subject token, or the refresh token it was derived from, revokes it too.
+	// Only the scopes the client is permitted are attached to it; the claims
+	// below use that narrowed set.
+	token, err := ctx.Server.store.Tokens.NewAccessToken(app.Id, subjectRecord.UserId, formatScope(granted), subjectRecord)
+	if err != nil {
+		return NewOAuthError("internal_server_error", "could not authorize client")
+	}
+
+	// Nor may it outlive the subject token.
+	seconds := int(storage.AccessTokenLifetime / time.Second)
+	if exp, ok := subject.Claims["exp"].(float64); ok {
+		if remaining := int(int64(exp) - time.Now().Unix()); remaining < seconds {
+			seconds = remaining
+		}
+	}
+
+	issuer := ctx.Server.config.OpenID.Issuer
+	accessToken := NewJWT(issuer, audience, subject.Claims["sub"].(string), seconds)
+	accessToken.Claims["client_id"] = app.ClientId
+	accessToken.Claims["jti"] = token.Token
+	accessToken.Claims["scope"] = token.Scope
+	if act != nil {
+		accessToken.Claims["act"] = act
+	}
+	signedAccessToken, err := ctx.Server.SignJWT(accessToken)
+	if err != nil {
+		return NewOAuthError("internal_server_error", "could not authorize client")
+	}
+
+	writeJson(w, TokenResponse{
+		AccessToken:     signedAccessToken,
+		IssuedTokenType: accessTokenType,
+		TokenType:       "bearer",
+		ExpiresIn:       seconds,
+		Scope:           token.Scope,
+	})
+	return nil
+}
+
+func clientCredentialsGrantHandler(ctx *Context, w http.ResponseWriter) error {
+	r := ctx.Request
+	app := context.Get(r, CurrentPrincipal).(*storage.Application)
+
+	scope, err := readOneFormValueOptional(r, "scope")
 	if err != nil {
 		return err
 	}
 
+	permitted, err := ctx.Server.store.Apps.PermittedScopes(app)
+	if err != nil {
+		return NewOAuthError("internal_server_error", "could not authorize client")
+	}
+
+	// The admin scope is only ever issued to users with the admin role, and
+	// the application is acting on no user's behalf.
+	var grantable []string
+	for _, s := range permitted {
+		if s != "admin" {
+			grantable = append(grantable, s)
+		}
+	}
+
+	requested := parseScope(scope)
+	granted := intersectScopes(requested, grantable)
+	if len(requested) > 0 && len(granted) == 0 {
+		return NewOAuthError("invalid_scope", "none of the requested scopes are permitted")
+	}
+
+	token, err := ctx.Server.store.Apps.Authorize(app, formatScope(granted))
+	if err != nil {
+		return NewOAuthError("internal_server_error", "could not authorize client")
+	}
+
+	// The application is acting on its own behalf, so it is also the subject.
+	seconds := int(storage.AccessTokenLifetime / time.Second)
+	issuer := ctx.Server.config.OpenID.Issuer
+	accessToken := NewJWT(issuer, app.ClientId, app.ClientId, seconds)
+	accessToken.Claims["jti"] = token.Token
+	accessToken.Claims["scope"] = token.Scope
+	signedAccessToken, err := ctx.Server.SignJWT(accessToken)
+	if err != nil {
+		return NewOAuthError("internal_server_error", "could not authorize client")
+	}
+
 	writeJson(w, TokenResponse{
-		AccessToken: token.Token,
-		TokenType:   token.Type,
-		ExpiresIn:   3600,
-		Scope:       scope,
+		AccessToken: signedAccessToken,
+		TokenType:   "bearer",
+		ExpiresIn:   seconds,
+		Scope:       token.Scope,
 	})
 	return nil
 }
@@ -301,24 +1142,25 @@ func passwordGrantHandler(ctx *Context, w http.ResponseWriter) error {
 		return NewOAuthError("access_denied", "invalid username/password")
 	}
 
-	seconds := 3600
-	issuer := ctx.Server.config.OpenID.Issuer
-	accessToken := NewJWT(issuer, app.ClientId, user.Email, seconds)
-	refreshToken, err := ctx.Server.store.Users.Authorize(user.Id, app.Id, scope, true)
+	permitted, err := ctx.Server.store.Apps.PermittedScopes(app)
 	if err != nil {
 		return NewOAuthError("internal_server_error", "could not authorize client")
 	}
 
-	signedAccessToken, err := ctx.Server.SignJWT(accessToken)
+	requested := parseScope(scope)
+	granted := formatScope(intersectScopes(requested, permitted))
+	if len(requested) > 0 && granted == "" {
+		return NewOAuthError("invalid_scope", "none of the requested scopes are permitted")
+	}
+
+	refreshToken, err := ctx.Server.store.Users.Authorize(user.Id, app.Id, granted, true)
 	if err != nil {
 		return NewOAuthError("internal_server_error", "could not authorize client")
 	}
 
-	resp := &TokenResponse{
-		AccessToken:  signedAccessToken,
-		RefreshToken: refreshToken,
-		ExpiresIn:    seconds,
-		TokenType:    "bearer",
+	resp, err := newUserTokenResponse(ctx, app, user, refreshToken, granted, "")
+	if err != nil {
+		return NewOAuthError("internal_server_error", "could not authorize client")
 	}
 
 	writeJson(w, resp)
@@ -339,35 +1181,213 @@ func refreshTokenGrantHandler(ctx *Context, w http.ResponseWriter) error {
 		return err
 	}
 
-	// TODO: actually need to load up old refresh token, check scope against scope param
-	// if scope param is empty, use refresh token scope
-	// if scope param includes scopes not granted to refresh token, fail (invalid_request)
-	// otherwise, use scope param
-	user, err := ctx.Server.store.Users.FindByRefreshToken(app.Id, refreshToken)
+	token, err := ctx.Server.store.Tokens.FindByValue("refresh_token", refreshToken)
 	if err != nil {
 		log.Printf("refresh failed: %s", err)
+		if reused, _ := ctx.Server.store.Tokens.RevokeReused(app.Id, refreshToken); reused {
+			log.Println("refresh failed: rotated refresh token was reused, revoked its family")
+		}
 		return NewOAuthError("invalid_grant", "refresh token is invalid or expired")
-	} else if user == nil {
-		log.Println("refresh failed: user not found with matching valid refresh token for specified client")
+	} else if token.ClientId != app.Id {
+		log.Println("refresh failed: refresh token was issued to another client")
 		return NewOAuthError("invalid_grant", "refresh token is invalid or expired")
 	}
 
-	seconds := 3600
-	issuer := ctx.Server.config.OpenID.Issuer
-	accessToken := NewJWT(issuer, app.ClientId, user.Email, seconds)
-	signedAccessToken, err := ctx.Server.SignJWT(accessToken)
+	user, err := ctx.Server.store.Users.FindById(token.UserId)
 	if err != nil {
+		log.Printf("refresh failed: %s", err)
+		return NewOAuthError("invalid_grant", "refresh token is invalid or expired")
+	}
+
+	// The new access token may be narrower than the original grant, but never
+	// broader. If no scope is requested, the original grant carries over.
+	granted := parseScope(token.Scope)
+	effective := granted
+	if scope != "" {
+		effective = parseScope(scope)
+		for _, s := range effective {
+			if !hasScope(granted, s) {
+				return NewOAuthError("invalid_scope", fmt.Sprintf("scope %q was not granted to this refresh token", s))
+			}
+		}
+	}
+
+	token, err = ctx.Server.store.Tokens.Refresh(app, token)
+	if err == storage.ErrInvalidGrant {
+		return NewOAuthError("invalid_grant", "refresh token is invalid or expired")
+	} else if err != nil {
 		return NewOAuthError("internal_server_error", "could not authorize client")
 	}
 
-	resp := &TokenResponse{
-		AccessToken:  signedAccessToken,
-		RefreshToken: refreshToken,
-		ExpiresIn:    seconds,
-		Scope:        scope, // FIXME: BUG!
-		TokenType:    "bearer",
+	resp, err := newUserTokenResponse(ctx, app, user, token, formatScope(effective), "")
+	if err != nil {
+		return NewOAuthError("internal_server_error", "could not authorize client")
 	}
 
 	writeJson(w, resp)
 	return nil
 }
+
+// POST /revoke
+func RevokeHandler(ctx *Context, w http.ResponseWriter) error {
+	r := ctx.Request
+	app := context.Get(r, CurrentPrincipal).(*storage.Application)
+
+	err := r.ParseForm()
+	if err != nil {
+		return NewOAuthError("invalid_request", err.Error())
+	}
+
+	token, err := readOneFormValue(r, "token")
+	if err != nil {
+		return err
+	}
+
+	hint, err := readOneFormValueOptional(r, "token_type_hint")
+	if err != nil {
+		return err
+	}
+
+	switch hint {
+	case "", "access_token", "refresh_token":
+	default:
+		return NewOAuthError("unsupported_token_type", fmt.Sprintf("unsupported token type %q", hint))
+	}
+
+	// Access tokens are JWTs, recorded by their jti, so the token itself tells
+	// us its type regardless of the hint. Anything else may be a refresh token.
+	typ, value := "refresh_token", token
+	if t, err := ctx.Server.ParseJWT(token); err == nil {
+		jti, ok := t.Claims["jti"].(string)
+		if !ok {
+			return nil
+		}
+		typ, value = "access_token", jti
+	}
+
+	// Per RFC 7009, invalid or unknown tokens are not an error: the client's
+	// goal (that the token be unusable) has been met either way.
+	err = ctx.Server.store.Tokens.Revoke(app.Id, typ, value)
+	if err != nil {
+		return NewOAuthError("internal_server_error", "could not revoke token")
+	}
+
+	return nil
+}
+
+// POST /introspect
+func IntrospectHandler(ctx *Context, w http.ResponseWriter) error {
+	r := ctx.Request
+	app := context.Get(r, CurrentPrincipal).(*storage.Application)
+
+	// Only clients that can actually authenticate may introspect tokens.
+	if app.IsPublic() {
+		return NewOAuthError("unauthorized_client", "public clients may not introspect tokens")
+	}
+
+	err := r.ParseForm()
+	if err != nil {
+		return NewOAuthError("invalid_request", err.Error())
+	}
+
+	token, err := readOneFormValue(r, "token")
+	if err != nil {
+		return err
+	}
+
+	hint, err := readOneFormValueOptional(r, "token_type_hint")
+	if err != nil {
+		return err
+	}
+
+	switch hint {
+	case "", "access_token", "refresh_token":
+	default:
+		return NewOAuthError("unsupported_token_type", fmt.Sprintf("unsupported token type %q", hint))
+	}
+
+	var resp *IntrospectionResponse
+	if t, err := ctx.Server.ParseJWT(token); err == nil {
+		resp = introspectAccessToken(ctx, t)
+	} else {
+		resp = introspectRefreshToken(ctx, app, token)
+	}
+
+	if resp == nil {
+		resp = &IntrospectionResponse{Active: false}
+	}
+
+	writeJson(w, resp)
+	return nil
+}
+
+// introspectAccessToken describes a validly signed, unexpired access token,
+// or returns nil if it has since been revoked. Only tokens carrying a jti are
+// access tokens; ID tokens and signed userinfo responses are not.
+func introspectAccessToken(ctx *Context, t *jwt.Token) *IntrospectionResponse {
+	jti, ok := t.Claims["jti"].(string)
+	if !ok {
+		return nil
+	}
+
+	token, err := ctx.Server.store.Tokens.FindByValue("access_token", jti)
+	if err != nil {
+		return nil
+	}
+
+	resp := &IntrospectionResponse{Active: true, TokenType: "bearer"}
+	resp.Audience, _ = t.Claims["aud"].(string)
+	resp.ClientId, _ = t.Claims["aud"].(string)
+	if clientId, ok := t.Claims["client_id"].(string); ok {
+		resp.ClientId = clientId
+	}
+	resp.Subject, _ = t.Claims["sub"].(string)
+	resp.Scope = token.Scope
+	if exp, ok := t.Claims["exp"].(float64); ok {
+		resp.ExpiresAt = int64(exp)
+	}
+	if iat, ok := t.Claims["iat"].(float64); ok {
+		resp.IssuedAt = int64(iat)
+	}
+
+	return resp
+}
+
+// introspectRefreshToken describes a live refresh token, or returns nil if
+// there is no such token. Refresh tokens are only described to the client
+// they were issued to.
+func introspectRefreshToken(ctx *Context, client *storage.Application, value string) *IntrospectionResponse {
+	token, err := ctx.Server.store.Tokens.FindByValue("refresh_token", value)
+	if err != nil {
+		return nil
+	}
+
+	if token.ClientId != client.Id {
+		return nil
+	}
+
+	app, err := ctx.Server.store.Apps.FindById(token.ClientId)
+	if err != nil {
+		return nil
+	}
+
+	user, err := ctx.Server.store.Users.FindById(token.UserId)
+	if err != nil {
+		return nil
+	}
+
+	resp := &IntrospectionResponse{
+		Active:    true,
+		Scope:     token.Scope,
+		ClientId:  app.ClientId,
+		Subject:   user.Email,
+		IssuedAt:  token.CreatedAt.Unix(),
+		Audience:  app.ClientId,
+		TokenType: "refresh_token",
+	}
+	if token.ExpiresAt != nil {
+		resp.ExpiresAt = token.ExpiresAt.Unix()
+	}
+
+	return resp
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"expvar"
+	"log"
+	"time"
+)
+
+const (
+	defaultJanitorInterval  = time.Hour
+	defaultJanitorBatchSize = 1000
+)
+
+// Counts of the rows the janitor has removed since the server started, plus
+// how many runs it has made, how many of them failed and how many were
+// skipped because another server leads cleanups.
+var janitorMetrics = expvar.NewMap("janitor")
+
+// runJanitor deletes expired and revoked tokens, and codes that were never
+// redeemed, so that the tables holding them don't grow forever. It cleans up
+// once straight away and then periodically, until stop is closed. When
+// several servers share a database, only the one that leads (see
+// storage.Client.LeadCleanup) does the work; the others keep checking, so one
+// of them takes over if the leader goes away.
+func (s *Server) runJanitor(stop <-chan struct{}) {
+	cfg := s.config.Janitor
+	if cfg.Interval < 0 {
+		return
+	}
+
+	interval := time.Duration(cfg.Interval) * time.Second
+	if interval == 0 {
+		interval = defaultJanitorInterval
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	leading := false
+	for {
+		leading = s.cleanup(leading)
+
+		select {
+		case <-ticker.C:
+		case <-stop:
+			return
+		}
+	}
+}
+
+// cleanup runs one cleanup if this server leads, and reports whether it does.
+// Changes of leadership since the last run (when it led if wasLeading) are
+// logged.
+func (s *Server) cleanup(wasLeading bool) bool {
+	cfg := s.config.Janitor
+	batchSize := cfg.BatchSize
+	if batchSize <= 0 {
+		batchSize = defaultJanitorBatchSize
+	}
+	before := time.Now().Add(-time.Duration(cfg.Retention) * time.Second)
+
+	janitorMetrics.Add("runs", 1)
+	leading, err := s.store.LeadCleanup()
+	if err != nil {
+		janitorMetrics.Add("errors", 1)
+		log.Println("Janitor: checking for the cleanup lock failed:", err)
+		return false
+	}
+	if leading != wasLeading {
+		if leading {
+			log.Println("Janitor: leading cleanups")
+		} else {
+			log.Println("Janitor: lost the cleanup lock; another server leads cleanups")
+		}
+	}
+	if !leading {
+		janitorMetrics.Add("skipped", 1)
+		return false
+	}
+
+	stats, err := s.store.Cleanup(before, batchSize)
+	if err != nil {
+		janitorMetrics.Add("errors", 1)
+		log.Println("Janitor: cleanup failed:", err)
+	}
+	if stats == nil {
+		return true
+	}
+
+	janitorMetrics.Add("tokens", stats.Tokens)
+	janitorMetrics.Add("authorized_scopes", stats.AuthorizedScopes)
+	janitorMetrics.Add("auth_codes", stats.AuthCodes)
+	janitorMetrics.Add("device_codes", stats.DeviceCodes)
+	janitorMetrics.Add("assertions", stats.Assertions)
+
+	removed := stats.Tokens + stats.AuthorizedScopes + stats.AuthCodes + stats.DeviceCodes + stats.Assertions
+	if removed > 0 {
+		log.Printf("Janitor: removed %d tokens, %d authorized scopes, %d authorization codes, %d device codes and %d client assertions",
+			stats.Tokens, stats.AuthorizedScopes, stats.AuthCodes, stats.DeviceCodes, stats.Assertions)
+	}
+
+	return true
+}
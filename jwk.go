@@ -0,0 +1,115 @@
+package main
+
+import (
+	"errors"
+	"math/big"
+
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+)
+
+// JWK is an RSA public key in JSON Web Key format (RFC 7517).
+type JWK struct {
+	Kty string `json:"kty"`
+	Use string `json:"use,omitempty"`
+	Alg string `json:"alg,omitempty"`
+	Kid string `json:"kid,omitempty"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+}
+
+type JWKSet struct {
+	Keys []*JWK `json:"keys"`
+}
+
+// NewSigningJWK describes key as an RS256 signature verification key.
+func NewSigningJWK(key *rsa.PublicKey) *JWK {
+	return &JWK{
+		Kty: "RSA",
+		Use: "sig",
+		Alg: "RS256",
+		Kid: keyThumbprint(key),
+		N:   base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+		E:   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+	}
+}
+
+// PublicKey decodes an RSA public key.
+func (k *JWK) PublicKey() (*rsa.PublicKey, error) {
+	if k.Kty != "RSA" {
+		return nil, errors.New("unsupported key type " + k.Kty)
+	}
+
+	n, err := base64.RawURLEncoding.DecodeString(k.N)
+	if err != nil {
+		return nil, err
+	}
+
+	e, err := base64.RawURLEncoding.DecodeString(k.E)
+	if err != nil {
+		return nil, err
+	}
+
+	exp := new(big.Int).SetBytes(e)
+	if exp.BitLen() > 31 {
+		return nil, errors.New("invalid exponent")
+	}
+
+	return &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(exp.Int64())}, nil
+}
+
+// ParseJWKSet decodes a JSON Web Key Set, such as one registered by a client.
+func ParseJWKSet(data string) (*JWKSet, error) {
+	ks := &JWKSet{}
+	err := json.Unmarshal([]byte(data), ks)
+	if err != nil {
+		return nil, err
+	}
+
+	return ks, nil
+}
+
+// Find returns the key with the given id. If kid is empty, the set must hold
+// exactly one key, which is returned.
+func (ks *JWKSet) Find(kid string) *JWK {
+	if kid == "" {
+		if len(ks.Keys) == 1 {
+			return ks.Keys[0]
+		}
+		return nil
+	}
+
+	for _, k := range ks.Keys {
+		if k.Kid == kid {
+			return k
+		}
+	}
+	return nil
+}
+
+// keyThumbprint computes the RFC 7638 thumbprint of key, which we use as its
+// key id. It is stable for a given key, so ids survive restarts without any
+// extra bookkeeping.
+func keyThumbprint(key *rsa.PublicKey) string {
+	// The thumbprint is taken over the required members only, in
+	// lexicographic order, with no whitespace.
+	members := struct {
+		E   string `json:"e"`
+		Kty string `json:"kty"`
+		N   string `json:"n"`
+	}{
+		E:   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+		Kty: "RSA",
+		N:   base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+	}
+
+	buf, err := json.Marshal(members)
+	if err != nil {
+		panic(err)
+	}
+
+	sum := sha256.Sum256(buf)
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
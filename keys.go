@@ -0,0 +1,405 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"time"
+
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"io/ioutil"
+	"path/filepath"
+
+	"github.com/BurntSushi/toml"
+	"github.com/dgrijalva/jwt-go"
+
+	"github.com/paulrosania/registrar/storage"
+)
+
+// Retired keys must be kept around until every token they signed has expired.
+const maxTokenLifetime = storage.AccessTokenLifetime
+
+const (
+	keyManifestName = "keys.toml"
+	keyFileExt      = ".rsa"
+	keySize         = 2048
+)
+
+// Key is a token signing key, identified by its RFC 7638 thumbprint. Private
+// is nil for keys that may only be used for verification.
+type Key struct {
+	Id        string
+	Private   *rsa.PrivateKey
+	Public    *rsa.PublicKey
+	RetiredAt time.Time
+	path      string
+	modTime   time.Time
+}
+
+func (k *Key) Retired() bool {
+	return !k.RetiredAt.IsZero()
+}
+
+// KeySet holds a single active signing key, along with any number of other
+// keys that tokens may be verified with: retired keys, which may still have
+// live tokens outstanding, and pending keys, which are published ahead of
+// being promoted so that relying parties have a chance to fetch them.
+type KeySet struct {
+	active *Key
+	keys   []*Key
+}
+
+func (ks *KeySet) Active() *Key {
+	return ks.active
+}
+
+func (ks *KeySet) Keys() []*Key {
+	return ks.keys
+}
+
+func (ks *KeySet) Find(kid string) *Key {
+	for _, k := range ks.keys {
+		if k.Id == kid {
+			return k
+		}
+	}
+	return nil
+}
+
+func (ks *KeySet) add(k *Key) {
+	if ks.Find(k.Id) == nil {
+		ks.keys = append(ks.keys, k)
+	}
+}
+
+// LoadKeyFiles builds a key set from the [jwt] config section: the active key
+// pair, plus the public halves of any retired keys.
+func LoadKeyFiles(privatePath, publicPath string, retiredPaths []string) (*KeySet, error) {
+	buf, err := ioutil.ReadFile(privatePath)
+	if err != nil {
+		return nil, err
+	}
+
+	private, err := jwt.ParseRSAPrivateKeyFromPEM(buf)
+	if err != nil {
+		return nil, err
+	}
+
+	buf, err = ioutil.ReadFile(publicPath)
+	if err != nil {
+		return nil, err
+	}
+
+	public, err := jwt.ParseRSAPublicKeyFromPEM(buf)
+	if err != nil {
+		return nil, err
+	}
+
+	ks := &KeySet{}
+	ks.active = &Key{Id: keyThumbprint(public), Private: private, Public: public}
+	ks.add(ks.active)
+
+	for _, path := range retiredPaths {
+		buf, err := ioutil.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+
+		public, err := jwt.ParseRSAPublicKeyFromPEM(buf)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %s", path, err)
+		}
+
+		ks.add(&Key{Id: keyThumbprint(public), Public: public, path: path})
+	}
+
+	return ks, nil
+}
+
+// A key directory holds one PEM-encoded private key per file, named
+// <kid>.rsa, and a keys.toml manifest recording which key is active and when
+// each of the others was retired. Keys that are neither active nor retired
+// are pending.
+type keyManifest struct {
+	Active  string               `toml:"active"`
+	Retired map[string]time.Time `toml:"retired"`
+}
+
+func readKeyManifest(dir string) (*keyManifest, error) {
+	m := &keyManifest{}
+	_, err := toml.DecodeFile(filepath.Join(dir, keyManifestName), m)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	if m.Retired == nil {
+		m.Retired = make(map[string]time.Time)
+	}
+	return m, nil
+}
+
+func writeKeyManifest(dir string, m *keyManifest) error {
+	path := filepath.Join(dir, keyManifestName)
+	tmp := path + ".tmp"
+
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+
+	err = toml.NewEncoder(f).Encode(m)
+	f.Close()
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+
+	return os.Rename(tmp, path)
+}
+
+// LoadKeyDir builds a key set from a key directory. It is an error for the
+// directory to have no active key.
+func LoadKeyDir(dir string) (*KeySet, error) {
+	m, err := readKeyManifest(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	paths, err := filepath.Glob(filepath.Join(dir, "*"+keyFileExt))
+	if err != nil {
+		return nil, err
+	}
+
+	ks := &KeySet{}
+	for _, path := range paths {
+		k, err := readKeyFile(path)
+		if err != nil {
+			return nil, err
+		}
+
+		k.RetiredAt = m.Retired[k.Id]
+		if k.Id == m.Active {
+			ks.active = k
+		}
+		ks.add(k)
+	}
+
+	if ks.active == nil {
+		return nil, fmt.Errorf("no active signing key in %s", dir)
+	}
+
+	return ks, nil
+}
+
+func readKeyFile(path string) (*Key, error) {
+	buf, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	private, err := jwt.ParseRSAPrivateKeyFromPEM(buf)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", path, err)
+	}
+
+	fi, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Key{
+		Id:      keyThumbprint(&private.PublicKey),
+		Private: private,
+		Public:  &private.PublicKey,
+		path:    path,
+		modTime: fi.ModTime(),
+	}, nil
+}
+
+// GenerateKey creates a new pending key in dir. If dir has no active key yet,
+// the new key becomes active immediately.
+func GenerateKey(dir string) (*Key, error) {
+	private, err := rsa.GenerateKey(rand.Reader, keySize)
+	if err != nil {
+		return nil, err
+	}
+
+	kid := keyThumbprint(&private.PublicKey)
+	path := filepath.Join(dir, kid+keyFileExt)
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return nil, err
+	}
+
+	err = pem.Encode(f, &pem.Block{
+		Type:  "RSA PRIVATE KEY",
+		Bytes: x509.MarshalPKCS1PrivateKey(private),
+	})
+	f.Close()
+	if err != nil {
+		os.Remove(path)
+		return nil, err
+	}
+
+	m, err := readKeyManifest(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	if m.Active == "" {
+		m.Active = kid
+		err = writeKeyManifest(dir, m)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return &Key{Id: kid, Private: private, Public: &private.PublicKey, path: path}, nil
+}
+
+// PromoteKey makes the key with the given id the active signing key, retiring
+// the previously active key. If kid is empty, the newest pending key is
+// promoted.
+func PromoteKey(dir, kid string) (*Key, error) {
+	ks, err := LoadKeyDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	var k *Key
+	if kid == "" {
+		for _, candidate := range ks.Keys() {
+			if candidate == ks.Active() || candidate.Retired() {
+				continue
+			}
+			if k == nil || candidate.modTime.After(k.modTime) {
+				k = candidate
+			}
+		}
+		if k == nil {
+			return nil, errors.New("no pending key to promote")
+		}
+	} else {
+		k = ks.Find(kid)
+		if k == nil {
+			return nil, fmt.Errorf("no such key %q", kid)
+		}
+	}
+
+	if k == ks.Active() {
+		return k, nil
+	}
+
+	m, err := readKeyManifest(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	m.Retired[ks.Active().Id] = time.Now().UTC()
+	delete(m.Retired, k.Id)
+	m.Active = k.Id
+
+	err = writeKeyManifest(dir, m)
+	if err != nil {
+		return nil, err
+	}
+
+	return k, nil
+}
+
+// PruneKeys deletes keys that were retired long enough ago that no token they
+// signed can still be valid, and returns their ids.
+func PruneKeys(dir string) ([]string, error) {
+	ks, err := LoadKeyDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	m, err := readKeyManifest(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	var pruned []string
+	cutoff := time.Now().Add(-maxTokenLifetime)
+	for _, k := range ks.Keys() {
+		if !k.Retired() || k.RetiredAt.After(cutoff) {
+			continue
+		}
+
+		err = os.Remove(k.path)
+		if err != nil {
+			return pruned, err
+		}
+		delete(m.Retired, k.Id)
+		pruned = append(pruned, k.Id)
+	}
+
+	sort.Strings(pruned)
+	return pruned, writeKeyManifest(dir, m)
+}
+
+// keysCommand implements `registrar keys`, which manages the key directory
+// configured by [jwt] key-dir. The server picks up changes on SIGHUP.
+func keysCommand(cfg *Config, args []string) error {
+	dir := cfg.JWT.KeyDir
+	if dir == "" {
+		return errors.New("no key directory configured ([jwt] key-dir)")
+	}
+
+	if len(args) == 0 {
+		return errors.New("usage: registrar keys list|generate|promote [kid]|prune")
+	}
+
+	switch args[0] {
+	case "list":
+		ks, err := LoadKeyDir(dir)
+		if err != nil {
+			return err
+		}
+
+		for _, k := range ks.Keys() {
+			switch {
+			case k == ks.Active():
+				fmt.Printf("%s\tactive\n", k.Id)
+			case k.Retired():
+				fmt.Printf("%s\tretired %s\n", k.Id, k.RetiredAt.Format(time.RFC3339))
+			default:
+				fmt.Printf("%s\tpending\n", k.Id)
+			}
+		}
+	case "generate":
+		k, err := GenerateKey(dir)
+		if err != nil {
+			return err
+		}
+		fmt.Println(k.Id)
+	case "promote":
+		var kid string
+		if len(args) > 1 {
+			kid = args[1]
+		}
+
+		k, err := PromoteKey(dir, kid)
+		if err != nil {
+			return err
+		}
+		fmt.Println(k.Id)
+	case "prune":
+		pruned, err := PruneKeys(dir)
+		if err != nil {
+			return err
+		}
+		for _, kid := range pruned {
+			fmt.Println(kid)
+		}
+	default:
+		return fmt.Errorf("unknown keys command %q", args[0])
+	}
+
+	return nil
+}
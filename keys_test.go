@@ -0,0 +1,121 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"net/http"
+)
+
+func TestKeyRotation(t *testing.T) {
+	dir, err := ioutil.TempDir("", "registrar-keys-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	s := NewServer(newTestConfig(t, dir))
+	first := s.Keys().Active()
+
+	sign := func() string {
+		signed, err := s.SignJWT(NewJWT("https://example.com", "client", "paul@example.com", 60))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return signed
+	}
+
+	certs := func() map[string]bool {
+		req, _ := http.NewRequest("GET", "/certs", nil)
+		w := serve(s, req)
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected 200 from certs, got %d", w.Code)
+		}
+
+		var set JWKSet
+		decodeJson(t, w, &set)
+		kids := make(map[string]bool)
+		for _, k := range set.Keys {
+			kids[k.Kid] = true
+		}
+		return kids
+	}
+
+	oldToken := sign()
+
+	pending, err := GenerateKey(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Retire the first key long enough ago for it to be pruned, as the
+	// last step does.
+	expire := func() error {
+		m, err := readKeyManifest(dir)
+		if err != nil {
+			return err
+		}
+		m.Retired[first.Id] = time.Now().Add(-maxTokenLifetime - time.Minute)
+		return writeKeyManifest(dir, m)
+	}
+
+	steps := []struct {
+		name       string
+		change     func() error
+		active     string
+		published  []string
+		oldTokenOk bool
+	}{
+		// A pending key is published before it is used, so that relying
+		// parties can fetch it ahead of time.
+		{"generate", func() error { return nil }, first.Id, []string{first.Id, pending.Id}, true},
+		// Tokens signed by the retired key stay valid until they expire.
+		{"promote", func() error { _, err := PromoteKey(dir, ""); return err }, pending.Id, []string{first.Id, pending.Id}, true},
+		{"prune too soon", func() error { _, err := PruneKeys(dir); return err }, pending.Id, []string{first.Id, pending.Id}, true},
+		{"prune", func() error {
+			err := expire()
+			if err != nil {
+				return err
+			}
+			_, err = PruneKeys(dir)
+			return err
+		}, pending.Id, []string{pending.Id}, false},
+	}
+
+	for _, step := range steps {
+		err := step.change()
+		if err != nil {
+			t.Fatalf("%s: %s", step.name, err)
+		}
+
+		err = s.loadKeys()
+		if err != nil {
+			t.Fatalf("%s: %s", step.name, err)
+		}
+
+		token, err := s.ParseJWT(sign())
+		if err != nil {
+			t.Fatalf("%s: %s", step.name, err)
+		}
+		if token.Header["kid"] != step.active {
+			t.Errorf("%s: expected tokens signed by %s, got %v", step.name, step.active, token.Header["kid"])
+		}
+
+		kids := certs()
+		if len(kids) != len(step.published) {
+			t.Errorf("%s: expected %d published keys, got %v", step.name, len(step.published), kids)
+		}
+		for _, kid := range step.published {
+			if !kids[kid] {
+				t.Errorf("%s: expected %s to be published", step.name, kid)
+			}
+		}
+
+		_, err = s.ParseJWT(oldToken)
+		if ok := err == nil; ok != step.oldTokenOk {
+			t.Errorf("%s: expected old token valid = %t, got error %v", step.name, step.oldTokenOk, err)
+		}
+	}
+}
@@ -0,0 +1,222 @@
+package main
+
+import (
+	"log"
+	"strings"
+	"time"
+
+	"net/http"
+	"net/url"
+
+	"github.com/dgrijalva/jwt-go"
+	"github.com/gorilla/context"
+
+	"github.com/paulrosania/registrar/storage"
+)
+
+// Back-channel logout notifications are best effort; a client that doesn't
+// respond promptly is given up on.
+var backchannelClient = &http.Client{Timeout: 5 * time.Second}
+
+// notifyLogout tells each of the given clients that has registered a
+// back-channel logout URI that user has logged out. Notifications are sent in
+// the background.
+func (s *Server) notifyLogout(clientIds []int64, user *storage.User) {
+	for _, id := range clientIds {
+		app, err := s.store.Apps.FindById(id)
+		if err != nil || app.BackchannelLogoutUri == "" {
+			continue
+		}
+
+		go s.sendLogoutToken(app, user)
+	}
+}
+
+func (s *Server) sendLogoutToken(app *storage.Application, user *storage.User) {
+	jti, err := storage.RandomToken()
+	if err != nil {
+		log.Println("back-channel logout failed:", err)
+		return
+	}
+
+	token := NewLogoutToken(s.config.OpenID.Issuer, app.ClientId, user.Email, jti)
+	signed, err := s.SignJWT(token)
+	if err != nil {
+		log.Println("back-channel logout failed:", err)
+		return
+	}
+
+	resp, err := backchannelClient.PostForm(app.BackchannelLogoutUri, url.Values{"logout_token": {signed}})
+	if err != nil {
+		log.Printf("back-channel logout to %s failed: %s", app.BackchannelLogoutUri, err)
+		return
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		log.Printf("back-channel logout to %s failed: %s", app.BackchannelLogoutUri, resp.Status)
+	}
+}
+
+// POST /logout
+//
+// Revokes the tokens the caller's client holds for the user, or (with
+// all=true) the tokens every client holds for them. Only the frontend, or an
+// admin, may log the user out of other clients.
+func LogoutHandler(ctx *Context, w http.ResponseWriter) error {
+	r := ctx.Request
+	user := context.Get(r, CurrentPrincipal).(*storage.User)
+
+	err := r.ParseForm()
+	if err != nil {
+		return NewOAuthError("invalid_request", err.Error())
+	}
+
+	all, err := readOneParamOptional(r, "all")
+	if err != nil {
+		return err
+	}
+
+	t, ok := context.Get(r, CurrentAccessToken).(*storage.Token)
+
+	var clientId int64
+	if all == "true" {
+		admin := ok && user.Admin && hasScope(parseScope(t.Scope), "admin")
+		if !fromFrontend(ctx) && !admin {
+			return NewOAuthError("access_denied", "only the frontend may log the user out of every client")
+		}
+	} else {
+		// Users authenticated with basic auth aren't acting through any
+		// particular client.
+		if !ok {
+			return NewOAuthError("invalid_request", "no client to log out of; use all=true")
+		}
+		clientId = t.ClientId
+	}
+
+	clientIds, err := ctx.Server.store.Tokens.RevokeUserTokens(user.Id, clientId)
+	if err != nil {
+		return NewOAuthError("internal_server_error", "could not log out")
+	}
+
+	ctx.Server.notifyLogout(clientIds, user)
+	return nil
+}
+
+// parseIdTokenHint validates an ID token we issued. The token may have
+// expired: it is only a hint as to who is logging out, and from where.
+func parseIdTokenHint(ctx *Context, hint string) (*jwt.Token, error) {
+	t, err := ctx.Server.ParseJWT(hint)
+	if e, ok := err.(*jwt.ValidationError); ok && e.Errors == jwt.ValidationErrorExpired {
+		return t, nil
+	}
+
+	return t, err
+}
+
+// GET, POST /end_session
+//
+// RP-initiated logout. Relying parties send the user agent here; since we
+// can't tell who the user is from a bare navigation, it is sent on to the
+// frontend's logout page with the same parameters. As with /authorize, the
+// frontend then calls this on behalf of the signed-in user and is told where
+// to send the user agent afterwards. The user is logged out of every client,
+// since their session with us is over.
+func EndSessionHandler(ctx *Context, w http.ResponseWriter) error {
+	r := ctx.Request
+
+	err := r.ParseForm()
+	if err != nil {
+		return NewOAuthError("invalid_request", err.Error())
+	}
+
+	u, ok := context.GetOk(r, CurrentPrincipal)
+	if !ok {
+		endSessionUrl := ctx.Server.config.Server.EndSessionUrl
+		if endSessionUrl == "" {
+			endSessionUrl = ctx.Server.config.OpenID.Issuer + "/logout"
+		}
+
+		frontend, err := url.Parse(endSessionUrl)
+		if err != nil {
+			return NewOAuthError("internal_server_error", "invalid end session URL")
+		}
+
+		http.Redirect(w, r, redirectWithParams(frontend, r.Form), http.StatusSeeOther)
+		return nil
+	}
+	user := u.(*storage.User)
+
+	idTokenHint, err := readOneParamOptional(r, "id_token_hint")
+	if err != nil {
+		return err
+	}
+
+	clientId, err := readOneParamOptional(r, "client_id")
+	if err != nil {
+		return err
+	}
+
+	postLogoutRedirectUri, err := readOneParamOptional(r, "post_logout_redirect_uri")
+	if err != nil {
+		return err
+	}
+
+	state, err := readOneParamOptional(r, "state")
+	if err != nil {
+		return err
+	}
+
+	if idTokenHint != "" {
+		t, err := parseIdTokenHint(ctx, idTokenHint)
+		if err != nil {
+			return NewOAuthError("invalid_request", "invalid id_token_hint")
+		}
+
+		if t.Claims["sub"] != user.Email {
+			return NewOAuthError("invalid_request", "id_token_hint was issued to another user")
+		}
+
+		aud, _ := t.Claims["aud"].(string)
+		if clientId != "" && clientId != aud {
+			return NewOAuthError("invalid_request", "id_token_hint was issued to another client")
+		}
+		clientId = aud
+	}
+
+	var redirectUri *url.URL
+	if postLogoutRedirectUri != "" {
+		if clientId == "" {
+			return NewOAuthError("invalid_request", "post_logout_redirect_uri requires id_token_hint or client_id")
+		}
+
+		app, err := ctx.Server.store.Apps.FindByClientId(clientId)
+		if err != nil {
+			return NewOAuthError("invalid_request", "unknown client")
+		}
+
+		if !hasScope(strings.Fields(app.PostLogoutRedirectUris), postLogoutRedirectUri) {
+			return NewOAuthError("invalid_request", "post_logout_redirect_uri is not registered for this client")
+		}
+
+		redirectUri, err = url.Parse(postLogoutRedirectUri)
+		if err != nil {
+			return NewOAuthError("invalid_request", "invalid post_logout_redirect_uri")
+		}
+	}
+
+	clientIds, err := ctx.Server.store.Tokens.RevokeUserTokens(user.Id, 0)
+	if err != nil {
+		return NewOAuthError("internal_server_error", "could not log out")
+	}
+
+	ctx.Server.notifyLogout(clientIds, user)
+
+	resp := map[string]string{}
+	if redirectUri != nil {
+		resp["redirect_uri"] = redirectWithParams(redirectUri, url.Values{"state": {state}})
+	}
+
+	writeJson(w, resp)
+	return nil
+}
@@ -0,0 +1,194 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+
+	"github.com/paulrosania/registrar/storage"
+)
+
+func TestEndSession(t *testing.T) {
+	s := newTestServer(t)
+	newTestUser(t, s, "paul@example.com")
+	newTestUser(t, s, "eve@example.com")
+	frontendToken := newFrontend(t, s, "paul@example.com")
+
+	app := newTestApp(t, s, &storage.ApplicationParams{
+		Name:                   "Web",
+		GrantTypes:             []string{"password", "refresh_token"},
+		Scope:                  "openid email",
+		PostLogoutRedirectUris: []string{"https://app.example.com/bye"},
+	})
+	paul := passwordGrant(t, s, app, "paul@example.com", "openid")
+	eve := passwordGrant(t, s, app, "eve@example.com", "openid")
+
+	const bye = "https://app.example.com/bye"
+
+	// Only the last case logs the user out; the others must fail first.
+	cases := []struct {
+		name     string
+		method   string
+		auth     func(*http.Request)
+		form     url.Values
+		err      string
+		redirect string
+	}{
+		// Relying parties send the user agent here, and it is sent on to
+		// the frontend with the same parameters.
+		{"navigation", "GET", nil, url.Values{"client_id": {app.ClientId}, "post_logout_redirect_uri": {bye}, "state": {"xyz"}}, "", "https://example.com/logout?client_id=" + app.ClientId + "&post_logout_redirect_uri=" + url.QueryEscape(bye) + "&state=xyz"},
+		{"client's token", "POST", bearer(paul.AccessToken), url.Values{"id_token_hint": {paul.IdToken}}, "access_denied", ""},
+		{"unregistered redirect", "POST", bearer(frontendToken), url.Values{"id_token_hint": {paul.IdToken}, "post_logout_redirect_uri": {"https://evil.example.com/"}}, "invalid_request", ""},
+		{"redirect without client", "POST", bearer(frontendToken), url.Values{"post_logout_redirect_uri": {bye}}, "invalid_request", ""},
+		{"another user's hint", "POST", bearer(frontendToken), url.Values{"id_token_hint": {eve.IdToken}}, "invalid_request", ""},
+		{"hint for another client", "POST", bearer(frontendToken), url.Values{"id_token_hint": {paul.IdToken}, "client_id": {"someone-else"}}, "invalid_request", ""},
+		{"logged out", "POST", bearer(frontendToken), url.Values{"id_token_hint": {paul.IdToken}, "post_logout_redirect_uri": {bye}, "state": {"xyz"}}, "", bye + "?state=xyz"},
+	}
+
+	for _, c := range cases {
+		var req *http.Request
+		if c.method == "GET" {
+			req, _ = http.NewRequest("GET", "/end_session?"+c.form.Encode(), nil)
+		} else {
+			req, _ = http.NewRequest("POST", "/end_session", strings.NewReader(c.form.Encode()))
+			req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		}
+		if c.auth != nil {
+			c.auth(req)
+		}
+
+		w := serve(s, req)
+		if w.Code == http.StatusSeeOther {
+			if loc := w.Header().Get("Location"); loc != c.redirect {
+				t.Errorf("%s: expected to be sent to %s, got %s", c.name, c.redirect, loc)
+			}
+			continue
+		}
+
+		if typ := errorType(t, w); typ != c.err {
+			t.Errorf("%s: expected error %q, got %q", c.name, c.err, typ)
+			continue
+		}
+		if c.err != "" {
+			continue
+		}
+
+		var resp map[string]string
+		decodeJson(t, w, &resp)
+		if resp["redirect_uri"] != c.redirect {
+			t.Errorf("%s: expected redirect to %s, got %q", c.name, c.redirect, resp["redirect_uri"])
+		}
+	}
+
+	// The user is logged out of every client, but other users aren't.
+	refresh := func(token string) string {
+		return errorType(t, postForm(s, "/token", url.Values{
+			"grant_type":    {"refresh_token"},
+			"refresh_token": {token},
+		}, app.ClientId, app.ClientSecret))
+	}
+	if typ := refresh(paul.RefreshToken); typ != "invalid_grant" {
+		t.Errorf("expected the user's refresh token to be revoked, got %q", typ)
+	}
+	if typ := refresh(eve.RefreshToken); typ != "" {
+		t.Errorf("expected another user's refresh token to survive, got %q", typ)
+	}
+}
+
+func TestLogout(t *testing.T) {
+	s := newTestServer(t)
+	newTestUser(t, s, "paul@example.com")
+	frontendToken := newFrontend(t, s, "paul@example.com")
+
+	notified := make(chan string, 1)
+	rp := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		notified <- r.FormValue("logout_token")
+	}))
+	defer rp.Close()
+
+	web := newTestApp(t, s, &storage.ApplicationParams{
+		Name:       "Web",
+		GrantTypes: []string{"password", "refresh_token"},
+		Scope:      "openid",
+	})
+	mobile := newTestApp(t, s, &storage.ApplicationParams{
+		Name:                 "Mobile",
+		GrantTypes:           []string{"password", "refresh_token"},
+		Scope:                "openid",
+		BackchannelLogoutUri: rp.URL,
+	})
+
+	type grant struct {
+		app    *storage.Application
+		tokens *TokenResponse
+	}
+	webGrant := grant{web, passwordGrant(t, s, web, "paul@example.com", "openid")}
+	mobileGrant := grant{mobile, passwordGrant(t, s, mobile, "paul@example.com", "openid")}
+
+	cases := []struct {
+		name    string
+		auth    func(*http.Request)
+		all     string
+		err     string
+		revoked []grant
+		live    []grant
+		notify  *storage.Application
+	}{
+		{"this client", bearer(webGrant.tokens.AccessToken), "", "", []grant{webGrant}, []grant{mobileGrant}, nil},
+		{"password without all", basicUser, "", "invalid_request", nil, []grant{mobileGrant}, nil},
+		{"every client, from another client", bearer(mobileGrant.tokens.AccessToken), "true", "access_denied", nil, []grant{mobileGrant}, nil},
+		{"every client", bearer(frontendToken), "true", "", []grant{mobileGrant}, nil, mobile},
+	}
+
+	for _, c := range cases {
+		form := url.Values{"all": {c.all}}
+		req, _ := http.NewRequest("POST", "/logout", strings.NewReader(form.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		c.auth(req)
+
+		if typ := errorType(t, serve(s, req)); typ != c.err {
+			t.Errorf("%s: expected error %q, got %q", c.name, c.err, typ)
+			continue
+		}
+
+		for _, g := range append(c.revoked, c.live...) {
+			typ := errorType(t, postForm(s, "/token", url.Values{
+				"grant_type":    {"refresh_token"},
+				"refresh_token": {g.tokens.RefreshToken},
+			}, g.app.ClientId, g.app.ClientSecret))
+
+			revoked := typ == "invalid_grant"
+			wantRevoked := false
+			for _, r := range c.revoked {
+				wantRevoked = wantRevoked || r == g
+			}
+			if revoked != wantRevoked {
+				t.Errorf("%s: expected %s's refresh token revoked = %t, got error %q", c.name, g.app.Name, wantRevoked, typ)
+			}
+		}
+
+		if c.notify == nil {
+			continue
+		}
+
+		// Clients that registered for back-channel logout are told.
+		select {
+		case signed := <-notified:
+			token, err := s.ParseJWT(signed)
+			if err != nil {
+				t.Fatalf("%s: invalid logout token: %s", c.name, err)
+			}
+
+			events, _ := token.Claims["events"].(map[string]interface{})
+			if token.Claims["aud"] != c.notify.ClientId || token.Claims["sub"] != "paul@example.com" || events["http://schemas.openid.net/event/backchannel-logout"] == nil {
+				t.Errorf("%s: unexpected logout token claims %v", c.name, token.Claims)
+			}
+		case <-time.After(5 * time.Second):
+			t.Errorf("%s: expected %s to be notified", c.name, c.notify.Name)
+		}
+	}
+}
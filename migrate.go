@@ -0,0 +1,60 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/paulrosania/registrar/storage"
+)
+
+// migrateCommand implements `registrar migrate`, which brings the database
+// schema up to date. It needs a database user that may create and alter
+// tables, which the server itself shouldn't run as.
+func migrateCommand(cfg *Config, args []string) error {
+	if len(args) == 0 {
+		return errors.New("usage: registrar migrate up|down|status")
+	}
+
+	store, err := storage.NewClient(&storage.Config{
+		Database: cfg.Database,
+	})
+	if err != nil {
+		return err
+	}
+	defer store.Close()
+
+	switch args[0] {
+	case "up":
+		applied, err := store.MigrateUp()
+		for _, m := range applied {
+			fmt.Printf("%d\t%s\n", m.Version, m.Description)
+		}
+		if err != nil {
+			return err
+		}
+	case "down":
+		m, err := store.MigrateDown()
+		if err != nil {
+			return err
+		}
+		fmt.Printf("%d\t%s\n", m.Version, m.Description)
+	case "status":
+		statuses, err := store.Migrations()
+		if err != nil {
+			return err
+		}
+
+		for _, m := range statuses {
+			if m.AppliedAt != nil {
+				fmt.Printf("%d\t%s\tapplied %s\n", m.Version, m.Description, m.AppliedAt.Format(time.RFC3339))
+			} else {
+				fmt.Printf("%d\t%s\tpending\n", m.Version, m.Description)
+			}
+		}
+	default:
+		return fmt.Errorf("unknown migrate command %q", args[0])
+	}
+
+	return nil
+}
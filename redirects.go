@@ -0,0 +1,169 @@
+package main
+
+import (
+	"strings"
+
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/url"
+
+	"github.com/gorilla/mux"
+
+	"github.com/paulrosania/go-validation"
+	"github.com/paulrosania/registrar/storage"
+)
+
+// splitHost splits a URL host into hostname and port, either of which may be
+// empty. IPv6 addresses lose their brackets, with or without a port.
+func splitHost(host string) (hostname, port string) {
+	hostname, port, err := net.SplitHostPort(host)
+	if err != nil {
+		return strings.TrimSuffix(strings.TrimPrefix(host, "["), "]"), ""
+	}
+	return hostname, port
+}
+
+func isLoopbackHost(hostname string) bool {
+	if hostname == "localhost" {
+		return true
+	}
+
+	ip := net.ParseIP(hostname)
+	return ip != nil && ip.IsLoopback()
+}
+
+// redirectUriMatches reports whether a redirect URI presented in an
+// authorization request matches a registered one. Matching is exact, except
+// that native apps listening on a loopback interface may use any port, since
+// they can only pick one once they are running (RFC 8252 section 7.3).
+func redirectUriMatches(registered, presented string) bool {
+	if registered == presented {
+		return true
+	}
+
+	r, err := url.Parse(registered)
+	if err != nil {
+		return false
+	}
+
+	p, err := url.Parse(presented)
+	if err != nil {
+		return false
+	}
+
+	rHost, _ := splitHost(r.Host)
+	pHost, _ := splitHost(p.Host)
+	return r.Scheme == "http" && p.Scheme == "http" &&
+		isLoopbackHost(rHost) && rHost == pHost &&
+		r.Path == p.Path && r.RawQuery == p.RawQuery &&
+		r.User == nil && p.User == nil
+}
+
+// findRegisteredRedirect returns the redirect registered by app that matches
+// uri, for responseType or (if responseType is empty) any response type.
+func findRegisteredRedirect(ctx *Context, app *storage.Application, uri, responseType string) (*storage.RegisteredRedirect, error) {
+	redirects, err := ctx.Server.store.Apps.RegisteredRedirects(app)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, r := range redirects {
+		if (responseType == "" || r.ResponseType == responseType) && redirectUriMatches(r.Url, uri) {
+			return r, nil
+		}
+	}
+
+	return nil, nil
+}
+
+// findAdminClient loads the client named in the URL of an admin request.
+func findAdminClient(ctx *Context) (*storage.Application, error) {
+	app, err := ctx.Server.store.Apps.FindByClientId(mux.Vars(ctx.Request)["client_id"])
+	if err != nil {
+		return nil, NewOAuthError("invalid_request", "unknown client")
+	}
+
+	return app, nil
+}
+
+// GET /admin/clients/{client_id}/redirects
+func RedirectsHandler(ctx *Context, w http.ResponseWriter) error {
+	app, err := findAdminClient(ctx)
+	if err != nil {
+		return err
+	}
+
+	redirects, err := ctx.Server.store.Apps.RegisteredRedirects(app)
+	if err != nil {
+		return NewOAuthError("internal_server_error", "could not load redirects")
+	}
+
+	if redirects == nil {
+		redirects = []*storage.RegisteredRedirect{}
+	}
+
+	writeJson(w, redirects)
+	return nil
+}
+
+func readRedirect(r *http.Request) (*storage.RegisteredRedirect, error) {
+	redirect := &storage.RegisteredRedirect{}
+	err := json.NewDecoder(r.Body).Decode(redirect)
+	if err != nil {
+		return nil, NewOAuthError("invalid_request", err.Error())
+	}
+
+	v := validation.NewMultiValidator()
+	v.Assert(isAbsoluteUrl(redirect.Url), "redirect_uri", "must be an absolute URL without a fragment")
+	v.Assert(redirect.ResponseType == "code", "response_type", "unsupported response type")
+	if !v.Valid() {
+		err := NewOAuthError("invalid_request", "validation failed")
+		err.Meta["fields"] = v.Errors()
+		return nil, err
+	}
+
+	return redirect, nil
+}
+
+// POST /admin/clients/{client_id}/redirects
+func AddRedirectHandler(ctx *Context, w http.ResponseWriter) error {
+	app, err := findAdminClient(ctx)
+	if err != nil {
+		return err
+	}
+
+	redirect, err := readRedirect(ctx.Request)
+	if err != nil {
+		return err
+	}
+
+	err = ctx.Server.store.Apps.AddRedirect(app, redirect.Url, redirect.ResponseType)
+	if err != nil {
+		return NewOAuthError("internal_server_error", "could not add redirect")
+	}
+
+	writeJson(w, redirect)
+	return nil
+}
+
+// DELETE /admin/clients/{client_id}/redirects
+func RemoveRedirectHandler(ctx *Context, w http.ResponseWriter) error {
+	app, err := findAdminClient(ctx)
+	if err != nil {
+		return err
+	}
+
+	redirect, err := readRedirect(ctx.Request)
+	if err != nil {
+		return err
+	}
+
+	err = ctx.Server.store.Apps.RemoveRedirect(app, redirect.Url, redirect.ResponseType)
+	if err != nil {
+		return NewOAuthError("internal_server_error", "could not remove redirect")
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+	return nil
+}
@@ -0,0 +1,40 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestRedirectUriMatches(t *testing.T) {
+	cases := []struct {
+		registered string
+		presented  string
+		match      bool
+	}{
+		{"https://app.example.com/cb", "https://app.example.com/cb", true},
+		{"https://app.example.com/cb", "https://app.example.com/cb/", false},
+		{"https://app.example.com/cb", "https://app.example.com:8443/cb", false},
+		{"https://app.example.com/cb", "https://app.example.com/cb?next=/", false},
+		{"http://app.example.com/cb", "http://app.example.com:8080/cb", false},
+
+		// Native apps on a loopback interface may pick any port.
+		{"http://127.0.0.1/cb", "http://127.0.0.1:51234/cb", true},
+		{"http://127.0.0.1:8080/cb", "http://127.0.0.1:51234/cb", true},
+		{"http://localhost/cb", "http://localhost:51234/cb", true},
+		{"http://[::1]/cb", "http://[::1]:51234/cb", true},
+
+		// But nothing else about the URI may change.
+		{"http://127.0.0.1/cb", "http://127.0.0.1:51234/other", false},
+		{"http://127.0.0.1/cb", "http://127.0.0.1:51234/cb?x=1", false},
+		{"http://127.0.0.1/cb", "http://localhost:51234/cb", false},
+		{"http://127.0.0.1/cb", "https://127.0.0.1:51234/cb", false},
+		{"https://127.0.0.1/cb", "https://127.0.0.1:51234/cb", false},
+		{"http://127.0.0.1/cb", "http://evil@127.0.0.1:51234/cb", false},
+		{"http://127.0.0.1/cb", "http://127.0.0.1.evil.com:51234/cb", false},
+	}
+
+	for _, c := range cases {
+		if got := redirectUriMatches(c.registered, c.presented); got != c.match {
+			t.Errorf("redirectUriMatches(%q, %q) = %t, expected %t", c.registered, c.presented, got, c.match)
+		}
+	}
+}
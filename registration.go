@@ -0,0 +1,454 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"crypto/subtle"
+	"encoding/json"
+	"net/http"
+	"net/url"
+
+	"github.com/gorilla/context"
+	"github.com/gorilla/mux"
+
+	"github.com/paulrosania/go-validation"
+	"github.com/paulrosania/registrar/storage"
+)
+
+// ClientMetadata is the client metadata (RFC 7591 section 2) a client may
+// register.
+type ClientMetadata struct {
+	RedirectUris            []string `json:"redirect_uris,omitempty"`
+	TokenEndpointAuthMethod string   `json:"token_endpoint_auth_method,omitempty"`
+	GrantTypes              []string `json:"grant_types,omitempty"`
+	ResponseTypes           []string `json:"response_types,omitempty"`
+	ClientName              string   `json:"client_name,omitempty"`
+	ClientUri               string   `json:"client_uri,omitempty"`
+	LogoUri                 string   `json:"logo_uri,omitempty"`
+	Scope                   string   `json:"scope,omitempty"`
+	Jwks                    *JWKSet  `json:"jwks,omitempty"`
+	PostLogoutRedirectUris  []string `json:"post_logout_redirect_uris,omitempty"`
+	BackchannelLogoutUri    string   `json:"backchannel_logout_uri,omitempty"`
+
+	UserinfoSignedResponseAlg string `json:"userinfo_signed_response_alg,omitempty"`
+
+	// Extensions: whether refresh tokens are rotated on every use, and how
+	// long (in seconds) they last after the user authenticates, and without
+	// being used. Zero means no limit.
+	RefreshTokenRotation     bool `json:"refresh_token_rotation,omitempty"`
+	RefreshTokenLifetime     int  `json:"refresh_token_lifetime,omitempty"`
+	RefreshTokenIdleLifetime int  `json:"refresh_token_idle_lifetime,omitempty"`
+}
+
+// ClientRegistration describes a registered client. The client secret and
+// registration access token are only returned when they are first issued.
+type ClientRegistration struct {
+	ClientId                string `json:"client_id"`
+	ClientSecret            string `json:"client_secret,omitempty"`
+	ClientSecretExpiresAt   *int64 `json:"client_secret_expires_at,omitempty"`
+	RegistrationAccessToken string `json:"registration_access_token,omitempty"`
+	RegistrationClientUri   string `json:"registration_client_uri"`
+
+	ClientMetadata
+}
+
+var supportedAuthMethods = []string{
+	"client_secret_basic",
+	"client_secret_post",
+	"private_key_jwt",
+	"none",
+}
+
+var supportedGrantTypes = []string{
+	"authorization_code",
+	"refresh_token",
+	"client_credentials",
+	"password",
+	deviceCodeGrantType,
+	tokenExchangeGrantType,
+	jwtBearerGrantType,
+}
+
+// Algorithms userinfo responses may be signed with, if a client asks for them
+// signed.
+var userinfoSigningAlgs = []string{"RS256"}
+
+// Grants that public clients may use; see TokenHandler.
+var publicGrantTypes = []string{
+	"authorization_code",
+	"refresh_token",
+	deviceCodeGrantType,
+}
+
+// Grants that let a client obtain tokens for users without their approval
+// (or, for the password grant, by handling their credentials). Only admins may
+// register clients for them.
+var adminGrantTypes = []string{
+	"password",
+	tokenExchangeGrantType,
+	jwtBearerGrantType,
+}
+
+func containsAny(set, values []string) bool {
+	for _, v := range values {
+		if hasScope(set, v) {
+			return true
+		}
+	}
+	return false
+}
+
+// Clients that don't ask for particular scopes get the standard OpenID ones.
+const defaultClientScope = "openid email profile"
+
+func isAbsoluteUrl(s string) bool {
+	u, err := url.Parse(s)
+	return err == nil && u.IsAbs() && u.Fragment == ""
+}
+
+func containsAll(set, values []string) bool {
+	for _, v := range values {
+		if !hasScope(set, v) {
+			return false
+		}
+	}
+	return true
+}
+
+// validateClientMetadata checks registration metadata, filling in defaults,
+// and translates it into application parameters. Only admins may register
+// clients that can request the admin scope or use adminGrantTypes.
+func validateClientMetadata(m *ClientMetadata, admin bool) (*storage.ApplicationParams, error) {
+	if m.TokenEndpointAuthMethod == "" {
+		m.TokenEndpointAuthMethod = "client_secret_basic"
+	}
+	if len(m.GrantTypes) == 0 {
+		m.GrantTypes = []string{"authorization_code"}
+	}
+	if len(m.ResponseTypes) == 0 {
+		m.ResponseTypes = []string{"code"}
+	}
+	if m.Scope == "" {
+		m.Scope = defaultClientScope
+	}
+
+	v := validation.NewMultiValidator()
+	v.Assert(hasScope(supportedAuthMethods, m.TokenEndpointAuthMethod), "token_endpoint_auth_method", "unsupported authentication method")
+	v.Assert(containsAll(supportedGrantTypes, m.GrantTypes), "grant_types", "unsupported grant type")
+	v.Assert(m.TokenEndpointAuthMethod != "none" || containsAll(publicGrantTypes, m.GrantTypes), "grant_types", "grant type requires client authentication")
+	v.Assert(containsAll([]string{"code"}, m.ResponseTypes), "response_types", "unsupported response type")
+	v.Assert(m.ClientUri == "" || isAbsoluteUrl(m.ClientUri), "client_uri", "must be an absolute URL")
+	v.Assert(m.LogoUri == "" || isAbsoluteUrl(m.LogoUri), "logo_uri", "must be an absolute URL")
+	v.Assert(admin || !containsAny(adminGrantTypes, m.GrantTypes), "grant_types", "grant type requires an admin registration")
+	v.Assert(admin || !hasScope(parseScope(m.Scope), "admin"), "scope", "admin scope requires an admin registration")
+
+	redirectUrisValid := true
+	for _, uri := range m.RedirectUris {
+		redirectUrisValid = redirectUrisValid && isAbsoluteUrl(uri)
+	}
+	v.Assert(redirectUrisValid, "redirect_uris", "must be absolute URLs without fragments")
+
+	postLogoutRedirectUrisValid := true
+	for _, uri := range m.PostLogoutRedirectUris {
+		postLogoutRedirectUrisValid = postLogoutRedirectUrisValid && isAbsoluteUrl(uri) && !strings.Contains(uri, " ")
+	}
+	v.Assert(postLogoutRedirectUrisValid, "post_logout_redirect_uris", "must be absolute URLs without fragments")
+	v.Assert(m.BackchannelLogoutUri == "" || isAbsoluteUrl(m.BackchannelLogoutUri), "backchannel_logout_uri", "must be an absolute URL")
+	v.Assert(m.UserinfoSignedResponseAlg == "" || hasScope(userinfoSigningAlgs, m.UserinfoSignedResponseAlg), "userinfo_signed_response_alg", "unsupported signing algorithm")
+	v.Assert(m.RefreshTokenLifetime >= 0, "refresh_token_lifetime", "must not be negative")
+	v.Assert(m.RefreshTokenIdleLifetime >= 0, "refresh_token_idle_lifetime", "must not be negative")
+	v.Assert(len(m.RedirectUris) > 0 || !hasScope(m.GrantTypes, "authorization_code"), "redirect_uris", "required for the authorization_code grant")
+
+	var jwks string
+	if m.Jwks != nil {
+		buf, err := json.Marshal(m.Jwks)
+		if err != nil {
+			return nil, NewOAuthError("invalid_client_metadata", err.Error())
+		}
+		jwks = string(buf)
+
+		keysValid := len(m.Jwks.Keys) > 0
+		for _, k := range m.Jwks.Keys {
+			_, err := k.PublicKey()
+			keysValid = keysValid && err == nil
+		}
+		v.Assert(keysValid, "jwks", "must contain only RSA public keys")
+	}
+	v.Assert(m.TokenEndpointAuthMethod != "private_key_jwt" || m.Jwks != nil, "jwks", "required for private_key_jwt authentication")
+
+	if !v.Valid() {
+		errs := v.Errors()
+		typ := "invalid_client_metadata"
+		if _, ok := errs["redirect_uris"]; ok {
+			typ = "invalid_redirect_uri"
+		}
+
+		err := NewOAuthError(typ, "validation failed")
+		err.Meta["fields"] = errs
+		return nil, err
+	}
+
+	return &storage.ApplicationParams{
+		Name:                    m.ClientName,
+		Website:                 m.ClientUri,
+		Logo:                    m.LogoUri,
+		TokenEndpointAuthMethod: m.TokenEndpointAuthMethod,
+		GrantTypes:              m.GrantTypes,
+		ResponseTypes:           m.ResponseTypes,
+		RedirectUris:            m.RedirectUris,
+		Scope:                   formatScope(parseScope(m.Scope)),
+		Jwks:                    jwks,
+		PostLogoutRedirectUris:  m.PostLogoutRedirectUris,
+		BackchannelLogoutUri:    m.BackchannelLogoutUri,
+
+		UserinfoSignedResponseAlg: m.UserinfoSignedResponseAlg,
+		RefreshTokenRotation:      m.RefreshTokenRotation,
+		RefreshTokenLifetime:      m.RefreshTokenLifetime,
+		RefreshTokenIdleLifetime:  m.RefreshTokenIdleLifetime,
+	}, nil
+}
+
+// newClientRegistration describes app's registration. Secrets are included
+// if app carries them, i.e. if they were just issued.
+func newClientRegistration(ctx *Context, app *storage.Application) (*ClientRegistration, error) {
+	redirectUris, err := ctx.Server.store.Apps.RedirectUris(app)
+	if err != nil {
+		return nil, err
+	}
+
+	permitted, err := ctx.Server.store.Apps.PermittedScopes(app)
+	if err != nil {
+		return nil, err
+	}
+
+	reg := &ClientRegistration{
+		ClientId:              app.ClientId,
+		ClientSecret:          app.ClientSecret,
+		RegistrationClientUri: ctx.Server.config.Server.BaseUrl + "/clients/" + url.QueryEscape(app.ClientId),
+		ClientMetadata: ClientMetadata{
+			RedirectUris:            redirectUris,
+			TokenEndpointAuthMethod: app.TokenEndpointAuthMethod,
+			GrantTypes:              strings.Fields(app.GrantTypes),
+			ResponseTypes:           strings.Fields(app.ResponseTypes),
+			ClientName:              app.Name,
+			ClientUri:               app.Website,
+			LogoUri:                 app.Logo,
+			Scope:                   formatScope(permitted),
+			PostLogoutRedirectUris:  strings.Fields(app.PostLogoutRedirectUris),
+			BackchannelLogoutUri:    app.BackchannelLogoutUri,
+
+			UserinfoSignedResponseAlg: app.UserinfoSignedResponseAlg,
+			RefreshTokenRotation:      app.RefreshTokenRotation,
+			RefreshTokenLifetime:      app.RefreshTokenLifetime,
+			RefreshTokenIdleLifetime:  app.RefreshTokenIdleLifetime,
+		},
+	}
+
+	if app.ClientSecret != "" {
+		// Client secrets don't expire.
+		var expiresAt int64
+		reg.ClientSecretExpiresAt = &expiresAt
+	}
+
+	if app.Jwks != "" {
+		reg.Jwks, err = ParseJWKSet(app.Jwks)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return reg, nil
+}
+
+func readBearerToken(r *http.Request) (string, bool) {
+	parts := strings.SplitN(r.Header.Get("Authorization"), " ", 2)
+	if len(parts) != 2 || strings.ToLower(parts[0]) != "bearer" {
+		return "", false
+	}
+	return parts[1], true
+}
+
+// authorizeRegistration checks that the caller may register clients: they must
+// present either one of the configured initial access tokens, or an admin's
+// access token carrying the admin scope. It reports whether the caller is an
+// admin.
+func authorizeRegistration(ctx *Context) (bool, error) {
+	r := ctx.Request
+
+	token, ok := readBearerToken(r)
+	if !ok {
+		return false, NewOAuthError("access_denied", "registration requires an initial access token")
+	}
+
+	for _, t := range ctx.Server.config.Registration.InitialAccessTokens {
+		if subtle.ConstantTimeCompare([]byte(t), []byte(token)) == 1 {
+			return false, nil
+		}
+	}
+
+	user, err := findUserByBearerAuth(ctx, token)
+	if err != nil {
+		return false, NewOAuthError("access_denied", "invalid initial access token")
+	}
+
+	if !user.(*storage.User).Admin {
+		return false, NewOAuthError("access_denied", "registration requires the admin role")
+	}
+
+	t, ok := context.Get(r, CurrentAccessToken).(*storage.Token)
+	if !ok || !hasScope(parseScope(t.Scope), "admin") {
+		return false, NewOAuthError("access_denied", "registration requires the admin scope")
+	}
+
+	return true, nil
+}
+
+// findRegisteredClient authenticates a request to manage a client's
+// registration (RFC 7592), which must carry the registration access token
+// issued along with the client.
+func findRegisteredClient(ctx *Context) (*storage.Application, error) {
+	token, ok := readBearerToken(ctx.Request)
+	if !ok {
+		return nil, NewOAuthError("access_denied", "registration access token required")
+	}
+
+	app, err := ctx.Server.store.Apps.FindByClientId(mux.Vars(ctx.Request)["client_id"])
+	if err != nil || !app.VerifyRegistrationAccessToken(token) {
+		return nil, NewOAuthError("access_denied", "invalid registration access token")
+	}
+
+	return app, nil
+}
+
+// POST /clients
+func RegisterClientHandler(ctx *Context, w http.ResponseWriter) error {
+	r := ctx.Request
+	defer context.Clear(r)
+
+	admin, err := authorizeRegistration(ctx)
+	if err != nil {
+		return err
+	}
+
+	m := &ClientMetadata{}
+	err = json.NewDecoder(r.Body).Decode(m)
+	if err != nil {
+		return NewOAuthError("invalid_client_metadata", err.Error())
+	}
+
+	params, err := validateClientMetadata(m, admin)
+	if err != nil {
+		return err
+	}
+
+	app, err := ctx.Server.store.Apps.New(params)
+	if err != nil {
+		return NewOAuthError("internal_server_error", "could not register client")
+	}
+
+	reg, err := newClientRegistration(ctx, app)
+	if err != nil {
+		return NewOAuthError("internal_server_error", "could not register client")
+	}
+	reg.RegistrationAccessToken = app.RegistrationAccessToken
+
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(http.StatusCreated)
+	writeJson(w, reg)
+	return nil
+}
+
+// GET /clients/{client_id}
+func ClientConfigurationHandler(ctx *Context, w http.ResponseWriter) error {
+	app, err := findRegisteredClient(ctx)
+	if err != nil {
+		return err
+	}
+
+	reg, err := newClientRegistration(ctx, app)
+	if err != nil {
+		return NewOAuthError("internal_server_error", "could not load client")
+	}
+
+	w.Header().Set("Cache-Control", "no-store")
+	writeJson(w, reg)
+	return nil
+}
+
+// PUT /clients/{client_id}
+//
+// Replaces the client's metadata wholesale: omitted fields are reset to their
+// defaults, per RFC 7592.
+func UpdateClientHandler(ctx *Context, w http.ResponseWriter) error {
+	r := ctx.Request
+
+	app, err := findRegisteredClient(ctx)
+	if err != nil {
+		return err
+	}
+
+	m := &struct {
+		ClientId string `json:"client_id"`
+		ClientMetadata
+	}{}
+	err = json.NewDecoder(r.Body).Decode(m)
+	if err != nil {
+		return NewOAuthError("invalid_client_metadata", err.Error())
+	}
+
+	if m.ClientId != app.ClientId {
+		return NewOAuthError("invalid_request", fmt.Sprintf("client_id must be %q", app.ClientId))
+	}
+
+	// Clients may keep the admin scope and admin-only grants if an admin
+	// granted them, but may not add them themselves.
+	permitted, err := ctx.Server.store.Apps.PermittedScopes(app)
+	if err != nil {
+		return NewOAuthError("internal_server_error", "could not load client")
+	}
+
+	keepsGrants := hasScope(permitted, "admin") || !hasScope(parseScope(m.Scope), "admin")
+	for _, g := range m.GrantTypes {
+		if hasScope(adminGrantTypes, g) && !hasScope(strings.Fields(app.GrantTypes), g) {
+			keepsGrants = false
+		}
+	}
+
+	params, err := validateClientMetadata(&m.ClientMetadata, keepsGrants)
+	if err != nil {
+		return err
+	}
+	params.Description = app.Description
+
+	app, err = ctx.Server.store.Apps.Update(app, params)
+	if err != nil {
+		return NewOAuthError("internal_server_error", "could not update client")
+	}
+
+	reg, err := newClientRegistration(ctx, app)
+	if err != nil {
+		return NewOAuthError("internal_server_error", "could not load client")
+	}
+
+	w.Header().Set("Cache-Control", "no-store")
+	writeJson(w, reg)
+	return nil
+}
+
+// DELETE /clients/{client_id}
+func DeleteClientHandler(ctx *Context, w http.ResponseWriter) error {
+	app, err := findRegisteredClient(ctx)
+	if err != nil {
+		return err
+	}
+
+	err = ctx.Server.store.Apps.Delete(app)
+	if err != nil {
+		return NewOAuthError("internal_server_error", "could not delete client")
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+	return nil
+}
@@ -0,0 +1,224 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+
+	"github.com/paulrosania/registrar/storage"
+)
+
+func TestRegisterClient(t *testing.T) {
+	s := newTestServer(t)
+	s.config.Registration.InitialAccessTokens = []string{"initial"}
+
+	newTestUser(t, s, "paul@example.com")
+	admin := newTestUser(t, s, "admin@example.com")
+	err := s.store.Users.SetAdmin(admin, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	console := newTestApp(t, s, &storage.ApplicationParams{
+		Name:       "Console",
+		GrantTypes: []string{"password"},
+		Scope:      "openid admin",
+	})
+	adminToken := passwordGrant(t, s, console, "admin@example.com", "openid admin").AccessToken
+	adminTokenWithoutScope := passwordGrant(t, s, console, "admin@example.com", "openid").AccessToken
+	userToken := passwordGrant(t, s, console, "paul@example.com", "openid admin").AccessToken
+
+	const web = `{"redirect_uris": ["https://app.example.com/cb"]}`
+	const password = `{"grant_types": ["password"]}`
+
+	cases := []struct {
+		name  string
+		token string
+		body  string
+		err   string
+	}{
+		{"no token", "", web, "access_denied"},
+		{"unknown token", "bogus", web, "access_denied"},
+		{"initial access token", "initial", web, ""},
+		{"initial access token, admin grant", "initial", password, "invalid_client_metadata"},
+		{"initial access token, admin scope", "initial", `{"grant_types": ["client_credentials"], "scope": "openid admin"}`, "invalid_client_metadata"},
+		{"admin", adminToken, password, ""},
+		{"admin without the admin scope", adminTokenWithoutScope, password, "access_denied"},
+		{"user who isn't an admin", userToken, web, "access_denied"},
+		{"relative redirect URI", "initial", `{"redirect_uris": ["/cb"]}`, "invalid_redirect_uri"},
+		{"code grant without redirect URIs", "initial", `{}`, "invalid_redirect_uri"},
+		{"public client, secret grant", "initial", `{"token_endpoint_auth_method": "none", "grant_types": ["client_credentials"]}`, "invalid_client_metadata"},
+		{"private_key_jwt without keys", "initial", `{"token_endpoint_auth_method": "private_key_jwt", "grant_types": ["client_credentials"]}`, "invalid_client_metadata"},
+		{"signed userinfo", "initial", `{"redirect_uris": ["https://app.example.com/cb"], "userinfo_signed_response_alg": "RS256"}`, ""},
+		{"unsupported userinfo algorithm", "initial", `{"redirect_uris": ["https://app.example.com/cb"], "userinfo_signed_response_alg": "HS256"}`, "invalid_client_metadata"},
+		{"rotated refresh tokens", "initial", `{"redirect_uris": ["https://app.example.com/cb"], "refresh_token_rotation": true, "refresh_token_lifetime": 86400}`, ""},
+		{"negative refresh token lifetime", "initial", `{"redirect_uris": ["https://app.example.com/cb"], "refresh_token_idle_lifetime": -1}`, "invalid_client_metadata"},
+	}
+
+	for _, c := range cases {
+		req, _ := http.NewRequest("POST", "/clients", strings.NewReader(c.body))
+		if c.token != "" {
+			bearer(c.token)(req)
+		}
+
+		w := serve(s, req)
+		if typ := errorType(t, w); typ != c.err {
+			t.Errorf("%s: expected error %q, got %q", c.name, c.err, typ)
+			continue
+		}
+		if c.err != "" {
+			continue
+		}
+
+		var reg ClientRegistration
+		decodeJson(t, w, &reg)
+		if reg.ClientId == "" || reg.ClientSecret == "" || reg.RegistrationAccessToken == "" {
+			t.Errorf("%s: expected client credentials, got %+v", c.name, reg)
+		}
+	}
+}
+
+func TestSignedUserinfo(t *testing.T) {
+	s := newTestServer(t)
+
+	admin := newTestUser(t, s, "admin@example.com")
+	err := s.store.Users.SetAdmin(admin, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	console := newTestApp(t, s, &storage.ApplicationParams{
+		Name:       "Console",
+		GrantTypes: []string{"password"},
+		Scope:      "openid admin",
+	})
+	adminToken := passwordGrant(t, s, console, "admin@example.com", "openid admin").AccessToken
+
+	cases := []struct {
+		name        string
+		alg         string
+		contentType string
+	}{
+		{"plain", "", "application/json"},
+		{"signed", "RS256", "application/jwt"},
+	}
+
+	for _, c := range cases {
+		body := fmt.Sprintf(`{"grant_types": ["password"], "scope": "openid email", "userinfo_signed_response_alg": %q}`, c.alg)
+		req, _ := http.NewRequest("POST", "/clients", strings.NewReader(body))
+		bearer(adminToken)(req)
+
+		var reg ClientRegistration
+		decodeJson(t, serve(s, req), &reg)
+		if reg.UserinfoSignedResponseAlg != c.alg {
+			t.Errorf("%s: expected userinfo_signed_response_alg %q, got %q", c.name, c.alg, reg.UserinfoSignedResponseAlg)
+		}
+
+		app := &storage.Application{ClientId: reg.ClientId, ClientSecret: reg.ClientSecret}
+		token := passwordGrant(t, s, app, "admin@example.com", "openid email").AccessToken
+
+		req, _ = http.NewRequest("GET", "/userinfo", nil)
+		bearer(token)(req)
+		w := serve(s, req)
+		if ct := w.Header().Get("Content-Type"); !strings.HasPrefix(ct, c.contentType) {
+			t.Errorf("%s: expected a %s response, got %s: %s", c.name, c.contentType, ct, w.Body)
+		}
+	}
+}
+
+func TestUpdateClient(t *testing.T) {
+	s := newTestServer(t)
+
+	ordinary := newTestApp(t, s, &storage.ApplicationParams{
+		Name:       "Ordinary",
+		GrantTypes: []string{"client_credentials"},
+		Scope:      "openid",
+	})
+	privileged := newTestApp(t, s, &storage.ApplicationParams{
+		Name:       "Privileged",
+		GrantTypes: []string{"password"},
+		Scope:      "openid admin",
+	})
+
+	cases := []struct {
+		name     string
+		app      *storage.Application
+		token    string
+		clientId string
+		body     string
+		err      string
+	}{
+		{"rename", ordinary, ordinary.RegistrationAccessToken, ordinary.ClientId, `"client_name": "Renamed", "grant_types": ["client_credentials"]`, ""},
+		{"add admin grant", ordinary, ordinary.RegistrationAccessToken, ordinary.ClientId, `"grant_types": ["client_credentials", "password"]`, "invalid_client_metadata"},
+		{"add admin scope", ordinary, ordinary.RegistrationAccessToken, ordinary.ClientId, `"grant_types": ["client_credentials"], "scope": "openid admin"`, "invalid_client_metadata"},
+		{"keep admin grant and scope", privileged, privileged.RegistrationAccessToken, privileged.ClientId, `"grant_types": ["password"], "scope": "openid admin"`, ""},
+		{"another client's token", ordinary, privileged.RegistrationAccessToken, ordinary.ClientId, `"grant_types": ["client_credentials"]`, "access_denied"},
+		{"mismatched client_id", ordinary, ordinary.RegistrationAccessToken, privileged.ClientId, `"grant_types": ["client_credentials"]`, "invalid_request"},
+	}
+
+	for _, c := range cases {
+		body := fmt.Sprintf(`{"client_id": %q, %s}`, c.clientId, c.body)
+		req, _ := http.NewRequest("PUT", "/clients/"+c.app.ClientId, strings.NewReader(body))
+		bearer(c.token)(req)
+
+		w := serve(s, req)
+		if typ := errorType(t, w); typ != c.err {
+			t.Errorf("%s: expected error %q, got %q", c.name, c.err, typ)
+		}
+	}
+}
+
+func TestTokenEndpointEnforcesRegistration(t *testing.T) {
+	s := newTestServer(t)
+
+	basic := newTestApp(t, s, &storage.ApplicationParams{
+		Name:       "Basic",
+		GrantTypes: []string{"client_credentials"},
+	})
+	post := newTestApp(t, s, &storage.ApplicationParams{
+		Name:                    "Post",
+		TokenEndpointAuthMethod: "client_secret_post",
+		GrantTypes:              []string{"client_credentials"},
+	})
+	web := newTestApp(t, s, &storage.ApplicationParams{
+		Name:       "Web",
+		GrantTypes: []string{"authorization_code"},
+	})
+
+	cases := []struct {
+		name   string
+		app    *storage.Application
+		grant  string
+		inline bool
+		err    string
+	}{
+		{"basic auth", basic, "client_credentials", false, ""},
+		{"basic auth client posting its secret", basic, "client_credentials", true, "invalid_client"},
+		{"posted secret", post, "client_credentials", true, ""},
+		{"post client using basic auth", post, "client_credentials", false, "invalid_client"},
+		{"unregistered grant", web, "client_credentials", false, "unauthorized_client"},
+		{"unregistered admin grant", web, "password", false, "unauthorized_client"},
+	}
+
+	for _, c := range cases {
+		form := url.Values{"grant_type": {c.grant}}
+
+		var w *httptest.ResponseRecorder
+		if c.inline {
+			form.Set("client_id", c.app.ClientId)
+			form.Set("client_secret", c.app.ClientSecret)
+			req, _ := http.NewRequest("POST", "/token", strings.NewReader(form.Encode()))
+			req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			w = serve(s, req)
+		} else {
+			w = postForm(s, "/token", form, c.app.ClientId, c.app.ClientSecret)
+		}
+
+		if typ := errorType(t, w); typ != c.err {
+			t.Errorf("%s: expected error %q, got %q", c.name, c.err, typ)
+		}
+	}
+}
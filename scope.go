@@ -0,0 +1,34 @@
+package main
+
+import (
+	"strings"
+)
+
+func parseScope(scope string) []string {
+	return strings.Fields(scope)
+}
+
+func formatScope(scopes []string) string {
+	return strings.Join(scopes, " ")
+}
+
+func hasScope(scopes []string, name string) bool {
+	for _, s := range scopes {
+		if s == name {
+			return true
+		}
+	}
+	return false
+}
+
+// intersectScopes returns the requested scopes that also appear in permitted,
+// preserving the order in which they were requested.
+func intersectScopes(requested, permitted []string) []string {
+	out := make([]string, 0, len(requested))
+	for _, s := range requested {
+		if hasScope(permitted, s) && !hasScope(out, s) {
+			out = append(out, s)
+		}
+	}
+	return out
+}
@@ -35,16 +35,17 @@ function createdb() {
   postgres_run "createdb $connection_opts $dbname"
 }
 
-function dbimport() {
-  postgres_run "psql $connection_opts -d $dbname < /db/schema.sql"
-}
-
+# Tables are created by `registrar migrate up`, run as a user that owns the
+# schema; the registrar user gets access to them as they're created.
 function grant() {
   psql_run "GRANT SELECT, INSERT, UPDATE, DELETE ON ALL TABLES IN SCHEMA public TO $dbuser;"
   psql_run "GRANT USAGE, SELECT ON ALL SEQUENCES IN SCHEMA public TO $dbuser;"
+  psql_run "ALTER DEFAULT PRIVILEGES IN SCHEMA public GRANT SELECT, INSERT, UPDATE, DELETE ON TABLES TO $dbuser;"
+  psql_run "ALTER DEFAULT PRIVILEGES IN SCHEMA public GRANT USAGE, SELECT ON SEQUENCES TO $dbuser;"
 }
 
 createuser
 createdb
-dbimport
 grant
+
+echo "Now run 'registrar migrate up' as the postgres user to create the schema."
@@ -5,10 +5,11 @@ import (
 	"fmt"
 	"log"
 	"os"
+	"sync"
+	"syscall"
 
-	"crypto/rsa"
-	"io/ioutil"
 	"net/http"
+	"os/signal"
 
 	"github.com/BurntSushi/toml"
 	"github.com/dgrijalva/jwt-go"
@@ -25,8 +26,8 @@ type Server struct {
 	config *Config
 	store  *storage.Client
 
-	verificationKey *rsa.PublicKey
-	signingKey      *rsa.PrivateKey
+	keysMu sync.RWMutex
+	keys   *KeySet
 }
 
 func NewServer(cfg *Config) *Server {
@@ -39,6 +40,11 @@ func NewServer(cfg *Config) *Server {
 		panic(err)
 	}
 
+	err = store.CheckSchema()
+	if err != nil {
+		panic(err)
+	}
+
 	s := &Server{
 		Server: http.Server{
 			Addr:    cfg.Server.Bind,
@@ -49,12 +55,7 @@ func NewServer(cfg *Config) *Server {
 		store:  store,
 	}
 
-	err = s.loadSigningKey()
-	if err != nil {
-		panic(err)
-	}
-
-	err = s.loadVerificationKey()
+	err = s.loadKeys()
 	if err != nil {
 		panic(err)
 	}
@@ -64,50 +65,89 @@ func NewServer(cfg *Config) *Server {
 	return s
 }
 
-func (s *Server) loadSigningKey() error {
-	buf, err := ioutil.ReadFile(s.config.JWT.PrivateKey)
-	if err != nil {
-		return err
+func (s *Server) loadKeys() error {
+	var keys *KeySet
+	var err error
+	if dir := s.config.JWT.KeyDir; dir != "" {
+		keys, err = LoadKeyDir(dir)
+	} else {
+		keys, err = LoadKeyFiles(s.config.JWT.PrivateKey, s.config.JWT.PublicKey, s.config.JWT.RetiredKeys)
 	}
-
-	s.signingKey, err = jwt.ParseRSAPrivateKeyFromPEM(buf)
 	if err != nil {
 		return err
 	}
 
+	s.keysMu.Lock()
+	s.keys = keys
+	s.keysMu.Unlock()
+
+	log.Println("Loaded signing keys, active key:", keys.Active().Id)
 	return nil
 }
 
-func (s *Server) loadVerificationKey() error {
-	buf, err := ioutil.ReadFile(s.config.JWT.PublicKey)
-	if err != nil {
-		return err
-	}
-
-	s.verificationKey, err = jwt.ParseRSAPublicKeyFromPEM(buf)
-	if err != nil {
-		return err
+// reloadKeysOnSignal reloads the key set whenever the process receives
+// SIGHUP, e.g. after running `registrar keys promote`.
+func (s *Server) reloadKeysOnSignal() {
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, syscall.SIGHUP)
+	for range c {
+		err := s.loadKeys()
+		if err != nil {
+			log.Println("Failed reloading signing keys:", err)
+		}
 	}
+}
 
-	return nil
+func (s *Server) Keys() *KeySet {
+	s.keysMu.RLock()
+	defer s.keysMu.RUnlock()
+	return s.keys
 }
 
 func (s *Server) loadRoutes() {
 	// Logged-out endpoints
 	s.handleFunc("/accounts", CreateAccountHandler).Methods("POST")
 	s.handleFunc("/accounts", OptionsHandler).Methods("OPTIONS")
-	s.handleFunc("/clients", NewClientHandler).Methods("POST")
+	s.handleFunc("/clients", RegisterClientHandler).Methods("POST")
+	s.handleFunc("/clients/{client_id}", ClientConfigurationHandler).Methods("GET")
+	s.handleFunc("/clients/{client_id}", UpdateClientHandler).Methods("PUT")
+	s.handleFunc("/clients/{client_id}", DeleteClientHandler).Methods("DELETE")
 	s.handleFunc("/.well-known/openid-configuration", OpenIdConfigurationHandler).Methods("GET")
+	s.handleFunc("/certs", CertsHandler).Methods("GET")
 
 	// Logged-in client endpoints
 	s.handleFunc("/client", detectClient(requireAuth(ClientHandler))).Methods("GET")
 	s.handleFunc("/token", detectClient(requireAuth(TokenHandler))).Methods("POST")
+	s.handleFunc("/revoke", detectClient(requireAuth(RevokeHandler))).Methods("POST")
+	s.handleFunc("/introspect", detectClient(requireAuth(IntrospectHandler))).Methods("POST")
+	s.handleFunc("/device_authorization", detectClient(requireAuth(DeviceAuthorizationHandler))).Methods("POST")
 
 	// Logged-in user endpoints
-	s.handleFunc("/authorize", detectUser(requireAuth(UserinfoHandler))).Methods("GET")
-	s.handleFunc("/authorize", detectUser(requireAuth(UserinfoHandler))).Methods("POST")
+	s.handleFunc("/authorize", detectUser(requireAuth(requireFrontend(AuthorizeHandler)))).Methods("GET")
+	s.handleFunc("/authorize", detectUser(requireAuth(requireFrontend(AuthorizeHandler)))).Methods("POST")
+	s.handleFunc("/accounts/me", OptionsHandler).Methods("OPTIONS")
+	s.handleFunc("/accounts/me", detectUser(requireAuth(ProfileHandler))).Methods("GET")
+	s.handleFunc("/accounts/me", detectUser(requireAuth(requireFrontend(UpdateProfileHandler)))).Methods("PATCH")
+	s.handleFunc("/accounts/me/authorizations", detectUser(requireAuth(requireFrontend(AuthorizationsHandler)))).Methods("GET")
+	s.handleFunc("/accounts/me/authorizations/{client_id}", detectUser(requireAuth(requireFrontend(RevokeAuthorizationHandler)))).Methods("DELETE")
+	s.handleFunc("/device", detectUser(requireAuth(DeviceHandler))).Methods("GET")
+	s.handleFunc("/device", detectUser(requireAuth(requireFrontend(ApproveDeviceHandler)))).Methods("POST")
 	s.handleFunc("/userinfo", detectUser(requireAuth(UserinfoHandler))).Methods("GET")
-	s.handleFunc("/logout", detectUser(requireAuth(UserinfoHandler))).Methods("POST")
+	s.handleFunc("/userinfo", detectUser(requireAuth(UserinfoHandler))).Methods("POST")
+
+	// Logout endpoints. Unauthenticated requests to /end_session are browser
+	// navigations from relying parties, and are handed off to the frontend.
+	s.handleFunc("/logout", detectUser(requireAuth(LogoutHandler))).Methods("POST")
+	s.handleFunc("/end_session", detectUser(requireFrontend(EndSessionHandler))).Methods("GET")
+	s.handleFunc("/end_session", detectUser(requireFrontend(EndSessionHandler))).Methods("POST")
+
+	// Admin endpoints
+	s.handleFunc("/admin/clients/{client_id}/redirects", detectUser(requireAuth(requireAdmin(RedirectsHandler)))).Methods("GET")
+	s.handleFunc("/admin/clients/{client_id}/redirects", detectUser(requireAuth(requireAdmin(AddRedirectHandler)))).Methods("POST")
+	s.handleFunc("/admin/clients/{client_id}/redirects", detectUser(requireAuth(requireAdmin(RemoveRedirectHandler)))).Methods("DELETE")
+	s.handleFunc("/admin/clients/{client_id}/assertion_subjects", detectUser(requireAuth(requireAdmin(AssertionSubjectsHandler)))).Methods("GET")
+	s.handleFunc("/admin/clients/{client_id}/assertion_subjects", detectUser(requireAuth(requireAdmin(AddAssertionSubjectHandler)))).Methods("POST")
+	s.handleFunc("/admin/clients/{client_id}/assertion_subjects", detectUser(requireAuth(requireAdmin(RemoveAssertionSubjectHandler)))).Methods("DELETE")
 }
 
 func (s *Server) handleFunc(path string, f HandlerFunc) *mux.Route {
@@ -130,16 +170,31 @@ func (s *Server) handleFunc(path string, f HandlerFunc) *mux.Route {
 }
 
 func (s *Server) SignJWT(token *jwt.Token) (string, error) {
-	return token.SignedString(s.signingKey)
+	key := s.Keys().Active()
+	token.Header["kid"] = key.Id
+	return token.SignedString(key.Private)
 }
 
 func (s *Server) ParseJWT(data string) (*jwt.Token, error) {
+	keys := s.Keys()
 	return jwt.Parse(data, func(token *jwt.Token) (interface{}, error) {
 		// validate "alg" is what we expect:
 		if _, ok := token.Method.(*jwt.SigningMethodRSA); !ok {
 			return nil, fmt.Errorf("Unexpected signing method: %v", token.Header["alg"])
 		}
-		return s.verificationKey, nil
+
+		// Tokens issued before we started stamping "kid" can only have been
+		// signed by the active key.
+		kid, _ := token.Header["kid"].(string)
+		if kid == "" {
+			return keys.Active().Public, nil
+		}
+
+		key := keys.Find(kid)
+		if key == nil {
+			return nil, fmt.Errorf("Unknown signing key: %v", kid)
+		}
+		return key.Public, nil
 	})
 }
 
@@ -153,6 +208,30 @@ func main() {
 		log.Fatal("Failed reading config file:", err)
 	}
 
+	switch flag.Arg(0) {
+	case "":
+	case "admins":
+		err = adminsCommand(&cfg, flag.Args()[1:])
+		if err != nil {
+			log.Fatal(err)
+		}
+		return
+	case "keys":
+		err = keysCommand(&cfg, flag.Args()[1:])
+		if err != nil {
+			log.Fatal(err)
+		}
+		return
+	case "migrate":
+		err = migrateCommand(&cfg, flag.Args()[1:])
+		if err != nil {
+			log.Fatal(err)
+		}
+		return
+	default:
+		log.Fatalf("Unknown command %q", flag.Arg(0))
+	}
+
 	if cfg.Log.Path != "" {
 		lf, err := os.Create(cfg.Log.Path)
 		if err != nil {
@@ -163,6 +242,18 @@ func main() {
 
 	s := NewServer(&cfg)
 	defer s.store.Close()
+	go s.reloadKeysOnSignal()
+	stopJanitor := make(chan struct{})
+	defer close(stopJanitor)
+	go s.runJanitor(stopJanitor)
+
+	if cfg.Server.MetricsBind != "" {
+		go func() {
+			// expvar registers /debug/vars with the default mux.
+			err := http.ListenAndServe(cfg.Server.MetricsBind, nil)
+			log.Println("Metrics server stopped:", err)
+		}()
+	}
 
 	log.Println("Registrar server listening on", cfg.Server.Bind)
 	err = s.ListenAndServe()
@@ -0,0 +1,985 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"database/sql"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+
+	"github.com/paulrosania/registrar/storage"
+)
+
+// newTestConfig configures a server backed by the memory store, with a
+// signing key freshly generated in dir.
+func newTestConfig(t *testing.T, dir string) *Config {
+	_, err := GenerateKey(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cfg := &Config{}
+	cfg.Server.BaseUrl = "https://api.example.com"
+	cfg.OpenID.Issuer = "https://example.com"
+	cfg.JWT.KeyDir = dir
+	cfg.Database.Driver = "memory"
+
+	return cfg
+}
+
+// newTestServer starts a server backed by the memory store, with a freshly
+// generated signing key.
+func newTestServer(t *testing.T) *Server {
+	dir, err := ioutil.TempDir("", "registrar-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	return NewServer(newTestConfig(t, dir))
+}
+
+// newSqliteTestServer is like newTestServer, but backed by a freshly migrated
+// SQLite database, for tests that need settings only the database holds (such
+// as token exchange policies). It returns a handle on the database for making
+// them, and a function that cleans up.
+func newSqliteTestServer(t *testing.T) (*Server, *sql.DB, func()) {
+	dir, err := ioutil.TempDir("", "registrar-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cfg := newTestConfig(t, dir)
+	cfg.Database.Driver = "sqlite"
+	cfg.Database.Database = filepath.Join(dir, "registrar.db")
+
+	store, err := storage.NewClient(&storage.Config{Database: cfg.Database})
+	if err != nil {
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+
+	_, err = store.MigrateUp()
+	store.Close()
+	if err != nil {
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+
+	db, err := sql.Open("sqlite3", cfg.Database.Database)
+	if err != nil {
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+
+	s := NewServer(cfg)
+	return s, db, func() {
+		db.Close()
+		s.store.Close()
+		os.RemoveAll(dir)
+	}
+}
+
+// newTestUser creates a user whose password is hunter2.
+func newTestUser(t *testing.T, s *Server, email string) *storage.User {
+	user, err := s.store.Users.New(&storage.UserParams{Email: email, Password: "hunter2"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return user
+}
+
+// newTestApp registers a client. Unless params say otherwise, it
+// authenticates with client_secret_basic.
+func newTestApp(t *testing.T, s *Server, params *storage.ApplicationParams) *storage.Application {
+	if params.TokenEndpointAuthMethod == "" {
+		params.TokenEndpointAuthMethod = "client_secret_basic"
+	}
+
+	app, err := s.store.Apps.New(params)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return app
+}
+
+// passwordGrant obtains tokens for a user created by newTestUser. The client
+// must be registered for the password grant.
+func passwordGrant(t *testing.T, s *Server, app *storage.Application, email, scope string) *TokenResponse {
+	w := postForm(s, "/token", url.Values{
+		"grant_type": {"password"},
+		"username":   {email},
+		"password":   {"hunter2"},
+		"scope":      {scope},
+	}, app.ClientId, app.ClientSecret)
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected 200 from the password grant, got %d: %s", w.Code, w.Body)
+	}
+
+	resp := &TokenResponse{}
+	decodeJson(t, w, resp)
+	return resp
+}
+
+// newFrontend registers the first-party frontend, and returns an access token
+// it holds for the user.
+func newFrontend(t *testing.T, s *Server, email string) string {
+	app := newTestApp(t, s, &storage.ApplicationParams{
+		Name:       "Frontend",
+		GrantTypes: []string{"password"},
+		Scope:      "openid email profile",
+	})
+	s.config.Server.FrontendClientId = app.ClientId
+
+	return passwordGrant(t, s, app, email, "openid").AccessToken
+}
+
+// authorize calls the authorization endpoint as the frontend would, with
+// auth setting the user's credentials.
+func authorize(s *Server, method string, form url.Values, auth func(*http.Request)) *httptest.ResponseRecorder {
+	var req *http.Request
+	if method == "GET" {
+		req, _ = http.NewRequest("GET", "/authorize?"+form.Encode(), nil)
+	} else {
+		req, _ = http.NewRequest("POST", "/authorize", strings.NewReader(form.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	}
+	auth(req)
+	return serve(s, req)
+}
+
+// authorizeRedirect decodes the URI the authorization endpoint sends the user
+// agent on to.
+func authorizeRedirect(t *testing.T, w *httptest.ResponseRecorder) *url.URL {
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected 200 from authorize, got %d: %s", w.Code, w.Body)
+	}
+
+	var resp struct {
+		RedirectUri string `json:"redirect_uri"`
+	}
+	decodeJson(t, w, &resp)
+
+	u, err := url.Parse(resp.RedirectUri)
+	if err != nil || resp.RedirectUri == "" {
+		t.Fatalf("expected a redirect, got %q", resp.RedirectUri)
+	}
+	return u
+}
+
+func basicUser(req *http.Request) {
+	req.SetBasicAuth("paul@example.com", "hunter2")
+}
+
+func bearer(token string) func(*http.Request) {
+	return func(req *http.Request) {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+}
+
+func serve(s *Server, req *http.Request) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	s.Handler.ServeHTTP(w, req)
+	return w
+}
+
+// postForm makes a form request authenticated with basic auth, or (if
+// clientSecret is empty) made by a public client identifying itself.
+func postForm(s *Server, path string, form url.Values, clientId, clientSecret string) *httptest.ResponseRecorder {
+	if clientSecret == "" {
+		form.Set("client_id", clientId)
+	}
+
+	req, _ := http.NewRequest("POST", path, strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	if clientSecret != "" {
+		req.SetBasicAuth(clientId, clientSecret)
+	}
+	return serve(s, req)
+}
+
+func decodeJson(t *testing.T, w *httptest.ResponseRecorder, v interface{}) {
+	err := json.NewDecoder(w.Body).Decode(v)
+	if err != nil {
+		t.Fatalf("failed decoding response: %s", err)
+	}
+}
+
+// errorType returns the type of the OAuth error in a response, or "" if it
+// succeeded.
+func errorType(t *testing.T, w *httptest.ResponseRecorder) string {
+	if w.Code >= 200 && w.Code < 300 {
+		return ""
+	}
+
+	var e OAuthError
+	decodeJson(t, w, &e)
+	return e.Type
+}
+
+func TestOpenIdConfiguration(t *testing.T) {
+	s := newTestServer(t)
+
+	req, _ := http.NewRequest("GET", "/.well-known/openid-configuration", nil)
+	w := serve(s, req)
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d", w.Code)
+	}
+
+	var config map[string]interface{}
+	decodeJson(t, w, &config)
+	if config["token_endpoint"] != "https://api.example.com/token" {
+		t.Errorf("expected token endpoint https://api.example.com/token, got %v", config["token_endpoint"])
+	}
+
+	// Only the code flow is implemented.
+	types, _ := config["response_types_supported"].([]interface{})
+	if len(types) != 1 || types[0] != "code" {
+		t.Errorf("expected only the code response type, got %v", config["response_types_supported"])
+	}
+	grants, _ := config["grant_types_supported"].([]interface{})
+	for _, g := range grants {
+		if g == "implicit" {
+			t.Errorf("expected the implicit grant not to be advertised")
+		}
+	}
+}
+
+func TestCreateAccount(t *testing.T) {
+	s := newTestServer(t)
+
+	create := func() *httptest.ResponseRecorder {
+		body := `{"email": "paul@example.com", "password": "hunter2"}`
+		req, _ := http.NewRequest("POST", "/accounts", strings.NewReader(body))
+		return serve(s, req)
+	}
+
+	w := create()
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", w.Code, w.Body)
+	}
+
+	var user storage.User
+	decodeJson(t, w, &user)
+	if user.Email != "paul@example.com" {
+		t.Errorf("expected paul@example.com, got %q", user.Email)
+	}
+
+	w = create()
+	if w.Code != http.StatusBadRequest {
+		t.Fatalf("expected 400 for a duplicate account, got %d", w.Code)
+	}
+}
+
+func TestPasswordGrantAndRevocation(t *testing.T) {
+	s := newTestServer(t)
+
+	_, err := s.store.Users.New(&storage.UserParams{Email: "paul@example.com", Password: "hunter2"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	app, err := s.store.Apps.New(&storage.ApplicationParams{
+		Name:                    "Test",
+		TokenEndpointAuthMethod: "client_secret_basic",
+		GrantTypes:              []string{"password", "refresh_token"},
+		Scope:                   "openid email",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	w := postForm(s, "/token", url.Values{
+		"grant_type": {"password"},
+		"username":   {"paul@example.com"},
+		"password":   {"hunter2"},
+		"scope":      {"openid email admin"},
+	}, app.ClientId, app.ClientSecret)
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", w.Code, w.Body)
+	}
+
+	var resp TokenResponse
+	decodeJson(t, w, &resp)
+	if resp.AccessToken == "" || resp.RefreshToken == "" {
+		t.Fatalf("expected access and refresh tokens, got %+v", resp)
+	}
+	if resp.Scope != "openid email" {
+		t.Errorf("expected scope %q, got %q", "openid email", resp.Scope)
+	}
+
+	req, _ := http.NewRequest("GET", "/userinfo", nil)
+	req.Header.Set("Authorization", "Bearer "+resp.AccessToken)
+	w = serve(s, req)
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected 200 from userinfo, got %d: %s", w.Code, w.Body)
+	}
+
+	// Addresses aren't verified yet, but the email scope still releases the
+	// claim saying so.
+	var claims map[string]interface{}
+	decodeJson(t, w, &claims)
+	if claims["email"] != "paul@example.com" || claims["email_verified"] != false {
+		t.Errorf("expected email and email_verified claims, got %v", claims)
+	}
+
+	w = postForm(s, "/revoke", url.Values{"token": {resp.RefreshToken}}, app.ClientId, app.ClientSecret)
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected 200 from revoke, got %d: %s", w.Code, w.Body)
+	}
+
+	// Revoking the refresh token revokes the access token issued with it.
+	w = serve(s, req)
+	if w.Code == http.StatusOK {
+		t.Errorf("expected revoked access token to be rejected")
+	}
+
+	w = postForm(s, "/token", url.Values{
+		"grant_type":    {"refresh_token"},
+		"refresh_token": {resp.RefreshToken},
+	}, app.ClientId, app.ClientSecret)
+	if w.Code == http.StatusOK {
+		t.Errorf("expected revoked refresh token to be rejected")
+	}
+}
+
+func TestClientCredentialsGrant(t *testing.T) {
+	s := newTestServer(t)
+
+	service := newTestApp(t, s, &storage.ApplicationParams{
+		Name:       "Service",
+		GrantTypes: []string{"client_credentials"},
+		Scope:      "openid email admin",
+	})
+	web := newTestApp(t, s, &storage.ApplicationParams{
+		Name:       "Web",
+		GrantTypes: []string{"authorization_code"},
+		Scope:      "openid email",
+	})
+
+	cases := []struct {
+		name  string
+		app   *storage.Application
+		scope string
+		want  string
+		err   string
+	}{
+		{"permitted scopes", service, "openid email", "openid email", ""},
+		{"narrowed to permitted scopes", service, "email profile", "email", ""},
+		{"admin never issued", service, "email admin", "email", ""},
+		{"only admin requested", service, "admin", "", "invalid_scope"},
+		{"no scope requested", service, "", "", ""},
+		{"client not registered for the grant", web, "openid", "", "unauthorized_client"},
+	}
+
+	for _, c := range cases {
+		w := postForm(s, "/token", url.Values{
+			"grant_type": {"client_credentials"},
+			"scope":      {c.scope},
+		}, c.app.ClientId, c.app.ClientSecret)
+		if typ := errorType(t, w); typ != c.err {
+			t.Errorf("%s: expected error %q, got %q", c.name, c.err, typ)
+			continue
+		}
+		if c.err != "" {
+			continue
+		}
+
+		var resp TokenResponse
+		decodeJson(t, w, &resp)
+		if resp.Scope != c.want || resp.RefreshToken != "" {
+			t.Errorf("%s: expected an access token with scope %q and no refresh token, got %+v", c.name, c.want, resp)
+		}
+
+		token, err := s.ParseJWT(resp.AccessToken)
+		if err != nil {
+			t.Fatalf("%s: %s", c.name, err)
+		}
+		if token.Claims["sub"] != c.app.ClientId || token.Claims["scope"] != c.want {
+			t.Errorf("%s: expected a token for %s with scope %q, got %v", c.name, c.app.ClientId, c.want, token.Claims)
+		}
+	}
+}
+
+func TestTokenResponseScope(t *testing.T) {
+	s := newTestServer(t)
+	newTestUser(t, s, "paul@example.com")
+
+	// The client may request admin, but the user isn't an admin, so it is
+	// never attached to their tokens.
+	app := newTestApp(t, s, &storage.ApplicationParams{
+		Name:       "Console",
+		GrantTypes: []string{"password", "refresh_token"},
+		Scope:      "openid email admin",
+	})
+	first := passwordGrant(t, s, app, "paul@example.com", "openid email admin")
+
+	w := postForm(s, "/token", url.Values{
+		"grant_type":    {"refresh_token"},
+		"refresh_token": {first.RefreshToken},
+		"scope":         {"openid"},
+	}, app.ClientId, app.ClientSecret)
+	var refreshed TokenResponse
+	decodeJson(t, w, &refreshed)
+
+	cases := []struct {
+		name  string
+		resp  *TokenResponse
+		scope string
+	}{
+		{"password grant", first, "openid email"},
+		{"refresh grant", &refreshed, "openid"},
+	}
+
+	for _, c := range cases {
+		if c.resp.Scope != c.scope {
+			t.Errorf("%s: expected scope %q, got %q", c.name, c.scope, c.resp.Scope)
+		}
+
+		token, err := s.ParseJWT(c.resp.AccessToken)
+		if err != nil {
+			t.Fatalf("%s: %s", c.name, err)
+		}
+		if token.Claims["scope"] != c.scope {
+			t.Errorf("%s: expected the access token's scope to be %q, got %v", c.name, c.scope, token.Claims["scope"])
+		}
+
+		if c.resp.IdToken == "" {
+			t.Errorf("%s: expected an ID token", c.name)
+		}
+	}
+}
+
+func TestIntrospect(t *testing.T) {
+	s := newTestServer(t)
+	newTestUser(t, s, "paul@example.com")
+
+	web := newTestApp(t, s, &storage.ApplicationParams{
+		Name:       "Web",
+		GrantTypes: []string{"password", "refresh_token"},
+		Scope:      "openid email",
+	})
+	other := newTestApp(t, s, &storage.ApplicationParams{
+		Name:       "Other",
+		GrantTypes: []string{"client_credentials"},
+	})
+	public := newTestApp(t, s, &storage.ApplicationParams{
+		Name:                    "Native",
+		TokenEndpointAuthMethod: "none",
+		GrantTypes:              []string{"authorization_code"},
+		RedirectUris:            []string{"https://app.example.com/cb"},
+	})
+
+	live := passwordGrant(t, s, web, "paul@example.com", "openid email")
+	revoked := passwordGrant(t, s, web, "paul@example.com", "openid")
+	w := postForm(s, "/revoke", url.Values{"token": {revoked.RefreshToken}}, web.ClientId, web.ClientSecret)
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected 200 from revoke, got %d: %s", w.Code, w.Body)
+	}
+
+	// A token for a recorded jti, but past its expiry.
+	parsed, err := s.ParseJWT(live.AccessToken)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expiredToken := NewJWT("https://example.com", web.ClientId, "paul@example.com", -60)
+	expiredToken.Claims["jti"] = parsed.Claims["jti"]
+	expired, err := s.SignJWT(expiredToken)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cases := []struct {
+		name   string
+		token  string
+		caller *storage.Application
+		err    string
+		active bool
+		scope  string
+	}{
+		{"access token", live.AccessToken, web, "", true, "openid email"},
+		{"access token, another client", live.AccessToken, other, "", true, "openid email"},
+		{"refresh token", live.RefreshToken, web, "", true, "openid email"},
+		{"another client's refresh token", live.RefreshToken, other, "", false, ""},
+		{"revoked refresh token", revoked.RefreshToken, web, "", false, ""},
+		{"access token issued with a revoked refresh token", revoked.AccessToken, web, "", false, ""},
+		{"expired access token", expired, web, "", false, ""},
+		{"ID token", live.IdToken, web, "", false, ""},
+		{"unknown token", "bogus", web, "", false, ""},
+		{"unauthenticated", live.AccessToken, nil, "access_denied", false, ""},
+		{"public client", live.AccessToken, public, "unauthorized_client", false, ""},
+	}
+
+	for _, c := range cases {
+		form := url.Values{"token": {c.token}}
+		if c.caller == nil {
+			req, _ := http.NewRequest("POST", "/introspect", strings.NewReader(form.Encode()))
+			req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			w = serve(s, req)
+		} else {
+			w = postForm(s, "/introspect", form, c.caller.ClientId, c.caller.ClientSecret)
+		}
+
+		if typ := errorType(t, w); typ != c.err {
+			t.Errorf("%s: expected error %q, got %q", c.name, c.err, typ)
+			continue
+		}
+		if c.err != "" {
+			continue
+		}
+
+		var resp IntrospectionResponse
+		decodeJson(t, w, &resp)
+		if resp.Active != c.active || resp.Scope != c.scope {
+			t.Errorf("%s: expected active = %t with scope %q, got %+v", c.name, c.active, c.scope, resp)
+		}
+		if resp.Active && (resp.Subject != "paul@example.com" || resp.ClientId != web.ClientId || resp.IssuedAt == 0) {
+			t.Errorf("%s: expected a token for paul@example.com issued to %s, got %+v", c.name, web.ClientId, resp)
+		}
+		if !resp.Active && resp != (IntrospectionResponse{}) {
+			t.Errorf("%s: expected nothing but active = false, got %+v", c.name, resp)
+		}
+	}
+}
+
+func TestUpdateProfile(t *testing.T) {
+	s := newTestServer(t)
+
+	_, err := s.store.Users.New(&storage.UserParams{Email: "paul@example.com", Password: "hunter2", Name: "Paul"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	patch := func(body string) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest("PATCH", "/accounts/me", strings.NewReader(body))
+		req.SetBasicAuth("paul@example.com", "hunter2")
+		return serve(s, req)
+	}
+
+	w := patch(`{"given_name": "Paul", "locale": "en-US"}`)
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", w.Code, w.Body)
+	}
+
+	var user storage.User
+	decodeJson(t, w, &user)
+	if user.Name != "Paul" || user.GivenName != "Paul" || user.Locale != "en-US" {
+		t.Errorf("expected name, given name and locale to be set, got %+v", user)
+	}
+
+	w = patch(`{"locale": "not a locale", "picture": "javascript:alert(1)"}`)
+	if w.Code != http.StatusBadRequest {
+		t.Fatalf("expected 400 for an invalid profile, got %d", w.Code)
+	}
+
+	var resp struct {
+		Meta struct {
+			Fields map[string][]string `json:"fields"`
+		} `json:"meta"`
+	}
+	decodeJson(t, w, &resp)
+	if len(resp.Meta.Fields["locale"]) == 0 || len(resp.Meta.Fields["picture"]) == 0 {
+		t.Errorf("expected locale and picture errors, got %v", resp.Meta.Fields)
+	}
+}
+
+func TestAuthorizationCodeGrantWithPKCE(t *testing.T) {
+	s := newTestServer(t)
+	newTestUser(t, s, "paul@example.com")
+
+	app := newTestApp(t, s, &storage.ApplicationParams{
+		Name:                    "Native",
+		TokenEndpointAuthMethod: "none",
+		GrantTypes:              []string{"authorization_code", "refresh_token"},
+		ResponseTypes:           []string{"code"},
+		RedirectUris:            []string{"https://app.example.com/cb"},
+		Scope:                   "openid email",
+	})
+
+	// From RFC 7636 appendix B.
+	verifier := "dBjftJeZ4CVP-mB92K27uhbUJU1p1r_wW1gFWFOEjXk"
+	challenge := "E9Melhoa2OwvFrEMTJguCHaoeK1t8URWbuGJSstw-cM"
+
+	cases := []struct {
+		name         string
+		challenge    string
+		method       string
+		verifier     string
+		authorizeErr string
+		tokenErr     string
+	}{
+		{"S256", challenge, "S256", verifier, "", ""},
+		{"plain", verifier, "plain", verifier, "", ""},
+		{"plain by default", verifier, "", verifier, "", ""},
+		{"wrong verifier", challenge, "S256", strings.Repeat("a", 43), "", "invalid_grant"},
+		{"verifier as challenge", challenge, "S256", challenge, "", "invalid_grant"},
+		{"missing verifier", challenge, "S256", "", "", "invalid_grant"},
+		{"short verifier", challenge, "S256", "abc", "", "invalid_request"},
+		{"missing challenge", "", "", verifier, "invalid_request", ""},
+		{"unsupported method", challenge, "S512", verifier, "invalid_request", ""},
+	}
+
+	for _, c := range cases {
+		w := authorize(s, "POST", url.Values{
+			"client_id":             {app.ClientId},
+			"redirect_uri":          {"https://app.example.com/cb"},
+			"response_type":         {"code"},
+			"scope":                 {"openid email"},
+			"state":                 {"xyz"},
+			"code_challenge":        {c.challenge},
+			"code_challenge_method": {c.method},
+			"decision":              {"approve"},
+		}, basicUser)
+		redirect := authorizeRedirect(t, w)
+
+		if q := redirect.Query(); q.Get("error") != c.authorizeErr {
+			t.Errorf("%s: expected authorize error %q, got %q (%s)", c.name, c.authorizeErr, q.Get("error"), q.Get("error_description"))
+			continue
+		} else if q.Get("state") != "xyz" {
+			t.Errorf("%s: expected state to be passed back, got %q", c.name, q.Get("state"))
+		}
+		if c.authorizeErr != "" {
+			continue
+		}
+
+		code := redirect.Query().Get("code")
+		redeem := func() *httptest.ResponseRecorder {
+			return postForm(s, "/token", url.Values{
+				"grant_type":    {"authorization_code"},
+				"code":          {code},
+				"redirect_uri":  {"https://app.example.com/cb"},
+				"code_verifier": {c.verifier},
+			}, app.ClientId, "")
+		}
+
+		w = redeem()
+		if typ := errorType(t, w); typ != c.tokenErr {
+			t.Errorf("%s: expected token error %q, got %q", c.name, c.tokenErr, typ)
+			continue
+		}
+		if c.tokenErr != "" {
+			continue
+		}
+
+		var resp TokenResponse
+		decodeJson(t, w, &resp)
+		if resp.AccessToken == "" || resp.RefreshToken == "" || resp.IdToken == "" {
+			t.Errorf("%s: expected access, refresh and ID tokens, got %+v", c.name, resp)
+		}
+
+		// Codes may only be redeemed once.
+		if typ := errorType(t, redeem()); typ != "invalid_grant" {
+			t.Errorf("%s: expected a redeemed code to be rejected, got %q", c.name, typ)
+		}
+	}
+}
+
+func TestRefreshTokenRotation(t *testing.T) {
+	s, _, done := newSqliteTestServer(t)
+	defer done()
+
+	newTestUser(t, s, "paul@example.com")
+	admin := newTestUser(t, s, "admin@example.com")
+	err := s.store.Users.SetAdmin(admin, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	console := newTestApp(t, s, &storage.ApplicationParams{
+		Name:       "Console",
+		GrantTypes: []string{"password"},
+		Scope:      "openid admin",
+	})
+	adminToken := passwordGrant(t, s, console, "admin@example.com", "openid admin").AccessToken
+
+	// Rotation and lifetimes are registered along with the rest of the
+	// client's metadata.
+	body := `{"grant_types": ["password", "refresh_token"], "scope": "openid email profile",
+		"refresh_token_rotation": true, "refresh_token_idle_lifetime": 3600}`
+	req, _ := http.NewRequest("POST", "/clients", strings.NewReader(body))
+	bearer(adminToken)(req)
+	w := serve(s, req)
+	if w.Code != http.StatusCreated {
+		t.Fatalf("expected 201 registering the client, got %d: %s", w.Code, w.Body)
+	}
+
+	var reg ClientRegistration
+	decodeJson(t, w, &reg)
+	if !reg.RefreshTokenRotation || reg.RefreshTokenIdleLifetime != 3600 {
+		t.Errorf("expected rotation and an idle lifetime to be registered, got %+v", reg.ClientMetadata)
+	}
+	app := &storage.Application{ClientId: reg.ClientId, ClientSecret: reg.ClientSecret}
+
+	refresh := func(token, scope string) *httptest.ResponseRecorder {
+		return postForm(s, "/token", url.Values{
+			"grant_type":    {"refresh_token"},
+			"refresh_token": {token},
+			"scope":         {scope},
+		}, app.ClientId, app.ClientSecret)
+	}
+
+	first := passwordGrant(t, s, app, "paul@example.com", "openid email")
+
+	cases := []struct {
+		name  string
+		scope string
+		err   string
+	}{
+		{"same scope", "", ""},
+		{"narrower scope", "openid", ""},
+		{"broader scope", "openid email profile", "invalid_scope"},
+	}
+
+	current := first.RefreshToken
+	var latest TokenResponse
+	for _, c := range cases {
+		w := refresh(current, c.scope)
+		if typ := errorType(t, w); typ != c.err {
+			t.Fatalf("%s: expected error %q, got %q", c.name, c.err, typ)
+		}
+		if c.err != "" {
+			continue
+		}
+
+		decodeJson(t, w, &latest)
+		if latest.RefreshToken == "" || latest.RefreshToken == current {
+			t.Fatalf("%s: expected the refresh token to be rotated", c.name)
+		}
+		current = latest.RefreshToken
+	}
+
+	// Each rotated token expires after the registered idle lifetime.
+	var introspected IntrospectionResponse
+	decodeJson(t, postForm(s, "/introspect", url.Values{"token": {current}}, app.ClientId, app.ClientSecret), &introspected)
+	if remaining := introspected.ExpiresAt - time.Now().Unix(); remaining <= 0 || remaining > 3600 {
+		t.Errorf("expected the refresh token to expire within the idle lifetime, got exp %d", introspected.ExpiresAt)
+	}
+
+	// Replaying a rotated token means it has leaked, so the whole family is
+	// revoked: the replay fails, and so does the token it was replaced by.
+	if typ := errorType(t, refresh(first.RefreshToken, "")); typ != "invalid_grant" {
+		t.Errorf("expected a rotated refresh token to be rejected, got %q", typ)
+	}
+	if typ := errorType(t, refresh(current, "")); typ != "invalid_grant" {
+		t.Errorf("expected reuse to revoke the current refresh token, got %q", typ)
+	}
+
+	req, _ = http.NewRequest("GET", "/userinfo", nil)
+	bearer(latest.AccessToken)(req)
+	if w := serve(s, req); w.Code == http.StatusOK {
+		t.Errorf("expected reuse to revoke access tokens issued by the family")
+	}
+}
+
+func TestDeviceGrant(t *testing.T) {
+	s := newTestServer(t)
+	newTestUser(t, s, "paul@example.com")
+
+	app := newTestApp(t, s, &storage.ApplicationParams{
+		Name:       "TV",
+		GrantTypes: []string{deviceCodeGrantType, "password"},
+		Scope:      "openid email",
+	})
+
+	start := func() *DeviceAuthorizationResponse {
+		w := postForm(s, "/device_authorization", url.Values{"scope": {"openid"}}, app.ClientId, app.ClientSecret)
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected 200 from device_authorization, got %d: %s", w.Code, w.Body)
+		}
+
+		resp := &DeviceAuthorizationResponse{}
+		decodeJson(t, w, resp)
+		return resp
+	}
+
+	poll := func(deviceCode string) *httptest.ResponseRecorder {
+		return postForm(s, "/token", url.Values{
+			"grant_type":  {deviceCodeGrantType},
+			"device_code": {deviceCode},
+		}, app.ClientId, app.ClientSecret)
+	}
+
+	decide := func(userCode, action string, auth func(*http.Request)) *httptest.ResponseRecorder {
+		form := url.Values{"user_code": {userCode}, "action": {action}}
+		req, _ := http.NewRequest("POST", "/device", strings.NewReader(form.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		auth(req)
+		return serve(s, req)
+	}
+
+	// Polling before the user has decided, and polling too often.
+	pending := start()
+	if typ := errorType(t, poll(pending.DeviceCode)); typ != "authorization_pending" {
+		t.Errorf("expected authorization_pending, got %q", typ)
+	}
+	if typ := errorType(t, poll(pending.DeviceCode)); typ != "slow_down" {
+		t.Errorf("expected slow_down, got %q", typ)
+	}
+
+	// Only the user (or the frontend acting for them) may decide; a token
+	// the user gave the device itself doesn't qualify.
+	deviceToken := passwordGrant(t, s, app, "paul@example.com", "openid").AccessToken
+	if w := decide(pending.UserCode, "approve", bearer(deviceToken)); w.Code != http.StatusUnauthorized {
+		t.Errorf("expected a client's token to be refused, got %d", w.Code)
+	}
+
+	cases := []struct {
+		name   string
+		action string
+		err    string
+	}{
+		{"approved", "approve", ""},
+		{"denied", "deny", "access_denied"},
+	}
+
+	for _, c := range cases {
+		code := start()
+
+		req, _ := http.NewRequest("GET", "/device?user_code="+url.QueryEscape(code.UserCode), nil)
+		basicUser(req)
+		if w := serve(s, req); w.Code != http.StatusOK {
+			t.Fatalf("%s: expected 200 from GET /device, got %d: %s", c.name, w.Code, w.Body)
+		}
+
+		if w := decide(code.UserCode, c.action, basicUser); w.Code != http.StatusOK {
+			t.Fatalf("%s: expected 200 from POST /device, got %d: %s", c.name, w.Code, w.Body)
+		}
+
+		w := poll(code.DeviceCode)
+		if typ := errorType(t, w); typ != c.err {
+			t.Errorf("%s: expected error %q, got %q", c.name, c.err, typ)
+			continue
+		}
+		if c.err == "" {
+			var resp TokenResponse
+			decodeJson(t, w, &resp)
+			if resp.AccessToken == "" || resp.RefreshToken == "" || resp.Scope != "openid" {
+				t.Errorf("%s: expected tokens with scope openid, got %+v", c.name, resp)
+			}
+		}
+
+		// Either way, the device code is used up.
+		if typ := errorType(t, poll(code.DeviceCode)); typ != "invalid_grant" {
+			t.Errorf("%s: expected a used device code to be rejected, got %q", c.name, typ)
+		}
+	}
+}
+
+func TestTokenExchange(t *testing.T) {
+	s, db, done := newSqliteTestServer(t)
+	defer done()
+
+	newTestUser(t, s, "paul@example.com")
+	newTestUser(t, s, "service@example.com")
+
+	web := newTestApp(t, s, &storage.ApplicationParams{
+		Name:       "Web",
+		GrantTypes: []string{"password"},
+		Scope:      "openid email profile",
+	})
+	gateway := newTestApp(t, s, &storage.ApplicationParams{
+		Name:       "Gateway",
+		GrantTypes: []string{tokenExchangeGrantType},
+		Scope:      "openid email profile",
+	})
+
+	const billing = "https://billing.example.com"
+	_, err := db.Exec("INSERT INTO token_exchange_policies (client_id, audience, scope) VALUES (?, ?, ?)", gateway.Id, billing, "email profile")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	subject := passwordGrant(t, s, web, "paul@example.com", "openid email")
+	actor := passwordGrant(t, s, web, "service@example.com", "openid")
+
+	cases := []struct {
+		name        string
+		token       string
+		tokenType   string
+		actor       string
+		audience    string
+		scope       string
+		err         string
+		wantScope   string
+		wantSubject string
+		wantActor   string
+	}{
+		// The subject token never carried profile, so neither can the new
+		// token, whatever the policy allows.
+		{"narrowed by policy", subject.AccessToken, accessTokenType, "", billing, "", "", "email", "paul@example.com", ""},
+		{"requested scope", subject.AccessToken, jwtTokenType, "", billing, "email", "", "email", "paul@example.com", ""},
+		{"with actor", subject.AccessToken, accessTokenType, actor.AccessToken, billing, "", "", "email", "paul@example.com", "service@example.com"},
+		{"scope not permitted", subject.AccessToken, accessTokenType, "", billing, "openid", "invalid_scope", "", "", ""},
+		{"no policy for audience", subject.AccessToken, accessTokenType, "", "https://other.example.com", "", "invalid_target", "", "", ""},
+		{"ID token as subject", subject.IdToken, accessTokenType, "", billing, "", "invalid_grant", "", "", ""},
+		{"unsupported token type", subject.AccessToken, "urn:ietf:params:oauth:token-type:id_token", "", billing, "", "invalid_request", "", "", ""},
+	}
+
+	var exchanged []string
+	for _, c := range cases {
+		form := url.Values{
+			"grant_type":         {tokenExchangeGrantType},
+			"subject_token":      {c.token},
+			"subject_token_type": {c.tokenType},
+			"audience":           {c.audience},
+			"scope":              {c.scope},
+		}
+		if c.actor != "" {
+			form.Set("actor_token", c.actor)
+			form.Set("actor_token_type", accessTokenType)
+		}
+
+		w := postForm(s, "/token", form, gateway.ClientId, gateway.ClientSecret)
+		if typ := errorType(t, w); typ != c.err {
+			t.Errorf("%s: expected error %q, got %q", c.name, c.err, typ)
+			continue
+		}
+		if c.err != "" {
+			continue
+		}
+
+		var resp TokenResponse
+		decodeJson(t, w, &resp)
+		if resp.Scope != c.wantScope {
+			t.Errorf("%s: expected scope %q, got %q", c.name, c.wantScope, resp.Scope)
+		}
+
+		token, err := s.ParseJWT(resp.AccessToken)
+		if err != nil {
+			t.Fatalf("%s: %s", c.name, err)
+		}
+		if token.Claims["aud"] != c.audience || token.Claims["sub"] != c.wantSubject {
+			t.Errorf("%s: expected a token for %s about %s, got %v", c.name, c.audience, c.wantSubject, token.Claims)
+		}
+
+		act, _ := token.Claims["act"].(map[string]interface{})
+		if c.wantActor == "" && act != nil {
+			t.Errorf("%s: expected no actor, got %v", c.name, act)
+		} else if c.wantActor != "" && (act == nil || act["sub"] != c.wantActor) {
+			t.Errorf("%s: expected actor %s, got %v", c.name, c.wantActor, act)
+		}
+
+		exchanged = append(exchanged, token.Claims["jti"].(string))
+	}
+
+	// Exchanged tokens are derived from the subject token, so revoking the
+	// refresh token it came from revokes them too.
+	w := postForm(s, "/revoke", url.Values{"token": {subject.RefreshToken}}, web.ClientId, web.ClientSecret)
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected 200 from revoke, got %d: %s", w.Code, w.Body)
+	}
+
+	for _, jti := range exchanged {
+		if _, err := s.store.Tokens.FindByValue("access_token", jti); err == nil {
+			t.Errorf("expected exchanged token %s to be revoked", jti)
+		}
+	}
+}
@@ -1,13 +1,30 @@
 package storage
 
 import (
+	"errors"
 	"log"
+	"strings"
+	"time"
 
+	"crypto/sha256"
+	"crypto/subtle"
+	"database/sql"
+	"encoding/base64"
+
+	"github.com/jmoiron/sqlx"
 	"golang.org/x/crypto/bcrypt"
 )
 
 const DefaultClientSecretCost = 12
 
+// Authorization codes must be redeemed shortly after they are issued (RFC
+// 6749 section 4.1.2 recommends no more than ten minutes).
+const AuthCodeLifetime = 10 * time.Minute
+
+var (
+	ErrInvalidGrant = errors.New("grant is invalid, expired, or was issued to another client")
+)
+
 type Application struct {
 	Id                 int64  `json:"id"`
 	Name               string `json:"name"`
@@ -18,16 +35,189 @@ type Application struct {
 	ClientId           string `json:"client_id"`
 	ClientSecret       string `json:"client_secret,omitempty"`
 	HashedClientSecret string `json:"-"`
+
+	// If set, userinfo responses are returned as JWTs signed with this
+	// algorithm rather than as plain JSON.
+	UserinfoSignedResponseAlg string `json:"userinfo_signed_response_alg,omitempty"`
+
+	// If RefreshTokenRotation is set, every use of a refresh token replaces
+	// it with a new one. Refresh tokens expire RefreshTokenLifetime seconds
+	// after the user authenticated, or after RefreshTokenIdleLifetime seconds
+	// without being used, whichever is sooner. Zero means no limit.
+	RefreshTokenRotation     bool `json:"refresh_token_rotation"`
+	RefreshTokenLifetime     int  `json:"refresh_token_lifetime,omitempty"`
+	RefreshTokenIdleLifetime int  `json:"refresh_token_idle_lifetime,omitempty"`
+
+	// A JSON Web Key Set holding the public keys the application signs JWT
+	// assertions (RFC 7523) with, if it uses them.
+	Jwks string `json:"-"`
+
+	// Registration metadata (RFC 7591). GrantTypes and ResponseTypes are
+	// space-separated lists, like scopes.
+	TokenEndpointAuthMethod string `json:"token_endpoint_auth_method"`
+	GrantTypes              string `json:"-"`
+	ResponseTypes           string `json:"-"`
+
+	// Where the user may be sent after logging out at the application's
+	// request (space-separated), and where the application should be told
+	// when the user logs out (OpenID Connect Back-Channel Logout).
+	PostLogoutRedirectUris string `json:"-"`
+	BackchannelLogoutUri   string `json:"-"`
+
+	// Allows the client to read and manage its own registration (RFC 7592).
+	// Like the client secret, it is only available in plain text when it is
+	// first issued.
+	RegistrationAccessToken       string `json:"-"`
+	HashedRegistrationAccessToken string `json:"-"`
+}
+
+// RefreshTokenExpiry returns when a refresh token issued or used now should
+// expire, given when the user authenticated, or nil if it should never expire.
+func (a *Application) RefreshTokenExpiry(authTime time.Time) *time.Time {
+	var expiresAt *time.Time
+	if a.RefreshTokenLifetime > 0 {
+		t := authTime.Add(time.Duration(a.RefreshTokenLifetime) * time.Second)
+		expiresAt = &t
+	}
+	if a.RefreshTokenIdleLifetime > 0 {
+		t := time.Now().Add(time.Duration(a.RefreshTokenIdleLifetime) * time.Second)
+		if expiresAt == nil || t.Before(*expiresAt) {
+			expiresAt = &t
+		}
+	}
+
+	return expiresAt
+}
+
+// IsPublic reports whether the application is unable to keep a client secret
+// confidential (e.g. a single-page or native app).
+func (a *Application) IsPublic() bool {
+	return a.ClientType != "secret"
 }
 
 type ApplicationParams struct {
+	Name                    string
+	Description             string
+	Website                 string
+	Logo                    string
+	TokenEndpointAuthMethod string
+	GrantTypes              []string
+	ResponseTypes           []string
+	RedirectUris            []string
+	Scope                   string
+	Jwks                    string
+	PostLogoutRedirectUris  []string
+	BackchannelLogoutUri    string
+
+	UserinfoSignedResponseAlg string
+
+	RefreshTokenRotation     bool
+	RefreshTokenLifetime     int
+	RefreshTokenIdleLifetime int
+}
+
+// clientType derives an application's client type from how it authenticates.
+func (p *ApplicationParams) clientType() string {
+	if p.TokenEndpointAuthMethod == "none" {
+		return "public"
+	}
+	return "secret"
+}
+
+// usesSecret reports whether the application authenticates with a client
+// secret. Applications that don't are never issued one.
+func (p *ApplicationParams) usesSecret() bool {
+	return p.TokenEndpointAuthMethod == "client_secret_basic" || p.TokenEndpointAuthMethod == "client_secret_post"
+}
+
+type AuthCode struct {
+	Id                  int64     `json:"-"`
+	ClientId            int64     `json:"-"`
+	UserId              int64     `json:"-"`
+	Code                string    `json:"code"` // stored hashed (see HashToken)
+	RedirectUri         string    `json:"redirect_uri"`
+	Scope               string    `json:"scope"`
+	CodeChallenge       string    `json:"-"`
+	CodeChallengeMethod string    `json:"-"`
+	Nonce               string    `json:"-"`
+	AuthTime            time.Time `json:"-"`
+	ExpiresAt           time.Time `json:"expires_at"`
+}
+
+type AuthCodeParams struct {
+	RedirectUri         string
+	Scope               string
+	CodeChallenge       string
+	CodeChallengeMethod string
+	Nonce               string
+	AuthTime            time.Time
+}
+
+// Verify checks a PKCE code verifier (RFC 7636) against the challenge the code
+// was issued with. Codes issued without a challenge must be redeemed without
+// a verifier.
+func (c *AuthCode) Verify(verifier string) bool {
+	if c.CodeChallenge == "" {
+		return verifier == ""
+	}
+
+	var computed string
+	switch c.CodeChallengeMethod {
+	case "S256":
+		sum := sha256.Sum256([]byte(verifier))
+		computed = base64.RawURLEncoding.EncodeToString(sum[:])
+	case "plain":
+		computed = verifier
+	default:
+		return false
+	}
+
+	return subtle.ConstantTimeCompare([]byte(computed), []byte(c.CodeChallenge)) == 1
+}
+
+// RegisteredRedirect is a redirect URI registered for use with one response
+// type by an application.
+type RegisteredRedirect struct {
+	Id           int64  `json:"-"`
+	ClientId     int64  `json:"-"`
+	Url          string `json:"redirect_uri"`
+	ResponseType string `json:"response_type"`
+}
+
+// ExchangePolicy permits an application to exchange tokens (RFC 8693) for
+// tokens targeted at Audience, carrying at most the scopes in Scope.
+type ExchangePolicy struct {
+	Id       int64
+	ClientId int64
+	Audience string
+	Scope    string
 }
 
 type ApplicationsService interface {
+	AddAssertionSubject(a *Application, subject string) error
+	AddRedirect(a *Application, url, responseType string) error
+	AssertionSubjects(a *Application) ([]string, error)
+	ApproveDeviceCode(userCode string, userId int64, approved bool) error
 	Authorize(a *Application, scope string) (*Token, error)
-	ExchangeAuthCode(a *Application, code, redirectUri string) (*Token, error)
+	Delete(a *Application) error
+	ExchangeAuthCode(a *Application, code, redirectUri, codeVerifier string) (*AuthCode, *Token, error)
+	ExchangeDeviceCode(a *Application, deviceCode string) (*DeviceCode, *Token, error)
+	FindByClientId(id string) (*Application, error)
+	FindById(id int64) (*Application, error)
 	FindByCredentials(email, password string) (*Application, error)
-	New(name, description, website, logo, clientType string) (*Application, error)
+	FindDeviceCode(userCode string) (*DeviceCode, error)
+	FindExchangePolicy(a *Application, audience string) (*ExchangePolicy, error)
+	FindScopes(names []string) ([]*Scope, error)
+	New(params *ApplicationParams) (*Application, error)
+	NewAuthCode(a *Application, userId int64, params *AuthCodeParams) (*AuthCode, error)
+	NewDeviceCode(a *Application, scope string) (*DeviceCode, error)
+	PermittedScopes(a *Application) ([]string, error)
+	RecordAssertion(a *Application, jti string, expiresAt time.Time) error
+	RedirectUris(a *Application) ([]string, error)
+	RegisteredRedirects(a *Application) ([]*RegisteredRedirect, error)
+	RemoveAssertionSubject(a *Application, subject string) error
+	RemoveRedirect(a *Application, url, responseType string) error
+	Update(a *Application, params *ApplicationParams) (*Application, error)
 }
 
 type LocalApplicationsService struct {
@@ -35,7 +225,11 @@ type LocalApplicationsService struct {
 }
 
 const defaultApplicationFields = `a.id, a.name, a.description, a.website, a.logo,
-a.client_type, a.client_id, a.client_secret as hashed_client_secret`
+a.client_type, a.client_id, a.client_secret as hashed_client_secret,
+a.userinfo_signed_response_alg, a.refresh_token_rotation, a.refresh_token_lifetime,
+a.refresh_token_idle_lifetime, a.jwks, a.token_endpoint_auth_method, a.grant_types,
+a.response_types, a.registration_access_token AS hashed_registration_access_token, a.post_logout_redirect_uris,
+a.backchannel_logout_uri`
 
 const findApplicationByClientIdSql = "SELECT " + defaultApplicationFields + ` FROM applications a
 WHERE a.client_id = $1 GROUP BY a.id LIMIT 1`
@@ -51,6 +245,20 @@ func (s *LocalApplicationsService) FindByClientId(id string) (*Application, erro
 	return a, nil
 }
 
+const findApplicationByIdSql = "SELECT " + defaultApplicationFields + ` FROM applications a
+WHERE a.id = $1 LIMIT 1`
+
+func (s *LocalApplicationsService) FindById(id int64) (*Application, error) {
+	a := &Application{}
+	err := s.client.db.Get(a, findApplicationByIdSql, id)
+	if err != nil {
+		log.Println("Apps.FindById:", err)
+		return nil, err
+	}
+
+	return a, nil
+}
+
 func (s *LocalApplicationsService) FindByCredentials(id, secret string) (*Application, error) {
 	a, err := s.FindByClientId(id)
 	if err != nil {
@@ -70,11 +278,34 @@ func (s *LocalApplicationsService) FindByCredentials(id, secret string) (*Applic
 }
 
 const createApplicationSql = `INSERT INTO applications
-(name, description, website, logo, client_type, client_id, client_secret)
-VALUES ($1, $2, $3, $4, $5, $6, $7) RETURNING id`
+(name, description, website, logo, client_type, client_id, client_secret,
+ token_endpoint_auth_method, grant_types, response_types, jwks, registration_access_token,
+ post_logout_redirect_uris, backchannel_logout_uri, userinfo_signed_response_alg,
+ refresh_token_rotation, refresh_token_lifetime, refresh_token_idle_lifetime)
+VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14, $15, $16, $17, $18) RETURNING id`
+
+// New registers an application. The generated client secret (if the
+// application uses one) and registration access token are only available on
+// the returned application; just a hash of the secret is stored.
+func (s *LocalApplicationsService) New(params *ApplicationParams) (*Application, error) {
+	a := &Application{
+		Name:                    params.Name,
+		Description:             params.Description,
+		Website:                 params.Website,
+		Logo:                    params.Logo,
+		ClientType:              params.clientType(),
+		TokenEndpointAuthMethod: params.TokenEndpointAuthMethod,
+		GrantTypes:              strings.Join(params.GrantTypes, " "),
+		ResponseTypes:           strings.Join(params.ResponseTypes, " "),
+		Jwks:                    params.Jwks,
+		PostLogoutRedirectUris:  strings.Join(params.PostLogoutRedirectUris, " "),
+		BackchannelLogoutUri:    params.BackchannelLogoutUri,
 
-func (s *LocalApplicationsService) New(name, description, website, logo, clientType string) (*Application, error) {
-	a := &Application{Name: name, Description: description, Website: website, Logo: logo, ClientType: clientType}
+		UserinfoSignedResponseAlg: params.UserinfoSignedResponseAlg,
+		RefreshTokenRotation:      params.RefreshTokenRotation,
+		RefreshTokenLifetime:      params.RefreshTokenLifetime,
+		RefreshTokenIdleLifetime:  params.RefreshTokenIdleLifetime,
+	}
 
 	var err error
 	a.ClientId, err = RandomToken()
@@ -82,39 +313,492 @@ func (s *LocalApplicationsService) New(name, description, website, logo, clientT
 		return nil, err
 	}
 
-	a.ClientSecret, err = RandomToken()
+	if params.usesSecret() {
+		err = a.generateSecret()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	err = a.generateRegistrationAccessToken()
 	if err != nil {
 		return nil, err
 	}
 
-	crypted, err := bcrypt.GenerateFromPassword([]byte(a.ClientSecret), DefaultClientSecretCost)
+	tx, err := s.client.db.Begin()
 	if err != nil {
+		log.Println("Apps.New:", err)
 		return nil, err
 	}
-	a.HashedClientSecret = string(crypted)
 
-	var id int64
-	err = s.client.db.QueryRow(createApplicationSql, a.Name, a.Description, a.Website, a.Logo, a.ClientType, a.ClientId, a.HashedClientSecret).Scan(&id)
+	err = tx.QueryRow(createApplicationSql, a.Name, a.Description, a.Website, a.Logo, a.ClientType, a.ClientId, a.HashedClientSecret,
+		a.TokenEndpointAuthMethod, a.GrantTypes, a.ResponseTypes, a.Jwks, a.HashedRegistrationAccessToken,
+		a.PostLogoutRedirectUris, a.BackchannelLogoutUri, a.UserinfoSignedResponseAlg,
+		a.RefreshTokenRotation, a.RefreshTokenLifetime, a.RefreshTokenIdleLifetime).Scan(&a.Id)
 	if err != nil {
+		tx.Rollback()
+		log.Println("Apps.New: failed inserting application:", err)
+		return nil, err
+	}
+
+	err = s.setRegistration(tx, a, params)
+	if err != nil {
+		tx.Rollback()
+		log.Println("Apps.New:", err)
+		return nil, err
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		log.Println("Apps.New: failed committing transaction:", err)
 		return nil, err
 	}
-	a.Id = id
 
 	return a, nil
 }
 
-func (s *LocalApplicationsService) ExchangeAuthCode(a *Application, code, redirectUri string) (*Token, error) {
-	// Verify we found a record
+func (a *Application) generateSecret() error {
+	var err error
+	a.ClientSecret, err = RandomToken()
+	if err != nil {
+		return err
+	}
+
+	crypted, err := bcrypt.GenerateFromPassword([]byte(a.ClientSecret), DefaultClientSecretCost)
+	if err != nil {
+		return err
+	}
+	a.HashedClientSecret = string(crypted)
+
+	return nil
+}
+
+func (a *Application) generateRegistrationAccessToken() error {
+	var err error
+	a.RegistrationAccessToken, err = RandomToken()
+	if err != nil {
+		return err
+	}
+	a.HashedRegistrationAccessToken = HashToken(a.RegistrationAccessToken)
+
+	return nil
+}
+
+// VerifyRegistrationAccessToken reports whether token is the application's
+// registration access token.
+func (a *Application) VerifyRegistrationAccessToken(token string) bool {
+	return a.HashedRegistrationAccessToken != "" &&
+		subtle.ConstantTimeCompare([]byte(a.HashedRegistrationAccessToken), []byte(HashToken(token))) == 1
+}
+
+const updateApplicationSql = `UPDATE applications SET name = $2, description = $3,
+website = $4, logo = $5, client_type = $6, client_secret = $7, token_endpoint_auth_method = $8,
+grant_types = $9, response_types = $10, jwks = $11, post_logout_redirect_uris = $12,
+backchannel_logout_uri = $13, userinfo_signed_response_alg = $14, refresh_token_rotation = $15,
+refresh_token_lifetime = $16, refresh_token_idle_lifetime = $17
+WHERE id = $1`
+
+// Update replaces an application's registration metadata. If the application
+// switches to authenticating with a client secret, a new one is generated.
+func (s *LocalApplicationsService) Update(a *Application, params *ApplicationParams) (*Application, error) {
+	u := *a
+	u.Name = params.Name
+	u.Description = params.Description
+	u.Website = params.Website
+	u.Logo = params.Logo
+	u.ClientType = params.clientType()
+	u.TokenEndpointAuthMethod = params.TokenEndpointAuthMethod
+	u.GrantTypes = strings.Join(params.GrantTypes, " ")
+	u.ResponseTypes = strings.Join(params.ResponseTypes, " ")
+	u.Jwks = params.Jwks
+	u.PostLogoutRedirectUris = strings.Join(params.PostLogoutRedirectUris, " ")
+	u.BackchannelLogoutUri = params.BackchannelLogoutUri
+	u.UserinfoSignedResponseAlg = params.UserinfoSignedResponseAlg
+	u.RefreshTokenRotation = params.RefreshTokenRotation
+	u.RefreshTokenLifetime = params.RefreshTokenLifetime
+	u.RefreshTokenIdleLifetime = params.RefreshTokenIdleLifetime
+
+	if !params.usesSecret() {
+		u.HashedClientSecret = ""
+	} else if u.HashedClientSecret == "" {
+		err := u.generateSecret()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	tx, err := s.client.db.Begin()
+	if err != nil {
+		log.Println("Apps.Update:", err)
+		return nil, err
+	}
+
+	_, err = tx.Exec(updateApplicationSql, u.Id, u.Name, u.Description, u.Website, u.Logo, u.ClientType, u.HashedClientSecret,
+		u.TokenEndpointAuthMethod, u.GrantTypes, u.ResponseTypes, u.Jwks,
+		u.PostLogoutRedirectUris, u.BackchannelLogoutUri, u.UserinfoSignedResponseAlg,
+		u.RefreshTokenRotation, u.RefreshTokenLifetime, u.RefreshTokenIdleLifetime)
+	if err != nil {
+		tx.Rollback()
+		log.Println("Apps.Update: failed updating application:", err)
+		return nil, err
+	}
+
+	err = s.setRegistration(tx, &u, params)
+	if err != nil {
+		tx.Rollback()
+		log.Println("Apps.Update:", err)
+		return nil, err
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		log.Println("Apps.Update: failed committing transaction:", err)
+		return nil, err
+	}
+
+	return &u, nil
+}
+
+const clearRegisteredRedirectsSql = `DELETE FROM registered_redirects WHERE client_id = $1`
+const createRegisteredRedirectSql = `INSERT INTO registered_redirects (client_id, url, response_type)
+VALUES ($1, $2, $3)`
+const clearPermittedScopesSql = `DELETE FROM permitted_scopes WHERE client_id = $1`
+const permitScopesSql = `INSERT INTO permitted_scopes (scope_id, client_id)
+SELECT s.id, ? FROM scopes s WHERE s.name IN (?)`
+
+// setRegistration replaces an application's redirect URIs (registered for
+// each of its response types) and permitted scopes.
+func (s *LocalApplicationsService) setRegistration(tx Tx, a *Application, params *ApplicationParams) error {
+	_, err := tx.Exec(clearRegisteredRedirectsSql, a.Id)
+	if err != nil {
+		return err
+	}
+
+	for _, uri := range params.RedirectUris {
+		for _, responseType := range params.ResponseTypes {
+			_, err = tx.Exec(createRegisteredRedirectSql, a.Id, uri, responseType)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	_, err = tx.Exec(clearPermittedScopesSql, a.Id)
+	if err != nil {
+		return err
+	}
+
+	scopes := strings.Fields(params.Scope)
+	if len(scopes) == 0 {
+		return nil
+	}
+
+	query, args, err := sqlx.In(permitScopesSql, a.Id, scopes)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec(s.client.db.Rebind(query), args...)
+	return err
+}
+
+// Everything belonging to the application goes with it, including all the
+// tokens issued to it.
+var deleteApplicationSqls = []string{
+	`DELETE FROM authorized_scopes WHERE oauth_token_id IN
+  (SELECT id FROM oauth_tokens WHERE client_id = $1)`,
+	`DELETE FROM oauth_tokens WHERE client_id = $1`,
+	`DELETE FROM authorization_codes WHERE client_id = $1`,
+	`DELETE FROM device_codes WHERE client_id = $1`,
+	`DELETE FROM client_assertions WHERE client_id = $1`,
+	`DELETE FROM token_exchange_policies WHERE client_id = $1`,
+	`DELETE FROM assertion_subjects WHERE client_id = $1`,
+	`DELETE FROM registered_redirects WHERE client_id = $1`,
+	`DELETE FROM permitted_scopes WHERE client_id = $1`,
+	`DELETE FROM applications WHERE id = $1`,
+}
+
+func (s *LocalApplicationsService) Delete(a *Application) error {
+	tx, err := s.client.db.Begin()
+	if err != nil {
+		log.Println("Apps.Delete:", err)
+		return err
+	}
+
+	for _, query := range deleteApplicationSqls {
+		_, err = tx.Exec(query, a.Id)
+		if err != nil {
+			tx.Rollback()
+			log.Println("Apps.Delete:", err)
+			return err
+		}
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		log.Println("Apps.Delete: failed committing transaction:", err)
+		return err
+	}
+
+	return nil
+}
+
+const registeredRedirectsSql = `SELECT r.id, r.client_id, r.url, r.response_type
+FROM registered_redirects r WHERE r.client_id = $1 ORDER BY r.url, r.response_type`
+
+func (s *LocalApplicationsService) RegisteredRedirects(a *Application) ([]*RegisteredRedirect, error) {
+	var redirects []*RegisteredRedirect
+	err := s.client.db.Select(&redirects, registeredRedirectsSql, a.Id)
+	if err != nil {
+		log.Println("Apps.RegisteredRedirects:", err)
+		return nil, err
+	}
+
+	return redirects, nil
+}
+
+// AddRedirect registers a redirect URI for a response type. Registering the
+// same URI twice is not an error.
+func (s *LocalApplicationsService) AddRedirect(a *Application, url, responseType string) error {
+	_, err := s.client.db.Exec(createRegisteredRedirectSql, a.Id, url, responseType)
+	err = translateError(err)
+	if err == ErrNotUnique {
+		return nil
+	} else if err != nil {
+		log.Println("Apps.AddRedirect:", err)
+		return err
+	}
+
+	return nil
+}
+
+const removeRegisteredRedirectSql = `DELETE FROM registered_redirects
+WHERE client_id = $1 AND url = $2 AND response_type = $3`
+
+func (s *LocalApplicationsService) RemoveRedirect(a *Application, url, responseType string) error {
+	_, err := s.client.db.Exec(removeRegisteredRedirectSql, a.Id, url, responseType)
+	if err != nil {
+		log.Println("Apps.RemoveRedirect:", err)
+		return err
+	}
+
+	return nil
+}
+
+const redirectUrisSql = `SELECT DISTINCT r.url FROM registered_redirects r
+WHERE r.client_id = $1 ORDER BY r.url`
+
+func (s *LocalApplicationsService) RedirectUris(a *Application) ([]string, error) {
+	var uris []string
+	err := s.client.db.Select(&uris, redirectUrisSql, a.Id)
+	if err != nil {
+		log.Println("Apps.RedirectUris:", err)
+		return nil, err
+	}
+
+	return uris, nil
+}
+
+const permittedScopesSql = `SELECT s.name FROM scopes s
+INNER JOIN permitted_scopes ps ON ps.scope_id = s.id
+WHERE ps.client_id = $1 ORDER BY s.id`
+
+func (s *LocalApplicationsService) PermittedScopes(a *Application) ([]string, error) {
+	var scopes []string
+	err := s.client.db.Select(&scopes, permittedScopesSql, a.Id)
+	if err != nil {
+		log.Println("Apps.PermittedScopes:", err)
+		return nil, err
+	}
+
+	return scopes, nil
+}
+
+const findExchangePolicySql = `SELECT p.id, p.client_id, p.audience, p.scope
+FROM token_exchange_policies p WHERE p.client_id = $1 AND p.audience = $2`
 
-	// In a transaction:
-	// 1. Create an auth token
-	// 2. Consume the auth code (delete/mark as used)
+func (s *LocalApplicationsService) FindExchangePolicy(a *Application, audience string) (*ExchangePolicy, error) {
+	p := &ExchangePolicy{}
+	err := s.client.db.Get(p, findExchangePolicySql, a.Id, audience)
+	if err != nil {
+		log.Println("Apps.FindExchangePolicy:", err)
+		return nil, err
+	}
+
+	return p, nil
+}
+
+const assertionSubjectsSql = `SELECT s.subject FROM assertion_subjects s
+WHERE s.client_id = $1 ORDER BY s.subject`
+
+// AssertionSubjects lists the users (by email) that the application may
+// obtain tokens for with the JWT bearer grant. Only admins may change this
+// list; an application with no subjects can't use the grant at all.
+func (s *LocalApplicationsService) AssertionSubjects(a *Application) ([]string, error) {
+	var subjects []string
+	err := s.client.db.Select(&subjects, assertionSubjectsSql, a.Id)
+	if err != nil {
+		log.Println("Apps.AssertionSubjects:", err)
+		return nil, err
+	}
+
+	return subjects, nil
+}
+
+const createAssertionSubjectSql = `INSERT INTO assertion_subjects (client_id, subject)
+VALUES ($1, $2)`
+
+// AddAssertionSubject lets the application assert subject with the JWT bearer
+// grant. Adding the same subject twice is not an error.
+func (s *LocalApplicationsService) AddAssertionSubject(a *Application, subject string) error {
+	_, err := s.client.db.Exec(createAssertionSubjectSql, a.Id, subject)
+	err = translateError(err)
+	if err == ErrNotUnique {
+		return nil
+	} else if err != nil {
+		log.Println("Apps.AddAssertionSubject:", err)
+		return err
+	}
+
+	return nil
+}
+
+const removeAssertionSubjectSql = `DELETE FROM assertion_subjects
+WHERE client_id = $1 AND subject = $2`
+
+func (s *LocalApplicationsService) RemoveAssertionSubject(a *Application, subject string) error {
+	_, err := s.client.db.Exec(removeAssertionSubjectSql, a.Id, subject)
+	if err != nil {
+		log.Println("Apps.RemoveAssertionSubject:", err)
+		return err
+	}
+
+	return nil
+}
+
+const recordAssertionSql = `INSERT INTO client_assertions (client_id, jti, expires_at)
+VALUES ($1, $2, $3)`
+
+// RecordAssertion marks the JWT assertion with the given id as used. Each
+// assertion may only be used once, so recording an assertion a second time
+// fails with ErrNotUnique.
+func (s *LocalApplicationsService) RecordAssertion(a *Application, jti string, expiresAt time.Time) error {
+	_, err := s.client.db.Exec(recordAssertionSql, a.Id, jti, expiresAt)
+	err = translateError(err)
+	if err != nil && err != ErrNotUnique {
+		log.Println("Apps.RecordAssertion:", err)
+	}
+
+	return err
+}
+
+const createAuthCodeSql = `INSERT INTO authorization_codes
+(client_id, user_id, code, redirect_uri, scope, code_challenge, code_challenge_method,
+ nonce, auth_time, expires_at)
+VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10) RETURNING id`
+
+func (s *LocalApplicationsService) NewAuthCode(a *Application, userId int64, params *AuthCodeParams) (*AuthCode, error) {
+	code, err := RandomToken()
+	if err != nil {
+		log.Println("Apps.NewAuthCode: failed generating code:", err)
+		return nil, err
+	}
+
+	c := &AuthCode{
+		ClientId:            a.Id,
+		UserId:              userId,
+		Code:                code,
+		RedirectUri:         params.RedirectUri,
+		Scope:               params.Scope,
+		CodeChallenge:       params.CodeChallenge,
+		CodeChallengeMethod: params.CodeChallengeMethod,
+		Nonce:               params.Nonce,
+		AuthTime:            params.AuthTime,
+		ExpiresAt:           time.Now().Add(AuthCodeLifetime),
+	}
+	err = s.client.db.QueryRow(createAuthCodeSql, c.ClientId, c.UserId, HashToken(c.Code), c.RedirectUri, c.Scope, c.CodeChallenge, c.CodeChallengeMethod, c.Nonce, c.AuthTime, c.ExpiresAt).Scan(&c.Id)
+	if err != nil {
+		log.Println("Apps.NewAuthCode: failed inserting code:", err)
+		return nil, err
+	}
+
+	return c, nil
+}
+
+// Codes are deleted as they are read, so a code can only ever be redeemed
+// once, even by concurrent requests.
+const consumeAuthCodeSql = `DELETE FROM authorization_codes
+WHERE code = $1 AND client_id = $2
+RETURNING id, client_id, user_id, code, redirect_uri, scope,
+  code_challenge, code_challenge_method, nonce, auth_time, expires_at`
+
+// ExchangeAuthCode consumes an authorization code, issuing a refresh token in
+// its place. The consumed code is returned too, since it carries details of
+// the original authorization request.
+func (s *LocalApplicationsService) ExchangeAuthCode(a *Application, code, redirectUri, codeVerifier string) (*AuthCode, *Token, error) {
+	tx, err := s.client.db.Begin()
+	if err != nil {
+		log.Println("Apps.ExchangeAuthCode:", err)
+		return nil, nil, err
+	}
+
+	c := &AuthCode{}
+	err = tx.Get(c, consumeAuthCodeSql, HashToken(code), a.Id)
+	if err == sql.ErrNoRows {
+		tx.Rollback()
+		return nil, nil, ErrInvalidGrant
+	} else if err != nil {
+		tx.Rollback()
+		log.Println("Apps.ExchangeAuthCode: failed consuming code:", err)
+		return nil, nil, err
+	}
+
+	// Public clients can't authenticate, so proof of possession is the only
+	// thing tying the code to the client that requested it.
+	if a.IsPublic() && c.CodeChallenge == "" {
+		tx.Commit()
+		return nil, nil, ErrInvalidGrant
+	}
+
+	if c.RedirectUri != redirectUri || time.Now().After(c.ExpiresAt) || !c.Verify(codeVerifier) {
+		// Commit anyway: a code that has been presented incorrectly is burned.
+		tx.Commit()
+		return nil, nil, ErrInvalidGrant
+	}
+
+	refreshToken, err := RandomToken()
+	if err != nil {
+		tx.Rollback()
+		log.Println("Apps.ExchangeAuthCode: failed generating token:", err)
+		return nil, nil, err
+	}
+
+	t := &Token{
+		ClientId:  c.ClientId,
+		UserId:    c.UserId,
+		Type:      "refresh_token",
+		Token:     refreshToken,
+		Scope:     c.Scope,
+		AuthTime:  &c.AuthTime,
+		ExpiresAt: a.RefreshTokenExpiry(c.AuthTime),
+	}
+	err = createToken(s.client.db, tx, t)
+	if err != nil {
+		tx.Rollback()
+		log.Println("Apps.ExchangeAuthCode: failed inserting token:", err)
+		return nil, nil, err
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		log.Println("Apps.ExchangeAuthCode: failed committing transaction:", err)
+		return nil, nil, err
+	}
 
-	// Respond with access token
-	return nil, nil
+	return c, t, nil
 }
 
+// Authorize issues an access token to the application on its own behalf. The
+// token value is the JWT id (jti) of the access token the caller signs.
 func (s *LocalApplicationsService) Authorize(a *Application, scope string) (*Token, error) {
-	// Assume client is already authorized, and generate an access token
-	return nil, nil
+	return s.client.Tokens.New(accessTokenParams(a.Id, 0, scope, nil))
 }
@@ -0,0 +1,117 @@
+package storage
+
+import (
+	"log"
+	"time"
+)
+
+// CleanupStats counts the rows removed by a cleanup.
+type CleanupStats struct {
+	Tokens           int64
+	AuthorizedScopes int64
+	AuthCodes        int64
+	DeviceCodes      int64
+	Assertions       int64
+}
+
+// The Postgres advisory lock held by the server that leads cleanups. The value
+// is arbitrary, but must not clash with other users of advisory locks.
+const cleanupLockKey int64 = 0x72656769737472 // "registr"
+
+// Advisory locks taken with a bigint key are listed in pg_locks with its high
+// and low halves as classid and objid.
+const (
+	holdsCleanupLockSql = `SELECT EXISTS (SELECT 1 FROM pg_locks
+WHERE locktype = 'advisory' AND pid = pg_backend_pid() AND granted
+  AND classid::bigint = $1 AND objid::bigint = $2 AND objsubid = 1)`
+	takeCleanupLockSql = `SELECT pg_try_advisory_lock($1)`
+)
+
+// LeadCleanup reports whether this client leads cleanups, trying to take the
+// lead if no other server sharing the database holds it. Once taken, the lead
+// is held (by a session-level advisory lock) until the client is closed or
+// its connection to the database is lost. Only Postgres databases are shared,
+// so other backends always lead.
+func (c *Client) LeadCleanup() (bool, error) {
+	if c.leader == nil {
+		return true, nil
+	}
+
+	// The leader pool has a single connection, so both queries run in the
+	// session that holds (or will hold) the lock. Taking it again while it is
+	// held would stack another lock in the same session, so check first.
+	var held bool
+	err := c.leader.Get(&held, holdsCleanupLockSql, cleanupLockKey>>32, cleanupLockKey&0xffffffff)
+	if err != nil || held {
+		return held, err
+	}
+
+	err = c.leader.Get(&held, takeCleanupLockSql, cleanupLockKey)
+	return held, err
+}
+
+// Rows are deleted by id, a batch at a time, so that no statement holds
+// locks for long. Rotated tokens are kept until they expire, so that reuse
+// can be detected.
+const (
+	cleanupTokensSql = `DELETE FROM oauth_tokens WHERE id IN
+  (SELECT id FROM oauth_tokens WHERE expires_at < $1 OR revoked_at < $1 LIMIT $2)`
+	cleanupAuthorizedScopesSql = `DELETE FROM authorized_scopes WHERE id IN
+  (SELECT a.id FROM authorized_scopes a LEFT JOIN oauth_tokens t ON t.id = a.oauth_token_id
+   WHERE t.id IS NULL LIMIT $1)`
+	cleanupAuthCodesSql = `DELETE FROM authorization_codes WHERE id IN
+  (SELECT id FROM authorization_codes WHERE expires_at < $1 LIMIT $2)`
+	cleanupDeviceCodesSql = `DELETE FROM device_codes WHERE id IN
+  (SELECT id FROM device_codes WHERE expires_at < $1 LIMIT $2)`
+	cleanupAssertionsSql = `DELETE FROM client_assertions WHERE id IN
+  (SELECT id FROM client_assertions WHERE expires_at < $1 LIMIT $2)`
+)
+
+// Cleanup deletes tokens that expired or were revoked before the given time,
+// the scopes attached to them, and codes and client assertions that have
+// expired. Authorization and device codes are deleted as they are redeemed,
+// so only those that never were are left to clean up. Servers sharing a
+// database should only clean up while they lead (see LeadCleanup).
+//
+// Each batch of at most batchSize rows is deleted by its own statement.
+func (c *Client) Cleanup(before time.Time, batchSize int) (*CleanupStats, error) {
+	if c.memory != nil {
+		return c.memory.cleanup(before), nil
+	}
+
+	stats := &CleanupStats{}
+	steps := []struct {
+		count *int64
+		query string
+		args  []interface{}
+	}{
+		{&stats.Tokens, cleanupTokensSql, []interface{}{before, batchSize}},
+		{&stats.AuthorizedScopes, cleanupAuthorizedScopesSql, []interface{}{batchSize}},
+		{&stats.AuthCodes, cleanupAuthCodesSql, []interface{}{time.Now(), batchSize}},
+		{&stats.DeviceCodes, cleanupDeviceCodesSql, []interface{}{time.Now(), batchSize}},
+		{&stats.Assertions, cleanupAssertionsSql, []interface{}{time.Now(), batchSize}},
+	}
+
+	for _, step := range steps {
+		for {
+			res, err := c.db.Exec(step.query, step.args...)
+			if err != nil {
+				log.Println("Cleanup:", err)
+				return stats, err
+			}
+
+			n, err := res.RowsAffected()
+			if err != nil {
+				log.Println("Cleanup:", err)
+				return stats, err
+			}
+
+			*step.count += n
+			if n < int64(batchSize) {
+				break
+			}
+		}
+	}
+
+	return stats, nil
+}
@@ -7,18 +7,58 @@ import (
 )
 
 type Client struct {
-	db Database
+	db     Database
+	memory *memoryStore
+
+	// A pool of one connection, whose session holds the cleanup lock while
+	// this client leads cleanups (see LeadCleanup).
+	leader *sqlx.DB
 
 	Apps   ApplicationsService
 	Tokens TokensService
 	Users  UsersService
 }
 
+// A Driver opens a storage backend, returning a client for its services.
+type Driver func(cfg *Config) (*Client, error)
+
+// DefaultDriver is used when the database config doesn't name a driver.
+const DefaultDriver = "postgres"
+
+var drivers = make(map[string]Driver)
+
+// Register makes a storage backend available under the given name, for
+// selection with the driver setting in the database config.
+func Register(name string, driver Driver) {
+	if _, dup := drivers[name]; dup {
+		panic("storage: Register called twice for driver " + name)
+	}
+	drivers[name] = driver
+}
+
+func init() {
+	Register("postgres", openPostgres)
+}
+
 func NewClient(cfg *Config) (*Client, error) {
+	name := cfg.Database.Driver
+	if name == "" {
+		name = DefaultDriver
+	}
+
+	driver, ok := drivers[name]
+	if !ok {
+		return nil, fmt.Errorf("Unknown storage driver %q", name)
+	}
+
+	return driver(cfg)
+}
+
+func openPostgres(cfg *Config) (*Client, error) {
 	connStr := fmt.Sprintf("user=%s password=%s host=%s port=%d dbname=%s sslmode=%s connect_timeout=10", cfg.Database.User, cfg.Database.Password, cfg.Database.Host, cfg.Database.Port, cfg.Database.Database, cfg.Database.Sslmode)
 	pg, err := sqlx.Open("postgres", connStr)
 	if err != nil {
-		return nil, fmt.Errorf("Failed opening Postgres connection:", err)
+		return nil, fmt.Errorf("Failed opening Postgres connection: %s", err)
 	}
 
 	pg.SetMaxOpenConns(cfg.Database.Pool) // 0 = unlimited
@@ -26,12 +66,20 @@ func NewClient(cfg *Config) (*Client, error) {
 	// Validate DSN data
 	err = pg.Ping()
 	if err != nil {
-		return nil, fmt.Errorf("Failed opening Postgres connection:", err)
+		return nil, fmt.Errorf("Failed opening Postgres connection: %s", err)
 	}
 
+	leader, err := sqlx.Open("postgres", connStr)
+	if err != nil {
+		pg.Close()
+		return nil, fmt.Errorf("Failed opening Postgres connection: %s", err)
+	}
+	leader.SetMaxOpenConns(1)
+	leader.SetMaxIdleConns(1)
+
 	db := NewDatabase(pg)
 
-	c := &Client{db: db}
+	c := &Client{db: db, leader: leader}
 	c.Apps = &LocalApplicationsService{c}
 	c.Tokens = &LocalTokensService{c}
 	c.Users = &LocalUsersService{c}
@@ -40,5 +88,15 @@ func NewClient(cfg *Config) (*Client, error) {
 }
 
 func (c *Client) Close() error {
+	// Closing the leader's session releases the cleanup lock.
+	if c.leader != nil {
+		c.leader.Close()
+	}
+
+	// Not every backend keeps a database connection.
+	if c.db == nil {
+		return nil
+	}
+
 	return c.db.Close()
 }
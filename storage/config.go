@@ -5,6 +5,12 @@ type Config struct {
 }
 
 type DatabaseConfig struct {
+	// The storage backend: "postgres" (the default), "sqlite" or "memory".
+	// For SQLite, Database is the path to the database file. The memory
+	// backend keeps everything in process and loses it on exit; it is meant
+	// for tests and demos.
+	Driver string
+
 	User     string
 	Password string
 	Protocol string
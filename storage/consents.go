@@ -0,0 +1,223 @@
+package storage
+
+import (
+	"log"
+	"strings"
+	"time"
+
+	"database/sql"
+
+	"github.com/jmoiron/sqlx"
+)
+
+type Scope struct {
+	Id           int64  `json:"-"`
+	Name         string `json:"name"`
+	FriendlyName string `json:"friendly_name"`
+	Description  string `json:"description"`
+}
+
+// Authorization describes an application a user has granted access to, and
+// the scopes they granted it.
+type Authorization struct {
+	ClientId    string    `json:"client_id"`
+	Name        string    `json:"name"`
+	Description string    `json:"description"`
+	Website     string    `json:"website"`
+	Logo        string    `json:"logo"`
+	Scope       string    `json:"scope"`
+	UpdatedAt   time.Time `json:"updated_at"`
+}
+
+const findScopesSql = `SELECT s.id, s.name, s.friendly_name, s.description FROM scopes s
+WHERE s.name IN (?) ORDER BY s.id`
+
+func (s *LocalApplicationsService) FindScopes(names []string) ([]*Scope, error) {
+	if len(names) == 0 {
+		return nil, nil
+	}
+
+	query, args, err := sqlx.In(findScopesSql, names)
+	if err != nil {
+		log.Println("Apps.FindScopes:", err)
+		return nil, err
+	}
+
+	var scopes []*Scope
+	err = s.client.db.Select(&scopes, s.client.db.Rebind(query), args...)
+	if err != nil {
+		log.Println("Apps.FindScopes:", err)
+		return nil, err
+	}
+
+	return scopes, nil
+}
+
+const findConsentSql = `SELECT c.scope FROM consents c
+WHERE c.user_id = $1 AND c.client_id = $2`
+
+// Consent returns the scopes the user has previously agreed to grant the
+// application, if any.
+func (s *LocalUsersService) Consent(userId, clientId int64) (string, error) {
+	var scope string
+	err := s.client.db.QueryRow(findConsentSql, userId, clientId).Scan(&scope)
+	if err == sql.ErrNoRows {
+		return "", nil
+	} else if err != nil {
+		log.Println("Users.Consent:", err)
+		return "", err
+	}
+
+	return scope, nil
+}
+
+const updateConsentSql = `UPDATE consents SET scope = $3, updated_at = $4
+WHERE user_id = $1 AND client_id = $2`
+const createConsentSql = `INSERT INTO consents (user_id, client_id, scope, updated_at)
+VALUES ($1, $2, $3, $4)`
+
+// RememberConsent records that the user has agreed to grant the application
+// the given scopes, in addition to any they agreed to before, so that they
+// needn't be asked again.
+func (s *LocalUsersService) RememberConsent(userId, clientId int64, scope string) error {
+	previous, err := s.Consent(userId, clientId)
+	if err != nil {
+		return err
+	}
+
+	scopes := strings.Fields(previous)
+	for _, name := range strings.Fields(scope) {
+		if !strings.Contains(" "+previous+" ", " "+name+" ") {
+			scopes = append(scopes, name)
+		}
+	}
+	scope = strings.Join(scopes, " ")
+
+	now := time.Now()
+	res, err := s.client.db.Exec(updateConsentSql, userId, clientId, scope, now)
+	if err != nil {
+		log.Println("Users.RememberConsent:", err)
+		return err
+	}
+
+	if n, err := res.RowsAffected(); err == nil && n > 0 {
+		return nil
+	}
+
+	// A concurrent request may have beaten us to the insert, in which case
+	// its consent stands.
+	_, err = s.client.db.Exec(createConsentSql, userId, clientId, scope, now)
+	err = translateError(err)
+	if err != nil && err != ErrNotUnique {
+		log.Println("Users.RememberConsent:", err)
+		return err
+	}
+
+	return nil
+}
+
+const tokenAuthorizationsSql = `SELECT a.client_id, a.name, a.description, a.website, a.logo,
+  s.name AS scope, t.created_at AS updated_at
+FROM oauth_tokens t
+INNER JOIN applications a ON a.id = t.client_id
+INNER JOIN authorized_scopes sa ON sa.oauth_token_id = t.id
+INNER JOIN scopes s ON s.id = sa.scope_id
+WHERE t.user_id = $1 AND t.rotated_at IS NULL AND t.revoked_at IS NULL
+  AND (t.expires_at IS NULL OR t.expires_at > $2)
+ORDER BY a.id, s.id`
+
+const consentAuthorizationsSql = `SELECT a.client_id, a.name, a.description, a.website, a.logo,
+  c.scope, c.updated_at
+FROM consents c
+INNER JOIN applications a ON a.id = c.client_id
+WHERE c.user_id = $1
+ORDER BY a.id`
+
+// Authorizations lists the applications the user has granted access to:
+// those they have consented to, and those holding live tokens for them (e.g.
+// from the password grant).
+func (s *LocalUsersService) Authorizations(userId int64) ([]*Authorization, error) {
+	var consents []*Authorization
+	err := s.client.db.Select(&consents, consentAuthorizationsSql, userId)
+	if err != nil {
+		log.Println("Users.Authorizations: failed loading consents:", err)
+		return nil, err
+	}
+
+	var grants []*Authorization
+	err = s.client.db.Select(&grants, tokenAuthorizationsSql, userId, time.Now())
+	if err != nil {
+		log.Println("Users.Authorizations: failed loading tokens:", err)
+		return nil, err
+	}
+
+	// Token rows come one per token and scope, so fold them together.
+	var auths []*Authorization
+	byClient := make(map[string]*Authorization)
+	for _, row := range append(consents, grants...) {
+		auth, ok := byClient[row.ClientId]
+		if !ok {
+			auth = &Authorization{}
+			*auth = *row
+			auth.Scope = ""
+			byClient[row.ClientId] = auth
+			auths = append(auths, auth)
+		}
+
+		for _, name := range strings.Fields(row.Scope) {
+			if !strings.Contains(" "+auth.Scope+" ", " "+name+" ") {
+				auth.Scope = strings.TrimSpace(auth.Scope + " " + name)
+			}
+		}
+		if row.UpdatedAt.After(auth.UpdatedAt) {
+			auth.UpdatedAt = row.UpdatedAt
+		}
+	}
+
+	return auths, nil
+}
+
+const revokeAuthorizationTokensSql = `UPDATE oauth_tokens SET revoked_at = $3
+WHERE user_id = $1 AND client_id = $2 AND revoked_at IS NULL`
+
+// Along with the user's tokens, any outstanding codes are discarded, and the
+// user will be asked for consent again next time.
+var deleteAuthorizationSqls = []string{
+	`DELETE FROM authorization_codes WHERE user_id = $1 AND client_id = $2`,
+	`DELETE FROM device_codes WHERE user_id = $1 AND client_id = $2`,
+	`DELETE FROM consents WHERE user_id = $1 AND client_id = $2`,
+}
+
+// RevokeAuthorization withdraws all access the user has granted the
+// application.
+func (s *LocalUsersService) RevokeAuthorization(userId, clientId int64) error {
+	tx, err := s.client.db.Begin()
+	if err != nil {
+		log.Println("Users.RevokeAuthorization:", err)
+		return err
+	}
+
+	_, err = tx.Exec(revokeAuthorizationTokensSql, userId, clientId, time.Now())
+	if err != nil {
+		tx.Rollback()
+		log.Println("Users.RevokeAuthorization: failed revoking tokens:", err)
+		return err
+	}
+
+	for _, query := range deleteAuthorizationSqls {
+		_, err = tx.Exec(query, userId, clientId)
+		if err != nil {
+			tx.Rollback()
+			log.Println("Users.RevokeAuthorization:", err)
+			return err
+		}
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		log.Println("Users.RevokeAuthorization: failed committing transaction:", err)
+		return err
+	}
+
+	return nil
+}
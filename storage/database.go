@@ -1,10 +1,15 @@
 package storage
 
 import (
+	"errors"
+	"log"
+	"strings"
+
 	"database/sql"
 
 	"github.com/jmoiron/sqlx"
-	_ "github.com/lib/pq"
+	"github.com/lib/pq"
+	"github.com/mattn/go-sqlite3"
 )
 
 func init() {
@@ -14,6 +19,7 @@ func init() {
 type Database interface {
 	Close() error
 	Begin() (Tx, error)
+	DriverName() string
 
 	Exec(query string, args ...interface{}) (sql.Result, error)
 	Get(dest interface{}, query string, args ...interface{}) error
@@ -51,3 +57,39 @@ type Tx interface {
 type SqlxTx struct {
 	*sqlx.Tx
 }
+
+var (
+	ErrNotUnique      = errors.New("duplicate key value violates unique key constraint")
+	ErrUndefinedTable = errors.New("relation does not exist")
+)
+
+// translateError maps database-specific errors onto the errors callers
+// check for.
+func translateError(err error) error {
+	switch err := err.(type) {
+	case nil:
+		return nil
+	case *pq.Error:
+		switch err.Code {
+		case "23505": // unique_violation
+			return ErrNotUnique
+		case "42P01": // undefined_table
+			return ErrUndefinedTable
+		default:
+			log.Printf("returning raw PQ error (code %s)", err.Code)
+			return err
+		}
+	case sqlite3.Error:
+		switch {
+		case err.ExtendedCode == sqlite3.ErrConstraintUnique, err.ExtendedCode == sqlite3.ErrConstraintPrimaryKey:
+			return ErrNotUnique
+		case strings.HasPrefix(err.Error(), "no such table"): // SQLite has no code for this
+			return ErrUndefinedTable
+		default:
+			log.Printf("returning raw SQLite error (code %d)", err.ExtendedCode)
+			return err
+		}
+	default:
+		return err
+	}
+}
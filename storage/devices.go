@@ -0,0 +1,282 @@
+package storage
+
+import (
+	"errors"
+	"log"
+	"strings"
+	"time"
+
+	"crypto/rand"
+	"database/sql"
+)
+
+// Device codes (RFC 8628) give the user time to find another device, sign in
+// and approve the request, so they live a little longer than auth codes.
+const (
+	DeviceCodeLifetime     = 15 * time.Minute
+	DeviceCodePollInterval = 5 * time.Second
+)
+
+// User codes are typed in by hand, so they use an alphabet with no vowels
+// (to avoid spelling words) and no easily confused characters.
+const (
+	userCodeAlphabet = "BCDFGHJKLMNPQRSTVWXZ"
+	userCodeLength   = 8
+)
+
+var (
+	ErrAuthorizationPending = errors.New("device authorization is still pending")
+	ErrSlowDown             = errors.New("device is polling too frequently")
+	ErrExpiredToken         = errors.New("device code has expired")
+	ErrAccessDenied         = errors.New("user denied the device authorization request")
+)
+
+type DeviceCode struct {
+	Id           int64      `json:"-"`
+	ClientId     int64      `json:"-"`
+	UserId       int64      `json:"-"`
+	DeviceCode   string     `json:"-"` // stored hashed (see HashToken)
+	UserCode     string     `json:"user_code"`
+	Scope        string     `json:"scope"`
+	Status       string     `json:"-"`
+	PollInterval int        `json:"-"`
+	LastPolledAt *time.Time `json:"-"`
+	AuthTime     *time.Time `json:"-"`
+	ExpiresAt    time.Time  `json:"expires_at"`
+}
+
+func randomUserCode() (string, error) {
+	code := make([]byte, 0, userCodeLength)
+	buf := make([]byte, userCodeLength)
+	for len(code) < userCodeLength {
+		_, err := rand.Read(buf)
+		if err != nil {
+			return "", err
+		}
+
+		// Reject bytes past the largest multiple of the alphabet size, so
+		// that every character is equally likely.
+		for _, b := range buf {
+			limit := 256 - 256%len(userCodeAlphabet)
+			if int(b) < limit && len(code) < userCodeLength {
+				code = append(code, userCodeAlphabet[int(b)%len(userCodeAlphabet)])
+			}
+		}
+	}
+
+	return NormalizeUserCode(string(code)), nil
+}
+
+// NormalizeUserCode puts a user code as typed by a user into the form it is
+// stored in (e.g. "bcdf ghjk" becomes "BCDF-GHJK").
+func NormalizeUserCode(code string) string {
+	code = strings.Map(func(r rune) rune {
+		if r >= 'a' && r <= 'z' {
+			return r - 'a' + 'A'
+		} else if r >= 'A' && r <= 'Z' {
+			return r
+		}
+		return -1
+	}, code)
+
+	if len(code) != userCodeLength {
+		return code
+	}
+	return code[:userCodeLength/2] + "-" + code[userCodeLength/2:]
+}
+
+const defaultDeviceCodeFields = `d.id, d.client_id, COALESCE(d.user_id, 0) AS user_id,
+d.device_code, d.user_code, d.scope, d.status, d.poll_interval, d.last_polled_at,
+d.auth_time, d.expires_at`
+
+const createDeviceCodeSql = `INSERT INTO device_codes
+(client_id, device_code, user_code, scope, poll_interval, expires_at)
+VALUES ($1, $2, $3, $4, $5, $6) RETURNING id`
+
+// Give up after this many user code collisions; with 20^8 possible codes,
+// reaching it means something else is wrong.
+const maxUserCodeAttempts = 3
+
+func (s *LocalApplicationsService) NewDeviceCode(a *Application, scope string) (*DeviceCode, error) {
+	deviceCode, err := RandomToken()
+	if err != nil {
+		log.Println("Apps.NewDeviceCode: failed generating code:", err)
+		return nil, err
+	}
+
+	c := &DeviceCode{
+		ClientId:     a.Id,
+		DeviceCode:   deviceCode,
+		Scope:        scope,
+		Status:       "pending",
+		PollInterval: int(DeviceCodePollInterval / time.Second),
+		ExpiresAt:    time.Now().Add(DeviceCodeLifetime),
+	}
+
+	for i := 0; i < maxUserCodeAttempts; i++ {
+		c.UserCode, err = randomUserCode()
+		if err != nil {
+			log.Println("Apps.NewDeviceCode: failed generating code:", err)
+			return nil, err
+		}
+
+		err = s.client.db.QueryRow(createDeviceCodeSql, c.ClientId, HashToken(c.DeviceCode), c.UserCode, c.Scope, c.PollInterval, c.ExpiresAt).Scan(&c.Id)
+		if translateError(err) != ErrNotUnique {
+			break
+		}
+	}
+	if err != nil {
+		log.Println("Apps.NewDeviceCode: failed inserting code:", err)
+		return nil, err
+	}
+
+	return c, nil
+}
+
+const findPendingDeviceCodeSql = `SELECT ` + defaultDeviceCodeFields + ` FROM device_codes d
+WHERE d.user_code = $1 AND d.status = 'pending' AND d.expires_at > $2`
+
+// FindDeviceCode looks up a device authorization request that is still waiting
+// for the user's decision.
+func (s *LocalApplicationsService) FindDeviceCode(userCode string) (*DeviceCode, error) {
+	c := &DeviceCode{}
+	err := s.client.db.Get(c, findPendingDeviceCodeSql, NormalizeUserCode(userCode), time.Now())
+	if err != nil {
+		log.Println("Apps.FindDeviceCode:", err)
+		return nil, err
+	}
+
+	return c, nil
+}
+
+const decideDeviceCodeSql = `UPDATE device_codes SET status = $3, user_id = $2, auth_time = $4
+WHERE user_code = $1 AND status = 'pending' AND expires_at > $4
+RETURNING id`
+
+// ApproveDeviceCode records the user's decision on a pending device
+// authorization request. A request can only be decided once.
+func (s *LocalApplicationsService) ApproveDeviceCode(userCode string, userId int64, approved bool) error {
+	status := "denied"
+	if approved {
+		status = "approved"
+	}
+
+	// The user is present and making the decision, so treat this as the
+	// moment they authenticated.
+	var id int64
+	err := s.client.db.QueryRow(decideDeviceCodeSql, NormalizeUserCode(userCode), userId, status, time.Now()).Scan(&id)
+	if err == sql.ErrNoRows {
+		return ErrInvalidGrant
+	} else if err != nil {
+		log.Println("Apps.ApproveDeviceCode:", err)
+		return err
+	}
+
+	return nil
+}
+
+const findDeviceCodeSql = `SELECT ` + defaultDeviceCodeFields + ` FROM device_codes d
+WHERE d.device_code = $1 AND d.client_id = $2`
+const pollDeviceCodeSql = `UPDATE device_codes SET last_polled_at = $2 WHERE id = $1`
+const slowDownDeviceCodeSql = `UPDATE device_codes SET last_polled_at = $2,
+poll_interval = poll_interval + $3 WHERE id = $1`
+const deleteDeviceCodeSql = `DELETE FROM device_codes WHERE id = $1`
+
+// Approved codes are deleted as they are read, so a code can only ever be
+// redeemed once, even by concurrent requests.
+const consumeDeviceCodeSql = `DELETE FROM device_codes
+WHERE id = $1 AND status = 'approved' RETURNING id`
+
+// ExchangeDeviceCode is called each time a device polls with its device code.
+// Until the user has approved the request, it returns one of the RFC 8628
+// polling errors; once they have, it consumes the code and issues a refresh
+// token in its place.
+func (s *LocalApplicationsService) ExchangeDeviceCode(a *Application, deviceCode string) (*DeviceCode, *Token, error) {
+	c := &DeviceCode{}
+	err := s.client.db.Get(c, findDeviceCodeSql, HashToken(deviceCode), a.Id)
+	if err == sql.ErrNoRows {
+		return nil, nil, ErrInvalidGrant
+	} else if err != nil {
+		log.Println("Apps.ExchangeDeviceCode: failed finding code:", err)
+		return nil, nil, err
+	}
+
+	now := time.Now()
+	if now.After(c.ExpiresAt) {
+		return nil, nil, ErrExpiredToken
+	}
+
+	interval := time.Duration(c.PollInterval) * time.Second
+	if c.LastPolledAt != nil && now.Sub(*c.LastPolledAt) < interval {
+		_, err = s.client.db.Exec(slowDownDeviceCodeSql, c.Id, now, int(DeviceCodePollInterval/time.Second))
+		if err != nil {
+			log.Println("Apps.ExchangeDeviceCode: failed updating code:", err)
+			return nil, nil, err
+		}
+		return nil, nil, ErrSlowDown
+	}
+
+	switch c.Status {
+	case "pending":
+		_, err = s.client.db.Exec(pollDeviceCodeSql, c.Id, now)
+		if err != nil {
+			log.Println("Apps.ExchangeDeviceCode: failed updating code:", err)
+			return nil, nil, err
+		}
+		return nil, nil, ErrAuthorizationPending
+	case "denied":
+		_, err = s.client.db.Exec(deleteDeviceCodeSql, c.Id)
+		if err != nil {
+			log.Println("Apps.ExchangeDeviceCode: failed deleting code:", err)
+			return nil, nil, err
+		}
+		return nil, nil, ErrAccessDenied
+	}
+
+	refreshToken, err := RandomToken()
+	if err != nil {
+		log.Println("Apps.ExchangeDeviceCode: failed generating token:", err)
+		return nil, nil, err
+	}
+
+	tx, err := s.client.db.Begin()
+	if err != nil {
+		log.Println("Apps.ExchangeDeviceCode:", err)
+		return nil, nil, err
+	}
+
+	var id int64
+	err = tx.QueryRow(consumeDeviceCodeSql, c.Id).Scan(&id)
+	if err == sql.ErrNoRows {
+		tx.Rollback()
+		return nil, nil, ErrInvalidGrant
+	} else if err != nil {
+		tx.Rollback()
+		log.Println("Apps.ExchangeDeviceCode: failed consuming code:", err)
+		return nil, nil, err
+	}
+
+	t := &Token{
+		ClientId:  c.ClientId,
+		UserId:    c.UserId,
+		Type:      "refresh_token",
+		Token:     refreshToken,
+		Scope:     c.Scope,
+		AuthTime:  c.AuthTime,
+		ExpiresAt: a.RefreshTokenExpiry(*c.AuthTime),
+	}
+	err = createToken(s.client.db, tx, t)
+	if err != nil {
+		tx.Rollback()
+		log.Println("Apps.ExchangeDeviceCode: failed inserting token:", err)
+		return nil, nil, err
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		log.Println("Apps.ExchangeDeviceCode: failed committing transaction:", err)
+		return nil, nil, err
+	}
+
+	return c, t, nil
+}
@@ -0,0 +1,252 @@
+package storage
+
+import (
+	"strings"
+	"sync"
+	"time"
+)
+
+func init() {
+	Register("memory", func(cfg *Config) (*Client, error) {
+		return NewMemoryClient(), nil
+	})
+}
+
+// NewMemoryClient returns a client whose services keep everything in memory.
+// Nothing is persisted, so it is only suitable for tests and demos. It starts
+// out with the same scopes as the initial migration, but no applications or users.
+func NewMemoryClient() *Client {
+	m := &memoryStore{
+		apps:        make(map[int64]*Application),
+		users:       make(map[int64]*memoryUser),
+		tokens:      make(map[int64]*Token),
+		permitted:   make(map[int64]map[int64]bool),
+		authCodes:   make(map[string]*AuthCode),
+		deviceCodes: make(map[int64]*DeviceCode),
+		assertions:  make(map[memoryAssertion]time.Time),
+		subjects:    make(map[int64]map[string]bool),
+		consents:    make(map[memoryConsentKey]*memoryConsent),
+	}
+
+	for _, s := range []Scope{
+		{Name: "openid", FriendlyName: "OpenID", Description: "Your OpenID identity information"},
+		{Name: "email", FriendlyName: "email", Description: "Your email address"},
+		{Name: "profile", FriendlyName: "profile", Description: "Your profile information"},
+		{Name: "admin", FriendlyName: "administration", Description: "Access to administration endpoints"},
+	} {
+		scope := s
+		scope.Id = m.newId()
+		m.scopes = append(m.scopes, &scope)
+	}
+
+	c := &Client{memory: m}
+	c.Apps = &MemoryApplicationsService{m}
+	c.Tokens = &MemoryTokensService{m}
+	c.Users = &MemoryUsersService{m}
+
+	return c
+}
+
+type memoryUser struct {
+	User
+	HashedPassword string
+}
+
+type memoryAssertion struct {
+	ClientId int64
+	Jti      string
+}
+
+type memoryConsentKey struct {
+	UserId   int64
+	ClientId int64
+}
+
+type memoryConsent struct {
+	Scope     string
+	UpdatedAt time.Time
+}
+
+// memoryStore holds the state shared by the memory services. Every method on
+// the services takes the lock for its whole duration, so each one is atomic,
+// like a transaction. Records are copied on the way in and out, so callers
+// can't modify the store by modifying what it returns.
+type memoryStore struct {
+	mu     sync.Mutex
+	lastId int64
+
+	apps        map[int64]*Application
+	users       map[int64]*memoryUser
+	tokens      map[int64]*Token
+	scopes      []*Scope
+	permitted   map[int64]map[int64]bool // client id -> scope ids
+	redirects   []*RegisteredRedirect
+	authCodes   map[string]*AuthCode
+	deviceCodes map[int64]*DeviceCode
+	assertions  map[memoryAssertion]time.Time
+	subjects    map[int64]map[string]bool // client id -> assertion subjects
+	consents    map[memoryConsentKey]*memoryConsent
+}
+
+// newId returns an id unique across all records in the store.
+func (m *memoryStore) newId() int64 {
+	m.lastId++
+	return m.lastId
+}
+
+func (m *memoryStore) findScope(name string) *Scope {
+	for _, s := range m.scopes {
+		if s.Name == name {
+			return s
+		}
+	}
+
+	return nil
+}
+
+// permittedScope filters scope down to the scopes that exist and that the
+// client may request, in scope id order.
+func (m *memoryStore) permittedScope(clientId int64, scope string) string {
+	requested := " " + strings.Join(strings.Fields(scope), " ") + " "
+	var names []string
+	for _, s := range m.scopes {
+		if m.permitted[clientId][s.Id] && strings.Contains(requested, " "+s.Name+" ") {
+			names = append(names, s.Name)
+		}
+	}
+
+	return strings.Join(names, " ")
+}
+
+// createToken stores a copy of t, filling in its id and creation time. As in
+// the database, only the scopes the client is permitted are attached (and the
+// admin scope only for admins), and only the token's digest is kept.
+func (m *memoryStore) createToken(t *Token) {
+	t.Id = m.newId()
+	t.CreatedAt = time.Now()
+	t.Scope = m.permittedScope(t.ClientId, t.Scope)
+	if u, ok := m.users[t.UserId]; ok && !u.Admin {
+		var scopes []string
+		for _, s := range strings.Fields(t.Scope) {
+			if s != "admin" {
+				scopes = append(scopes, s)
+			}
+		}
+		t.Scope = strings.Join(scopes, " ")
+	}
+
+	stored := *t
+	stored.Token = HashToken(t.Token)
+	m.tokens[t.Id] = &stored
+}
+
+// newToken stores a token with a fresh random value.
+func (m *memoryStore) newToken(params *TokenParams) (*Token, error) {
+	value, err := RandomToken()
+	if err != nil {
+		return nil, err
+	}
+
+	t := &Token{
+		ClientId:  params.ClientId,
+		UserId:    params.UserId,
+		ParentId:  params.ParentId,
+		FamilyId:  params.FamilyId,
+		Type:      params.Type,
+		Token:     value,
+		Scope:     params.Scope,
+		AuthTime:  params.AuthTime,
+		ExpiresAt: params.ExpiresAt,
+	}
+	m.createToken(t)
+
+	return t, nil
+}
+
+// copyToken returns a copy of a stored token. Tokens that are not part of a
+// family are reported as the root of their own, as in the database.
+func copyToken(t *Token) *Token {
+	c := *t
+	if c.FamilyId == 0 {
+		c.FamilyId = c.Id
+	}
+
+	return &c
+}
+
+// revokeTokenFamily revokes a token family: see revokeTokenFamilySql.
+func (m *memoryStore) revokeTokenFamily(familyId int64) {
+	family := make(map[int64]bool)
+	for _, t := range m.tokens {
+		if t.Id == familyId || t.FamilyId == familyId {
+			family[t.Id] = true
+		}
+	}
+
+	// Sweep in derived tokens until no more turn up.
+	for grew := true; grew; {
+		grew = false
+		for _, t := range m.tokens {
+			if !family[t.Id] && family[t.ParentId] {
+				family[t.Id] = true
+				grew = true
+			}
+		}
+	}
+
+	now := time.Now()
+	for id := range family {
+		if t := m.tokens[id]; t.RevokedAt == nil {
+			t.RevokedAt = &now
+		}
+	}
+}
+
+// cleanup is the counterpart of Client.Cleanup. Scopes are stored with their
+// tokens, so there are never any left behind.
+func (m *memoryStore) cleanup(before time.Time) *CleanupStats {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	now := time.Now()
+	stats := &CleanupStats{}
+	for id, t := range m.tokens {
+		if (t.ExpiresAt != nil && t.ExpiresAt.Before(before)) ||
+			(t.RevokedAt != nil && t.RevokedAt.Before(before)) {
+			delete(m.tokens, id)
+			stats.Tokens++
+		}
+	}
+	for code, c := range m.authCodes {
+		if c.ExpiresAt.Before(now) {
+			delete(m.authCodes, code)
+			stats.AuthCodes++
+		}
+	}
+	for id, c := range m.deviceCodes {
+		if c.ExpiresAt.Before(now) {
+			delete(m.deviceCodes, id)
+			stats.DeviceCodes++
+		}
+	}
+	for a, expiresAt := range m.assertions {
+		if expiresAt.Before(now) {
+			delete(m.assertions, a)
+			stats.Assertions++
+		}
+	}
+
+	return stats
+}
+
+// isLive reports whether a token is unexpired, unrotated and unrevoked.
+func isLive(t *Token, now time.Time) bool {
+	return t.RotatedAt == nil && t.RevokedAt == nil &&
+		(t.ExpiresAt == nil || t.ExpiresAt.After(now))
+}
+
+type int64s []int64
+
+func (s int64s) Len() int           { return len(s) }
+func (s int64s) Less(i, j int) bool { return s[i] < s[j] }
+func (s int64s) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
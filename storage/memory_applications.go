@@ -0,0 +1,622 @@
+package storage
+
+import (
+	"sort"
+	"strings"
+	"time"
+
+	"database/sql"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+type MemoryApplicationsService struct {
+	store *memoryStore
+}
+
+func (s *MemoryApplicationsService) FindByClientId(id string) (*Application, error) {
+	s.store.mu.Lock()
+	defer s.store.mu.Unlock()
+
+	return s.findByClientId(id)
+}
+
+func (s *MemoryApplicationsService) findByClientId(id string) (*Application, error) {
+	for _, a := range s.store.apps {
+		if a.ClientId == id {
+			c := *a
+			return &c, nil
+		}
+	}
+
+	return nil, sql.ErrNoRows
+}
+
+func (s *MemoryApplicationsService) FindById(id int64) (*Application, error) {
+	s.store.mu.Lock()
+	defer s.store.mu.Unlock()
+
+	a, ok := s.store.apps[id]
+	if !ok {
+		return nil, sql.ErrNoRows
+	}
+
+	c := *a
+	return &c, nil
+}
+
+func (s *MemoryApplicationsService) FindByCredentials(id, secret string) (*Application, error) {
+	a, err := s.FindByClientId(id)
+	if err != nil {
+		return nil, err
+	}
+
+	err = bcrypt.CompareHashAndPassword([]byte(a.HashedClientSecret), []byte(secret))
+	if err != nil {
+		return nil, err
+	}
+
+	return a, nil
+}
+
+func (s *MemoryApplicationsService) New(params *ApplicationParams) (*Application, error) {
+	a := &Application{
+		Name:                    params.Name,
+		Description:             params.Description,
+		Website:                 params.Website,
+		Logo:                    params.Logo,
+		ClientType:              params.clientType(),
+		TokenEndpointAuthMethod: params.TokenEndpointAuthMethod,
+		GrantTypes:              strings.Join(params.GrantTypes, " "),
+		ResponseTypes:           strings.Join(params.ResponseTypes, " "),
+		Jwks:                    params.Jwks,
+		PostLogoutRedirectUris:  strings.Join(params.PostLogoutRedirectUris, " "),
+		BackchannelLogoutUri:    params.BackchannelLogoutUri,
+
+		UserinfoSignedResponseAlg: params.UserinfoSignedResponseAlg,
+		RefreshTokenRotation:      params.RefreshTokenRotation,
+		RefreshTokenLifetime:      params.RefreshTokenLifetime,
+		RefreshTokenIdleLifetime:  params.RefreshTokenIdleLifetime,
+	}
+
+	var err error
+	a.ClientId, err = RandomToken()
+	if err != nil {
+		return nil, err
+	}
+
+	if params.usesSecret() {
+		err = a.generateSecret()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	err = a.generateRegistrationAccessToken()
+	if err != nil {
+		return nil, err
+	}
+
+	s.store.mu.Lock()
+	defer s.store.mu.Unlock()
+
+	a.Id = s.store.newId()
+	stored := *a
+	stored.ClientSecret = ""
+	stored.RegistrationAccessToken = ""
+	s.store.apps[a.Id] = &stored
+	s.setRegistration(a, params)
+
+	return a, nil
+}
+
+func (s *MemoryApplicationsService) Update(a *Application, params *ApplicationParams) (*Application, error) {
+	u := *a
+	u.Name = params.Name
+	u.Description = params.Description
+	u.Website = params.Website
+	u.Logo = params.Logo
+	u.ClientType = params.clientType()
+	u.TokenEndpointAuthMethod = params.TokenEndpointAuthMethod
+	u.GrantTypes = strings.Join(params.GrantTypes, " ")
+	u.ResponseTypes = strings.Join(params.ResponseTypes, " ")
+	u.Jwks = params.Jwks
+	u.PostLogoutRedirectUris = strings.Join(params.PostLogoutRedirectUris, " ")
+	u.BackchannelLogoutUri = params.BackchannelLogoutUri
+	u.UserinfoSignedResponseAlg = params.UserinfoSignedResponseAlg
+	u.RefreshTokenRotation = params.RefreshTokenRotation
+	u.RefreshTokenLifetime = params.RefreshTokenLifetime
+	u.RefreshTokenIdleLifetime = params.RefreshTokenIdleLifetime
+
+	if !params.usesSecret() {
+		u.HashedClientSecret = ""
+	} else if u.HashedClientSecret == "" {
+		err := u.generateSecret()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	s.store.mu.Lock()
+	defer s.store.mu.Unlock()
+
+	stored, ok := s.store.apps[u.Id]
+	if !ok {
+		return nil, sql.ErrNoRows
+	}
+
+	// The registration access token is never changed by an update.
+	registrationAccessToken := stored.HashedRegistrationAccessToken
+	*stored = u
+	stored.ClientSecret = ""
+	stored.RegistrationAccessToken = ""
+	stored.HashedRegistrationAccessToken = registrationAccessToken
+	s.setRegistration(&u, params)
+
+	return &u, nil
+}
+
+// setRegistration is the counterpart of
+// LocalApplicationsService.setRegistration.
+func (s *MemoryApplicationsService) setRegistration(a *Application, params *ApplicationParams) {
+	var redirects []*RegisteredRedirect
+	for _, r := range s.store.redirects {
+		if r.ClientId != a.Id {
+			redirects = append(redirects, r)
+		}
+	}
+	for _, uri := range params.RedirectUris {
+		for _, responseType := range params.ResponseTypes {
+			redirects = append(redirects, &RegisteredRedirect{
+				Id:           s.store.newId(),
+				ClientId:     a.Id,
+				Url:          uri,
+				ResponseType: responseType,
+			})
+		}
+	}
+	s.store.redirects = redirects
+
+	permitted := make(map[int64]bool)
+	for _, name := range strings.Fields(params.Scope) {
+		if scope := s.store.findScope(name); scope != nil {
+			permitted[scope.Id] = true
+		}
+	}
+	s.store.permitted[a.Id] = permitted
+}
+
+// Delete removes the application and everything belonging to it, as
+// LocalApplicationsService.Delete does.
+func (s *MemoryApplicationsService) Delete(a *Application) error {
+	s.store.mu.Lock()
+	defer s.store.mu.Unlock()
+
+	for id, t := range s.store.tokens {
+		if t.ClientId == a.Id {
+			delete(s.store.tokens, id)
+		}
+	}
+	for code, c := range s.store.authCodes {
+		if c.ClientId == a.Id {
+			delete(s.store.authCodes, code)
+		}
+	}
+	for id, c := range s.store.deviceCodes {
+		if c.ClientId == a.Id {
+			delete(s.store.deviceCodes, id)
+		}
+	}
+	for key := range s.store.assertions {
+		if key.ClientId == a.Id {
+			delete(s.store.assertions, key)
+		}
+	}
+	for key := range s.store.consents {
+		if key.ClientId == a.Id {
+			delete(s.store.consents, key)
+		}
+	}
+
+	var redirects []*RegisteredRedirect
+	for _, r := range s.store.redirects {
+		if r.ClientId != a.Id {
+			redirects = append(redirects, r)
+		}
+	}
+	s.store.redirects = redirects
+
+	delete(s.store.permitted, a.Id)
+	delete(s.store.subjects, a.Id)
+	delete(s.store.apps, a.Id)
+
+	return nil
+}
+
+type redirectsByUrl []*RegisteredRedirect
+
+func (r redirectsByUrl) Len() int      { return len(r) }
+func (r redirectsByUrl) Swap(i, j int) { r[i], r[j] = r[j], r[i] }
+func (r redirectsByUrl) Less(i, j int) bool {
+	if r[i].Url != r[j].Url {
+		return r[i].Url < r[j].Url
+	}
+	return r[i].ResponseType < r[j].ResponseType
+}
+
+func (s *MemoryApplicationsService) RegisteredRedirects(a *Application) ([]*RegisteredRedirect, error) {
+	s.store.mu.Lock()
+	defer s.store.mu.Unlock()
+
+	var redirects []*RegisteredRedirect
+	for _, r := range s.store.redirects {
+		if r.ClientId == a.Id {
+			c := *r
+			redirects = append(redirects, &c)
+		}
+	}
+	sort.Sort(redirectsByUrl(redirects))
+
+	return redirects, nil
+}
+
+// AddRedirect registers a redirect URI for a response type. Registering the
+// same URI twice is not an error.
+func (s *MemoryApplicationsService) AddRedirect(a *Application, url, responseType string) error {
+	s.store.mu.Lock()
+	defer s.store.mu.Unlock()
+
+	for _, r := range s.store.redirects {
+		if r.ClientId == a.Id && r.Url == url && r.ResponseType == responseType {
+			return nil
+		}
+	}
+
+	s.store.redirects = append(s.store.redirects, &RegisteredRedirect{
+		Id:           s.store.newId(),
+		ClientId:     a.Id,
+		Url:          url,
+		ResponseType: responseType,
+	})
+
+	return nil
+}
+
+func (s *MemoryApplicationsService) RemoveRedirect(a *Application, url, responseType string) error {
+	s.store.mu.Lock()
+	defer s.store.mu.Unlock()
+
+	var redirects []*RegisteredRedirect
+	for _, r := range s.store.redirects {
+		if r.ClientId != a.Id || r.Url != url || r.ResponseType != responseType {
+			redirects = append(redirects, r)
+		}
+	}
+	s.store.redirects = redirects
+
+	return nil
+}
+
+func (s *MemoryApplicationsService) RedirectUris(a *Application) ([]string, error) {
+	s.store.mu.Lock()
+	defer s.store.mu.Unlock()
+
+	var uris []string
+	seen := make(map[string]bool)
+	for _, r := range s.store.redirects {
+		if r.ClientId == a.Id && !seen[r.Url] {
+			seen[r.Url] = true
+			uris = append(uris, r.Url)
+		}
+	}
+	sort.Strings(uris)
+
+	return uris, nil
+}
+
+func (s *MemoryApplicationsService) PermittedScopes(a *Application) ([]string, error) {
+	s.store.mu.Lock()
+	defer s.store.mu.Unlock()
+
+	var scopes []string
+	for _, scope := range s.store.scopes {
+		if s.store.permitted[a.Id][scope.Id] {
+			scopes = append(scopes, scope.Name)
+		}
+	}
+
+	return scopes, nil
+}
+
+func (s *MemoryApplicationsService) FindScopes(names []string) ([]*Scope, error) {
+	s.store.mu.Lock()
+	defer s.store.mu.Unlock()
+
+	var scopes []*Scope
+	for _, scope := range s.store.scopes {
+		for _, name := range names {
+			if scope.Name == name {
+				c := *scope
+				scopes = append(scopes, &c)
+				break
+			}
+		}
+	}
+
+	return scopes, nil
+}
+
+// Token exchange policies are only ever configured directly in the database,
+// so the memory backend has none.
+func (s *MemoryApplicationsService) FindExchangePolicy(a *Application, audience string) (*ExchangePolicy, error) {
+	return nil, sql.ErrNoRows
+}
+
+func (s *MemoryApplicationsService) AssertionSubjects(a *Application) ([]string, error) {
+	s.store.mu.Lock()
+	defer s.store.mu.Unlock()
+
+	var subjects []string
+	for subject := range s.store.subjects[a.Id] {
+		subjects = append(subjects, subject)
+	}
+	sort.Strings(subjects)
+
+	return subjects, nil
+}
+
+func (s *MemoryApplicationsService) AddAssertionSubject(a *Application, subject string) error {
+	s.store.mu.Lock()
+	defer s.store.mu.Unlock()
+
+	if s.store.subjects[a.Id] == nil {
+		s.store.subjects[a.Id] = make(map[string]bool)
+	}
+	s.store.subjects[a.Id][subject] = true
+
+	return nil
+}
+
+func (s *MemoryApplicationsService) RemoveAssertionSubject(a *Application, subject string) error {
+	s.store.mu.Lock()
+	defer s.store.mu.Unlock()
+
+	delete(s.store.subjects[a.Id], subject)
+
+	return nil
+}
+
+func (s *MemoryApplicationsService) RecordAssertion(a *Application, jti string, expiresAt time.Time) error {
+	s.store.mu.Lock()
+	defer s.store.mu.Unlock()
+
+	key := memoryAssertion{a.Id, jti}
+	if _, ok := s.store.assertions[key]; ok {
+		return ErrNotUnique
+	}
+	s.store.assertions[key] = expiresAt
+
+	return nil
+}
+
+func (s *MemoryApplicationsService) NewAuthCode(a *Application, userId int64, params *AuthCodeParams) (*AuthCode, error) {
+	code, err := RandomToken()
+	if err != nil {
+		return nil, err
+	}
+
+	c := &AuthCode{
+		ClientId:            a.Id,
+		UserId:              userId,
+		Code:                code,
+		RedirectUri:         params.RedirectUri,
+		Scope:               params.Scope,
+		CodeChallenge:       params.CodeChallenge,
+		CodeChallengeMethod: params.CodeChallengeMethod,
+		Nonce:               params.Nonce,
+		AuthTime:            params.AuthTime,
+		ExpiresAt:           time.Now().Add(AuthCodeLifetime),
+	}
+
+	s.store.mu.Lock()
+	defer s.store.mu.Unlock()
+
+	c.Id = s.store.newId()
+	stored := *c
+	stored.Code = HashToken(code)
+	s.store.authCodes[stored.Code] = &stored
+
+	return c, nil
+}
+
+// ExchangeAuthCode consumes an authorization code, issuing a refresh token in
+// its place, as LocalApplicationsService.ExchangeAuthCode does.
+func (s *MemoryApplicationsService) ExchangeAuthCode(a *Application, code, redirectUri, codeVerifier string) (*AuthCode, *Token, error) {
+	refreshToken, err := RandomToken()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	s.store.mu.Lock()
+	defer s.store.mu.Unlock()
+
+	c, ok := s.store.authCodes[HashToken(code)]
+	if !ok || c.ClientId != a.Id {
+		return nil, nil, ErrInvalidGrant
+	}
+	delete(s.store.authCodes, c.Code)
+
+	if a.IsPublic() && c.CodeChallenge == "" {
+		return nil, nil, ErrInvalidGrant
+	}
+
+	if c.RedirectUri != redirectUri || time.Now().After(c.ExpiresAt) || !c.Verify(codeVerifier) {
+		return nil, nil, ErrInvalidGrant
+	}
+
+	authTime := c.AuthTime
+	t := &Token{
+		ClientId:  c.ClientId,
+		UserId:    c.UserId,
+		Type:      "refresh_token",
+		Token:     refreshToken,
+		Scope:     c.Scope,
+		AuthTime:  &authTime,
+		ExpiresAt: a.RefreshTokenExpiry(c.AuthTime),
+	}
+	s.store.createToken(t)
+
+	return c, t, nil
+}
+
+// Authorize issues an access token to the application on its own behalf. The
+// token value is the JWT id (jti) of the access token the caller signs.
+func (s *MemoryApplicationsService) Authorize(a *Application, scope string) (*Token, error) {
+	s.store.mu.Lock()
+	defer s.store.mu.Unlock()
+
+	return s.store.newToken(accessTokenParams(a.Id, 0, scope, nil))
+}
+
+func (s *MemoryApplicationsService) NewDeviceCode(a *Application, scope string) (*DeviceCode, error) {
+	deviceCode, err := RandomToken()
+	if err != nil {
+		return nil, err
+	}
+
+	c := &DeviceCode{
+		ClientId:     a.Id,
+		DeviceCode:   deviceCode,
+		Scope:        scope,
+		Status:       "pending",
+		PollInterval: int(DeviceCodePollInterval / time.Second),
+		ExpiresAt:    time.Now().Add(DeviceCodeLifetime),
+	}
+
+	s.store.mu.Lock()
+	defer s.store.mu.Unlock()
+
+	for i := 0; i < maxUserCodeAttempts; i++ {
+		c.UserCode, err = randomUserCode()
+		if err != nil {
+			return nil, err
+		}
+
+		if s.findDeviceCodeByUserCode(c.UserCode) == nil {
+			c.Id = s.store.newId()
+			stored := *c
+			stored.DeviceCode = HashToken(c.DeviceCode)
+			s.store.deviceCodes[c.Id] = &stored
+			return c, nil
+		}
+	}
+
+	return nil, ErrNotUnique
+}
+
+func (s *MemoryApplicationsService) findDeviceCodeByUserCode(userCode string) *DeviceCode {
+	for _, c := range s.store.deviceCodes {
+		if c.UserCode == userCode {
+			return c
+		}
+	}
+
+	return nil
+}
+
+// FindDeviceCode looks up a device authorization request that is still waiting
+// for the user's decision.
+func (s *MemoryApplicationsService) FindDeviceCode(userCode string) (*DeviceCode, error) {
+	s.store.mu.Lock()
+	defer s.store.mu.Unlock()
+
+	c := s.findDeviceCodeByUserCode(NormalizeUserCode(userCode))
+	if c == nil || c.Status != "pending" || !c.ExpiresAt.After(time.Now()) {
+		return nil, sql.ErrNoRows
+	}
+
+	found := *c
+	return &found, nil
+}
+
+// ApproveDeviceCode records the user's decision on a pending device
+// authorization request. A request can only be decided once.
+func (s *MemoryApplicationsService) ApproveDeviceCode(userCode string, userId int64, approved bool) error {
+	s.store.mu.Lock()
+	defer s.store.mu.Unlock()
+
+	now := time.Now()
+	c := s.findDeviceCodeByUserCode(NormalizeUserCode(userCode))
+	if c == nil || c.Status != "pending" || !c.ExpiresAt.After(now) {
+		return ErrInvalidGrant
+	}
+
+	c.Status = "denied"
+	if approved {
+		c.Status = "approved"
+	}
+	c.UserId = userId
+	c.AuthTime = &now
+
+	return nil
+}
+
+// ExchangeDeviceCode is called each time a device polls with its device code,
+// and behaves as LocalApplicationsService.ExchangeDeviceCode does.
+func (s *MemoryApplicationsService) ExchangeDeviceCode(a *Application, deviceCode string) (*DeviceCode, *Token, error) {
+	refreshToken, err := RandomToken()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	s.store.mu.Lock()
+	defer s.store.mu.Unlock()
+
+	var c *DeviceCode
+	for _, d := range s.store.deviceCodes {
+		if d.DeviceCode == HashToken(deviceCode) && d.ClientId == a.Id {
+			c = d
+			break
+		}
+	}
+	if c == nil {
+		return nil, nil, ErrInvalidGrant
+	}
+
+	now := time.Now()
+	if now.After(c.ExpiresAt) {
+		return nil, nil, ErrExpiredToken
+	}
+
+	interval := time.Duration(c.PollInterval) * time.Second
+	if c.LastPolledAt != nil && now.Sub(*c.LastPolledAt) < interval {
+		c.LastPolledAt = &now
+		c.PollInterval += int(DeviceCodePollInterval / time.Second)
+		return nil, nil, ErrSlowDown
+	}
+
+	switch c.Status {
+	case "pending":
+		c.LastPolledAt = &now
+		return nil, nil, ErrAuthorizationPending
+	case "denied":
+		delete(s.store.deviceCodes, c.Id)
+		return nil, nil, ErrAccessDenied
+	}
+
+	delete(s.store.deviceCodes, c.Id)
+
+	t := &Token{
+		ClientId:  c.ClientId,
+		UserId:    c.UserId,
+		Type:      "refresh_token",
+		Token:     refreshToken,
+		Scope:     c.Scope,
+		AuthTime:  c.AuthTime,
+		ExpiresAt: a.RefreshTokenExpiry(*c.AuthTime),
+	}
+	s.store.createToken(t)
+
+	found := *c
+	return &found, t, nil
+}
@@ -0,0 +1,154 @@
+package storage
+
+import (
+	"time"
+
+	"database/sql"
+)
+
+type MemoryTokensService struct {
+	store *memoryStore
+}
+
+// New issues a token with a fresh random value, as LocalTokensService.New
+// does.
+func (s *MemoryTokensService) New(params *TokenParams) (*Token, error) {
+	s.store.mu.Lock()
+	defer s.store.mu.Unlock()
+
+	return s.store.newToken(params)
+}
+
+// FindByValue returns the live (unexpired and unrevoked) token of the given
+// type, along with its authorized scopes.
+func (s *MemoryTokensService) FindByValue(typ, token string) (*Token, error) {
+	s.store.mu.Lock()
+	defer s.store.mu.Unlock()
+
+	now := time.Now()
+	digest := HashToken(token)
+	for _, t := range s.store.tokens {
+		if t.Type == typ && t.Token == digest && isLive(t, now) {
+			found := copyToken(t)
+			found.Token = token
+			return found, nil
+		}
+	}
+
+	return nil, sql.ErrNoRows
+}
+
+// NewAccessToken records an access token issued to a user, as
+// LocalTokensService.NewAccessToken does.
+func (s *MemoryTokensService) NewAccessToken(clientId, userId int64, scope string, parent *Token) (*Token, error) {
+	return s.New(accessTokenParams(clientId, userId, scope, parent))
+}
+
+// Refresh records the use of refresh token t by application a, as
+// LocalTokensService.Refresh does.
+func (s *MemoryTokensService) Refresh(a *Application, t *Token) (*Token, error) {
+	authTime := t.CreatedAt
+	if t.AuthTime != nil {
+		authTime = *t.AuthTime
+	}
+	expiresAt := a.RefreshTokenExpiry(authTime)
+
+	value, err := RandomToken()
+	if err != nil {
+		return nil, err
+	}
+
+	s.store.mu.Lock()
+	defer s.store.mu.Unlock()
+
+	stored, ok := s.store.tokens[t.Id]
+	if !ok {
+		return nil, ErrInvalidGrant
+	}
+
+	if !a.RefreshTokenRotation {
+		stored.ExpiresAt = expiresAt
+		t.ExpiresAt = expiresAt
+		return t, nil
+	}
+
+	if stored.RotatedAt != nil || stored.RevokedAt != nil {
+		return nil, ErrInvalidGrant
+	}
+	now := time.Now()
+	stored.RotatedAt = &now
+
+	n := &Token{
+		ClientId:  t.ClientId,
+		UserId:    t.UserId,
+		FamilyId:  t.FamilyId,
+		Type:      "refresh_token",
+		Token:     value,
+		Scope:     t.Scope,
+		AuthTime:  t.AuthTime,
+		ExpiresAt: expiresAt,
+	}
+	s.store.createToken(n)
+
+	return n, nil
+}
+
+// RevokeUserTokens revokes every token the user has issued to the given
+// client, or to all clients if clientId is 0. It returns the ids of the
+// clients that lost tokens.
+func (s *MemoryTokensService) RevokeUserTokens(userId, clientId int64) ([]int64, error) {
+	s.store.mu.Lock()
+	defer s.store.mu.Unlock()
+
+	now := time.Now()
+	var clientIds []int64
+	seen := make(map[int64]bool)
+	for _, t := range s.store.tokens {
+		if t.UserId != userId || t.RevokedAt != nil || (clientId != 0 && t.ClientId != clientId) {
+			continue
+		}
+
+		t.RevokedAt = &now
+		if !seen[t.ClientId] {
+			seen[t.ClientId] = true
+			clientIds = append(clientIds, t.ClientId)
+		}
+	}
+
+	return clientIds, nil
+}
+
+// RevokeReused checks whether token is a refresh token that has already been
+// rotated, and if so revokes its whole family.
+func (s *MemoryTokensService) RevokeReused(clientId int64, token string) (bool, error) {
+	s.store.mu.Lock()
+	defer s.store.mu.Unlock()
+
+	digest := HashToken(token)
+	for _, t := range s.store.tokens {
+		if t.ClientId == clientId && t.Type == "refresh_token" && t.Token == digest && t.RotatedAt != nil {
+			s.store.revokeTokenFamily(copyToken(t).FamilyId)
+			return true, nil
+		}
+	}
+
+	return false, nil
+}
+
+// Revoke revokes a token issued to the given client, along with the rest of
+// its family. Revoking a token that doesn't exist (or has already been
+// revoked) is not an error.
+func (s *MemoryTokensService) Revoke(clientId int64, typ, token string) error {
+	s.store.mu.Lock()
+	defer s.store.mu.Unlock()
+
+	digest := HashToken(token)
+	for _, t := range s.store.tokens {
+		if t.ClientId == clientId && t.Type == typ && t.Token == digest && t.RevokedAt == nil {
+			s.store.revokeTokenFamily(copyToken(t).FamilyId)
+			return nil
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,288 @@
+package storage
+
+import (
+	"sort"
+	"strings"
+	"time"
+
+	"database/sql"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+type MemoryUsersService struct {
+	store *memoryStore
+}
+
+func (s *MemoryUsersService) FindById(id int64) (*User, error) {
+	s.store.mu.Lock()
+	defer s.store.mu.Unlock()
+
+	return s.findById(id)
+}
+
+func (s *MemoryUsersService) findById(id int64) (*User, error) {
+	u, ok := s.store.users[id]
+	if !ok {
+		return nil, sql.ErrNoRows
+	}
+
+	user := u.User
+	return &user, nil
+}
+
+func (s *MemoryUsersService) findByEmail(email string) *memoryUser {
+	for _, u := range s.store.users {
+		if u.Email == email {
+			return u
+		}
+	}
+
+	return nil
+}
+
+func (s *MemoryUsersService) FindByEmail(email string) (*User, error) {
+	s.store.mu.Lock()
+	defer s.store.mu.Unlock()
+
+	u := s.findByEmail(email)
+	if u == nil {
+		return nil, sql.ErrNoRows
+	}
+
+	user := u.User
+	return &user, nil
+}
+
+func (s *MemoryUsersService) FindByCredentials(email, password string) (*User, error) {
+	s.store.mu.Lock()
+	u := s.findByEmail(email)
+	s.store.mu.Unlock()
+
+	if u == nil {
+		return nil, sql.ErrNoRows
+	}
+
+	// Hash outside the lock: it's slow, and a user's password never changes.
+	err := bcrypt.CompareHashAndPassword([]byte(u.HashedPassword), []byte(password))
+	if err != nil {
+		return nil, err
+	}
+
+	user := u.User
+	return &user, nil
+}
+
+func (s *MemoryUsersService) New(params *UserParams) (*User, error) {
+	crypted, err := bcrypt.GenerateFromPassword([]byte(params.Password), DefaultPasswordCost)
+	if err != nil {
+		return nil, err
+	}
+
+	s.store.mu.Lock()
+	defer s.store.mu.Unlock()
+
+	if s.findByEmail(params.Email) != nil {
+		return nil, ErrNotUnique
+	}
+
+	u := &memoryUser{
+		User: User{
+			Id:         s.store.newId(),
+			Email:      params.Email,
+			Name:       params.Name,
+			GivenName:  params.GivenName,
+			FamilyName: params.FamilyName,
+			Locale:     params.Locale,
+			Picture:    params.Picture,
+		},
+		HashedPassword: string(crypted),
+	}
+	s.store.users[u.Id] = u
+
+	user := u.User
+	return &user, nil
+}
+
+// Update changes a user's profile, as LocalUsersService.Update does.
+func (s *MemoryUsersService) Update(u *User, params *UserParams) (*User, error) {
+	s.store.mu.Lock()
+	defer s.store.mu.Unlock()
+
+	stored, ok := s.store.users[u.Id]
+	if !ok {
+		return nil, sql.ErrNoRows
+	}
+
+	stored.Name = params.Name
+	stored.GivenName = params.GivenName
+	stored.FamilyName = params.FamilyName
+	stored.Locale = params.Locale
+	stored.Picture = params.Picture
+
+	user := stored.User
+	return &user, nil
+}
+
+func (s *MemoryUsersService) SetAdmin(u *User, admin bool) error {
+	s.store.mu.Lock()
+	defer s.store.mu.Unlock()
+
+	stored, ok := s.store.users[u.Id]
+	if !ok {
+		return sql.ErrNoRows
+	}
+	stored.Admin = admin
+
+	return nil
+}
+
+func (s *MemoryUsersService) Authorize(userId, clientId int64, scope string, refresh bool) (*Token, error) {
+	if !refresh {
+		return nil, nil
+	}
+
+	s.store.mu.Lock()
+	defer s.store.mu.Unlock()
+
+	a, ok := s.store.apps[clientId]
+	if !ok {
+		return nil, sql.ErrNoRows
+	}
+
+	// The user has just presented their credentials.
+	authTime := time.Now()
+	return s.store.newToken(&TokenParams{
+		ClientId:  clientId,
+		UserId:    userId,
+		Type:      "refresh_token",
+		Scope:     scope,
+		AuthTime:  &authTime,
+		ExpiresAt: a.RefreshTokenExpiry(authTime),
+	})
+}
+
+// Consent returns the scopes the user has previously agreed to grant the
+// application, if any.
+func (s *MemoryUsersService) Consent(userId, clientId int64) (string, error) {
+	s.store.mu.Lock()
+	defer s.store.mu.Unlock()
+
+	if c, ok := s.store.consents[memoryConsentKey{userId, clientId}]; ok {
+		return c.Scope, nil
+	}
+
+	return "", nil
+}
+
+// RememberConsent records that the user has agreed to grant the application
+// the given scopes, in addition to any they agreed to before.
+func (s *MemoryUsersService) RememberConsent(userId, clientId int64, scope string) error {
+	s.store.mu.Lock()
+	defer s.store.mu.Unlock()
+
+	key := memoryConsentKey{userId, clientId}
+	c, ok := s.store.consents[key]
+	if !ok {
+		c = &memoryConsent{}
+		s.store.consents[key] = c
+	}
+
+	scopes := strings.Fields(c.Scope)
+	for _, name := range strings.Fields(scope) {
+		if !strings.Contains(" "+c.Scope+" ", " "+name+" ") {
+			scopes = append(scopes, name)
+		}
+	}
+	c.Scope = strings.Join(scopes, " ")
+	c.UpdatedAt = time.Now()
+
+	return nil
+}
+
+// Authorizations lists the applications the user has granted access to, as
+// LocalUsersService.Authorizations does.
+func (s *MemoryUsersService) Authorizations(userId int64) ([]*Authorization, error) {
+	s.store.mu.Lock()
+	defer s.store.mu.Unlock()
+
+	var clientIds []int64
+	byClient := make(map[int64]*Authorization)
+	add := func(clientId int64, scope string, updatedAt time.Time) {
+		a, ok := s.store.apps[clientId]
+		if !ok {
+			return
+		}
+
+		auth, ok := byClient[clientId]
+		if !ok {
+			auth = &Authorization{
+				ClientId:    a.ClientId,
+				Name:        a.Name,
+				Description: a.Description,
+				Website:     a.Website,
+				Logo:        a.Logo,
+			}
+			byClient[clientId] = auth
+			clientIds = append(clientIds, clientId)
+		}
+
+		for _, name := range strings.Fields(scope) {
+			if !strings.Contains(" "+auth.Scope+" ", " "+name+" ") {
+				auth.Scope = strings.TrimSpace(auth.Scope + " " + name)
+			}
+		}
+		if updatedAt.After(auth.UpdatedAt) {
+			auth.UpdatedAt = updatedAt
+		}
+	}
+
+	for key, c := range s.store.consents {
+		if key.UserId == userId {
+			add(key.ClientId, c.Scope, c.UpdatedAt)
+		}
+	}
+
+	now := time.Now()
+	for _, t := range s.store.tokens {
+		if t.UserId == userId && t.Scope != "" && isLive(t, now) {
+			add(t.ClientId, t.Scope, t.CreatedAt)
+		}
+	}
+
+	// List applications in the order they were registered.
+	sort.Sort(int64s(clientIds))
+	var auths []*Authorization
+	for _, id := range clientIds {
+		auths = append(auths, byClient[id])
+	}
+
+	return auths, nil
+}
+
+// RevokeAuthorization withdraws all access the user has granted the
+// application.
+func (s *MemoryUsersService) RevokeAuthorization(userId, clientId int64) error {
+	s.store.mu.Lock()
+	defer s.store.mu.Unlock()
+
+	now := time.Now()
+	for _, t := range s.store.tokens {
+		if t.UserId == userId && t.ClientId == clientId && t.RevokedAt == nil {
+			t.RevokedAt = &now
+		}
+	}
+	for code, c := range s.store.authCodes {
+		if c.UserId == userId && c.ClientId == clientId {
+			delete(s.store.authCodes, code)
+		}
+	}
+	for id, c := range s.store.deviceCodes {
+		if c.UserId == userId && c.ClientId == clientId {
+			delete(s.store.deviceCodes, id)
+		}
+	}
+	delete(s.store.consents, memoryConsentKey{userId, clientId})
+
+	return nil
+}
@@ -0,0 +1,745 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"time"
+)
+
+// Migration is one step in the evolution of the database schema. Each
+// migration has SQL for each database driver (named as in sqlx, e.g.
+// "postgres" or "sqlite3"); the SQL may hold several statements. Changes to
+// data that are easier to make in Go than in every dialect of SQL go in
+// UpFunc, which runs after the SQL, in the same transaction.
+type Migration struct {
+	Version     int
+	Description string
+	Up          map[string]string
+	UpFunc      func(tx Tx) error
+	Down        map[string]string
+}
+
+// MigrationStatus describes a migration and when (if ever) it was applied.
+type MigrationStatus struct {
+	*Migration
+	AppliedAt *time.Time
+}
+
+var errNoSchema = errors.New("this storage driver has no schema to migrate")
+
+// The scopes registrar understands, and the primary client, which may request
+// all of them.
+const seedSql = `
+INSERT INTO scopes (name, friendly_name, description)
+SELECT * FROM (VALUES
+  ('openid', 'OpenID', 'Your OpenID identity information'),
+  ('email', 'email', 'Your email address'),
+  ('profile', 'profile', 'Your profile information'),
+  ('admin', 'administration', 'Access to administration endpoints')
+) AS s WHERE NOT EXISTS (SELECT 1 FROM scopes);
+
+INSERT INTO applications (name, description, website, logo, client_type, client_id, client_secret)
+SELECT 'Ibex', '', '', '', 'secret', '2ddc784a1d3b452155647cac1becced6d41fcb9924ae92b2771481e90d1767c1',
+  '$2a$12$s5qwHNvwnmD2nafr9aTGge5eJgIsPyv7zIABZUxsBRbItLiOr3kS2'
+WHERE NOT EXISTS (SELECT 1 FROM applications);
+
+INSERT INTO permitted_scopes (scope_id, client_id)
+SELECT s.id, a.id FROM scopes s, applications a
+WHERE a.name = 'Ibex' AND NOT EXISTS (SELECT 1 FROM permitted_scopes);
+`
+
+// Migrations, oldest first. Never edit a migration once it has been released;
+// add another one instead.
+//
+// The first Postgres migrations only create what doesn't exist yet, so that
+// databases loaded from the schema.sql dump that preceded them can be
+// migrated too. SQLite support arrived with the second, so the first SQLite
+// migration creates everything.
+var migrations = []*Migration{
+	{
+		Version:     1,
+		Description: "initial schema",
+		Up: map[string]string{
+			"postgres": `
+CREATE TABLE IF NOT EXISTS applications (
+    id serial PRIMARY KEY,
+    name character varying(510) NOT NULL,
+    description text,
+    website character varying(510) DEFAULT NULL,
+    logo character varying(510) DEFAULT NULL,
+    client_type character varying(510) NOT NULL,
+    client_id character varying(510) NOT NULL,
+    client_secret character varying(510) NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS authorized_scopes (
+    id serial PRIMARY KEY,
+    oauth_token_id integer NOT NULL,
+    scope_id integer NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS oauth_tokens (
+    id serial PRIMARY KEY,
+    client_id integer NOT NULL,
+    user_id integer NOT NULL,
+    type character varying(510) NOT NULL,
+    token character varying(510) NOT NULL,
+    expires_at timestamp with time zone
+);
+
+CREATE TABLE IF NOT EXISTS permitted_scopes (
+    id serial PRIMARY KEY,
+    client_id integer NOT NULL,
+    scope_id integer NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS registered_redirects (
+    id serial PRIMARY KEY,
+    client_id integer NOT NULL,
+    url character varying(510) NOT NULL,
+    response_type character varying(510) NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS scopes (
+    id serial PRIMARY KEY,
+    name character varying(510) NOT NULL,
+    friendly_name character varying(510) NOT NULL,
+    description character varying(510) NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS users (
+    id serial PRIMARY KEY,
+    email character varying(510) NOT NULL UNIQUE,
+    password character varying(510) NOT NULL
+);
+` + seedSql,
+			"sqlite3": `
+CREATE TABLE applications (
+    id integer PRIMARY KEY AUTOINCREMENT,
+    name varchar(510) NOT NULL,
+    description text,
+    website varchar(510) DEFAULT NULL,
+    logo varchar(510) DEFAULT NULL,
+    client_type varchar(510) NOT NULL,
+    client_id varchar(510) NOT NULL,
+    client_secret varchar(510) NOT NULL,
+    userinfo_signed_response_alg varchar(16) DEFAULT '' NOT NULL,
+    refresh_token_rotation boolean DEFAULT 0 NOT NULL,
+    refresh_token_lifetime integer DEFAULT 0 NOT NULL,
+    refresh_token_idle_lifetime integer DEFAULT 0 NOT NULL,
+    jwks text DEFAULT '' NOT NULL,
+    token_endpoint_auth_method varchar(32) DEFAULT 'client_secret_basic' NOT NULL,
+    grant_types text DEFAULT 'authorization_code' NOT NULL,
+    response_types text DEFAULT 'code' NOT NULL,
+    registration_access_token varchar(510) DEFAULT '' NOT NULL,
+    post_logout_redirect_uris text DEFAULT '' NOT NULL,
+    backchannel_logout_uri varchar(2048) DEFAULT '' NOT NULL
+);
+
+CREATE TABLE authorization_codes (
+    id integer PRIMARY KEY AUTOINCREMENT,
+    client_id integer NOT NULL,
+    user_id integer NOT NULL,
+    code varchar(510) NOT NULL UNIQUE,
+    redirect_uri varchar(2048) NOT NULL,
+    scope text DEFAULT '' NOT NULL,
+    code_challenge varchar(128) DEFAULT '' NOT NULL,
+    code_challenge_method varchar(16) DEFAULT '' NOT NULL,
+    nonce varchar(510) DEFAULT '' NOT NULL,
+    auth_time timestamp NOT NULL,
+    expires_at timestamp NOT NULL
+);
+
+CREATE TABLE authorized_scopes (
+    id integer PRIMARY KEY AUTOINCREMENT,
+    oauth_token_id integer NOT NULL,
+    scope_id integer NOT NULL
+);
+
+CREATE TABLE client_assertions (
+    id integer PRIMARY KEY AUTOINCREMENT,
+    client_id integer NOT NULL,
+    jti varchar(510) NOT NULL,
+    expires_at timestamp NOT NULL,
+    UNIQUE (client_id, jti)
+);
+
+CREATE TABLE consents (
+    id integer PRIMARY KEY AUTOINCREMENT,
+    user_id integer NOT NULL,
+    client_id integer NOT NULL,
+    scope text DEFAULT '' NOT NULL,
+    updated_at timestamp DEFAULT CURRENT_TIMESTAMP NOT NULL,
+    UNIQUE (user_id, client_id)
+);
+
+CREATE TABLE device_codes (
+    id integer PRIMARY KEY AUTOINCREMENT,
+    client_id integer NOT NULL,
+    user_id integer,
+    device_code varchar(510) NOT NULL UNIQUE,
+    user_code varchar(16) NOT NULL UNIQUE,
+    scope text DEFAULT '' NOT NULL,
+    status varchar(16) DEFAULT 'pending' NOT NULL,
+    poll_interval integer NOT NULL,
+    last_polled_at timestamp,
+    auth_time timestamp,
+    expires_at timestamp NOT NULL
+);
+
+CREATE TABLE oauth_tokens (
+    id integer PRIMARY KEY AUTOINCREMENT,
+    client_id integer NOT NULL,
+    user_id integer,
+    type varchar(510) NOT NULL,
+    token varchar(510) NOT NULL,
+    parent_id integer,
+    family_id integer,
+    created_at timestamp DEFAULT CURRENT_TIMESTAMP NOT NULL,
+    auth_time timestamp,
+    expires_at timestamp,
+    rotated_at timestamp,
+    revoked_at timestamp
+);
+
+CREATE TABLE permitted_scopes (
+    id integer PRIMARY KEY AUTOINCREMENT,
+    client_id integer NOT NULL,
+    scope_id integer NOT NULL
+);
+
+CREATE TABLE registered_redirects (
+    id integer PRIMARY KEY AUTOINCREMENT,
+    client_id integer NOT NULL,
+    url varchar(510) NOT NULL,
+    response_type varchar(510) NOT NULL,
+    UNIQUE (client_id, url, response_type)
+);
+
+CREATE TABLE scopes (
+    id integer PRIMARY KEY AUTOINCREMENT,
+    name varchar(510) NOT NULL,
+    friendly_name varchar(510) NOT NULL,
+    description varchar(510) NOT NULL
+);
+
+CREATE TABLE token_exchange_policies (
+    id integer PRIMARY KEY AUTOINCREMENT,
+    client_id integer NOT NULL,
+    audience varchar(510) NOT NULL,
+    scope text DEFAULT '' NOT NULL,
+    UNIQUE (client_id, audience)
+);
+
+CREATE TABLE users (
+    id integer PRIMARY KEY AUTOINCREMENT,
+    email varchar(510) NOT NULL UNIQUE,
+    password varchar(510) NOT NULL
+);
+` + seedSql,
+		},
+		Down: map[string]string{
+			"postgres": `
+DROP TABLE IF EXISTS applications;
+DROP TABLE IF EXISTS authorized_scopes;
+DROP TABLE IF EXISTS oauth_tokens;
+DROP TABLE IF EXISTS permitted_scopes;
+DROP TABLE IF EXISTS registered_redirects;
+DROP TABLE IF EXISTS scopes;
+DROP TABLE IF EXISTS users;
+`,
+			"sqlite3": `
+DROP TABLE applications;
+DROP TABLE authorization_codes;
+DROP TABLE authorized_scopes;
+DROP TABLE client_assertions;
+DROP TABLE consents;
+DROP TABLE device_codes;
+DROP TABLE oauth_tokens;
+DROP TABLE permitted_scopes;
+DROP TABLE registered_redirects;
+DROP TABLE scopes;
+DROP TABLE token_exchange_policies;
+DROP TABLE users;
+`,
+		},
+	},
+	{
+		Version:     2,
+		Description: "token lifecycle, codes, client registration, consent and logout",
+		Up: map[string]string{
+			"postgres": `
+ALTER TABLE applications
+    ADD COLUMN IF NOT EXISTS userinfo_signed_response_alg character varying(16) DEFAULT '' NOT NULL,
+    ADD COLUMN IF NOT EXISTS refresh_token_rotation boolean DEFAULT false NOT NULL,
+    ADD COLUMN IF NOT EXISTS refresh_token_lifetime integer DEFAULT 0 NOT NULL,
+    ADD COLUMN IF NOT EXISTS refresh_token_idle_lifetime integer DEFAULT 0 NOT NULL,
+    ADD COLUMN IF NOT EXISTS jwks text DEFAULT '' NOT NULL,
+    ADD COLUMN IF NOT EXISTS token_endpoint_auth_method character varying(32) DEFAULT 'client_secret_basic' NOT NULL,
+    ADD COLUMN IF NOT EXISTS grant_types text DEFAULT 'authorization_code' NOT NULL,
+    ADD COLUMN IF NOT EXISTS response_types text DEFAULT 'code' NOT NULL,
+    ADD COLUMN IF NOT EXISTS registration_access_token character varying(510) DEFAULT '' NOT NULL,
+    ADD COLUMN IF NOT EXISTS post_logout_redirect_uris text DEFAULT '' NOT NULL,
+    ADD COLUMN IF NOT EXISTS backchannel_logout_uri character varying(2048) DEFAULT '' NOT NULL;
+
+-- Tokens issued to clients on their own behalf have no user.
+ALTER TABLE oauth_tokens
+    ALTER COLUMN user_id DROP NOT NULL,
+    ADD COLUMN IF NOT EXISTS parent_id integer,
+    ADD COLUMN IF NOT EXISTS family_id integer,
+    ADD COLUMN IF NOT EXISTS created_at timestamp with time zone DEFAULT now() NOT NULL,
+    ADD COLUMN IF NOT EXISTS auth_time timestamp with time zone,
+    ADD COLUMN IF NOT EXISTS rotated_at timestamp with time zone,
+    ADD COLUMN IF NOT EXISTS revoked_at timestamp with time zone;
+
+CREATE UNIQUE INDEX IF NOT EXISTS registered_redirects_client_id_url_response_type_key
+    ON registered_redirects (client_id, url, response_type);
+
+CREATE TABLE IF NOT EXISTS authorization_codes (
+    id serial PRIMARY KEY,
+    client_id integer NOT NULL,
+    user_id integer NOT NULL,
+    code character varying(510) NOT NULL UNIQUE,
+    redirect_uri character varying(2048) NOT NULL,
+    scope text DEFAULT '' NOT NULL,
+    code_challenge character varying(128) DEFAULT '' NOT NULL,
+    code_challenge_method character varying(16) DEFAULT '' NOT NULL,
+    nonce character varying(510) DEFAULT '' NOT NULL,
+    auth_time timestamp with time zone NOT NULL,
+    expires_at timestamp with time zone NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS client_assertions (
+    id serial PRIMARY KEY,
+    client_id integer NOT NULL,
+    jti character varying(510) NOT NULL,
+    expires_at timestamp with time zone NOT NULL,
+    UNIQUE (client_id, jti)
+);
+
+CREATE TABLE IF NOT EXISTS consents (
+    id serial PRIMARY KEY,
+    user_id integer NOT NULL,
+    client_id integer NOT NULL,
+    scope text DEFAULT '' NOT NULL,
+    updated_at timestamp with time zone DEFAULT now() NOT NULL,
+    UNIQUE (user_id, client_id)
+);
+
+CREATE TABLE IF NOT EXISTS device_codes (
+    id serial PRIMARY KEY,
+    client_id integer NOT NULL,
+    user_id integer,
+    device_code character varying(510) NOT NULL UNIQUE,
+    user_code character varying(16) NOT NULL UNIQUE,
+    scope text DEFAULT '' NOT NULL,
+    status character varying(16) DEFAULT 'pending' NOT NULL,
+    poll_interval integer NOT NULL,
+    last_polled_at timestamp with time zone,
+    auth_time timestamp with time zone,
+    expires_at timestamp with time zone NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS token_exchange_policies (
+    id serial PRIMARY KEY,
+    client_id integer NOT NULL,
+    audience character varying(510) NOT NULL,
+    scope text DEFAULT '' NOT NULL,
+    UNIQUE (client_id, audience)
+);
+`,
+			"sqlite3": ``,
+		},
+		Down: map[string]string{
+			"postgres": `
+DROP TABLE IF EXISTS authorization_codes;
+DROP TABLE IF EXISTS client_assertions;
+DROP TABLE IF EXISTS consents;
+DROP TABLE IF EXISTS device_codes;
+DROP TABLE IF EXISTS token_exchange_policies;
+
+ALTER TABLE registered_redirects
+    DROP CONSTRAINT IF EXISTS registered_redirects_client_id_url_response_type_key;
+DROP INDEX IF EXISTS registered_redirects_client_id_url_response_type_key;
+
+DELETE FROM authorized_scopes WHERE oauth_token_id IN
+  (SELECT id FROM oauth_tokens WHERE user_id IS NULL);
+DELETE FROM oauth_tokens WHERE user_id IS NULL;
+ALTER TABLE oauth_tokens
+    ALTER COLUMN user_id SET NOT NULL,
+    DROP COLUMN IF EXISTS parent_id,
+    DROP COLUMN IF EXISTS family_id,
+    DROP COLUMN IF EXISTS created_at,
+    DROP COLUMN IF EXISTS auth_time,
+    DROP COLUMN IF EXISTS rotated_at,
+    DROP COLUMN IF EXISTS revoked_at;
+
+ALTER TABLE applications
+    DROP COLUMN IF EXISTS userinfo_signed_response_alg,
+    DROP COLUMN IF EXISTS refresh_token_rotation,
+    DROP COLUMN IF EXISTS refresh_token_lifetime,
+    DROP COLUMN IF EXISTS refresh_token_idle_lifetime,
+    DROP COLUMN IF EXISTS jwks,
+    DROP COLUMN IF EXISTS token_endpoint_auth_method,
+    DROP COLUMN IF EXISTS grant_types,
+    DROP COLUMN IF EXISTS response_types,
+    DROP COLUMN IF EXISTS registration_access_token,
+    DROP COLUMN IF EXISTS post_logout_redirect_uris,
+    DROP COLUMN IF EXISTS backchannel_logout_uri;
+`,
+			"sqlite3": ``,
+		},
+	},
+	{
+		Version:     3,
+		Description: "store secrets hashed",
+		Up: map[string]string{
+			"postgres": ``,
+			"sqlite3":  ``,
+		},
+		UpFunc: hashSecrets,
+		// Hashing can't be undone, so the secrets that were hashed are thrown
+		// away: users and clients will have to authorize again, and dynamically
+		// registered clients lose the ability to manage their registrations.
+		Down: map[string]string{
+			"postgres": revokeHashedSecretsSql,
+			"sqlite3":  revokeHashedSecretsSql,
+		},
+	},
+	{
+		Version:     4,
+		Description: "user profiles",
+		Up: map[string]string{
+			"postgres": `
+ALTER TABLE users
+    ADD COLUMN email_verified boolean DEFAULT false NOT NULL,
+    ADD COLUMN name character varying(510) DEFAULT '' NOT NULL,
+    ADD COLUMN given_name character varying(510) DEFAULT '' NOT NULL,
+    ADD COLUMN family_name character varying(510) DEFAULT '' NOT NULL,
+    ADD COLUMN locale character varying(35) DEFAULT '' NOT NULL,
+    ADD COLUMN picture character varying(2048) DEFAULT '' NOT NULL;
+`,
+			"sqlite3": `
+ALTER TABLE users ADD COLUMN email_verified boolean DEFAULT 0 NOT NULL;
+ALTER TABLE users ADD COLUMN name varchar(510) DEFAULT '' NOT NULL;
+ALTER TABLE users ADD COLUMN given_name varchar(510) DEFAULT '' NOT NULL;
+ALTER TABLE users ADD COLUMN family_name varchar(510) DEFAULT '' NOT NULL;
+ALTER TABLE users ADD COLUMN locale varchar(35) DEFAULT '' NOT NULL;
+ALTER TABLE users ADD COLUMN picture varchar(2048) DEFAULT '' NOT NULL;
+`,
+		},
+		Down: map[string]string{
+			"postgres": `
+ALTER TABLE users
+    DROP COLUMN email_verified,
+    DROP COLUMN name,
+    DROP COLUMN given_name,
+    DROP COLUMN family_name,
+    DROP COLUMN locale,
+    DROP COLUMN picture;
+`,
+			"sqlite3": `
+ALTER TABLE users DROP COLUMN email_verified;
+ALTER TABLE users DROP COLUMN name;
+ALTER TABLE users DROP COLUMN given_name;
+ALTER TABLE users DROP COLUMN family_name;
+ALTER TABLE users DROP COLUMN locale;
+ALTER TABLE users DROP COLUMN picture;
+`,
+		},
+	},
+	{
+		Version:     5,
+		Description: "jwt bearer grant subjects",
+		Up: map[string]string{
+			"postgres": `
+CREATE TABLE assertion_subjects (
+    id serial PRIMARY KEY,
+    client_id integer NOT NULL,
+    subject character varying(510) NOT NULL,
+    UNIQUE (client_id, subject)
+);
+`,
+			"sqlite3": `
+CREATE TABLE assertion_subjects (
+    id integer PRIMARY KEY AUTOINCREMENT,
+    client_id integer NOT NULL,
+    subject varchar(510) NOT NULL,
+    UNIQUE (client_id, subject)
+);
+`,
+		},
+		Down: map[string]string{
+			"postgres": `DROP TABLE assertion_subjects;`,
+			"sqlite3":  `DROP TABLE assertion_subjects;`,
+		},
+	},
+	{
+		// Clients are now held to the grant types they registered for.
+		// Clients that were never registered (e.g. the seeded Ibex client)
+		// keep the grants every client could use before registration existed.
+		Version:     6,
+		Description: "grant types for unregistered clients",
+		Up: map[string]string{
+			"postgres": legacyGrantTypesSql,
+			"sqlite3":  legacyGrantTypesSql,
+		},
+		Down: map[string]string{
+			"postgres": revokeLegacyGrantTypesSql,
+			"sqlite3":  revokeLegacyGrantTypesSql,
+		},
+	},
+	{
+		Version:     7,
+		Description: "admin role",
+		Up: map[string]string{
+			"postgres": `ALTER TABLE users ADD COLUMN admin boolean DEFAULT false NOT NULL;`,
+			"sqlite3":  `ALTER TABLE users ADD COLUMN admin boolean DEFAULT 0 NOT NULL;`,
+		},
+		Down: map[string]string{
+			"postgres": `ALTER TABLE users DROP COLUMN admin;`,
+			"sqlite3":  `ALTER TABLE users DROP COLUMN admin;`,
+		},
+	},
+}
+
+const legacyGrantTypesSql = `UPDATE applications
+SET grant_types = 'authorization_code refresh_token client_credentials password'
+WHERE registration_access_token = '' AND grant_types = 'authorization_code';`
+
+const revokeLegacyGrantTypesSql = `UPDATE applications SET grant_types = 'authorization_code'
+WHERE registration_access_token = ''
+  AND grant_types = 'authorization_code refresh_token client_credentials password';`
+
+// The columns holding secrets that are stored hashed (see HashToken). Device
+// user codes are left alone: they are short enough to guess, and only live
+// for a few minutes.
+var hashedColumns = []struct{ table, column string }{
+	{"applications", "registration_access_token"},
+	{"authorization_codes", "code"},
+	{"device_codes", "device_code"},
+	{"oauth_tokens", "token"},
+}
+
+func hashSecrets(tx Tx) error {
+	for _, c := range hashedColumns {
+		var rows []struct {
+			Id    int64
+			Value string
+		}
+		err := tx.Select(&rows, fmt.Sprintf("SELECT id, %s AS value FROM %s WHERE %s <> ''", c.column, c.table, c.column))
+		if err != nil {
+			return err
+		}
+
+		update := fmt.Sprintf("UPDATE %s SET %s = $2 WHERE id = $1", c.table, c.column)
+		for _, row := range rows {
+			_, err = tx.Exec(update, row.Id, HashToken(row.Value))
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+const revokeHashedSecretsSql = `
+DELETE FROM authorized_scopes;
+DELETE FROM oauth_tokens;
+DELETE FROM authorization_codes;
+DELETE FROM device_codes;
+UPDATE applications SET registration_access_token = '';
+`
+
+// LatestSchemaVersion is the schema version this build of registrar expects.
+func LatestSchemaVersion() int {
+	return migrations[len(migrations)-1].Version
+}
+
+var createSchemaVersionSqls = map[string]string{
+	"postgres": `CREATE TABLE IF NOT EXISTS schema_version (
+    version integer PRIMARY KEY,
+    applied_at timestamp with time zone NOT NULL
+)`,
+	"sqlite3": `CREATE TABLE IF NOT EXISTS schema_version (
+    version integer PRIMARY KEY,
+    applied_at timestamp NOT NULL
+)`,
+}
+
+const schemaVersionSql = `SELECT COALESCE(MAX(version), 0) FROM schema_version`
+const appliedMigrationsSql = `SELECT version, applied_at FROM schema_version ORDER BY version`
+const recordMigrationSql = `INSERT INTO schema_version (version, applied_at) VALUES ($1, $2)`
+const forgetMigrationSql = `DELETE FROM schema_version WHERE version = $1`
+
+// SchemaVersion returns the version of the newest migration applied to the
+// database, or 0 if none have been.
+func (c *Client) SchemaVersion() (int, error) {
+	if c.db == nil {
+		return 0, errNoSchema
+	}
+
+	var version int
+	err := c.db.QueryRow(schemaVersionSql).Scan(&version)
+	if translateError(err) == ErrUndefinedTable {
+		return 0, nil
+	} else if err != nil {
+		log.Println("SchemaVersion:", err)
+		return 0, err
+	}
+
+	return version, nil
+}
+
+// CheckSchema returns an error unless the database schema is exactly the
+// version this build of registrar expects.
+func (c *Client) CheckSchema() error {
+	if c.db == nil {
+		return nil
+	}
+
+	version, err := c.SchemaVersion()
+	if err != nil {
+		return err
+	}
+
+	latest := LatestSchemaVersion()
+	if version < latest {
+		return fmt.Errorf("Database schema is out of date (version %d, need %d); run `registrar migrate up`", version, latest)
+	} else if version > latest {
+		return fmt.Errorf("Database schema (version %d) is newer than this version of registrar supports (version %d)", version, latest)
+	}
+
+	return nil
+}
+
+// Migrations lists every migration, along with when it was applied.
+func (c *Client) Migrations() ([]*MigrationStatus, error) {
+	if c.db == nil {
+		return nil, errNoSchema
+	}
+
+	var applied []struct {
+		Version   int
+		AppliedAt time.Time
+	}
+	err := c.db.Select(&applied, appliedMigrationsSql)
+	if err != nil && translateError(err) != ErrUndefinedTable {
+		log.Println("Migrations:", err)
+		return nil, err
+	}
+
+	var statuses []*MigrationStatus
+	for _, m := range migrations {
+		status := &MigrationStatus{Migration: m}
+		for _, a := range applied {
+			if a.Version == m.Version {
+				appliedAt := a.AppliedAt
+				status.AppliedAt = &appliedAt
+			}
+		}
+		statuses = append(statuses, status)
+	}
+
+	return statuses, nil
+}
+
+// MigrateUp applies every pending migration, each in its own transaction, and
+// returns the migrations it applied.
+func (c *Client) MigrateUp() ([]*Migration, error) {
+	if c.db == nil {
+		return nil, errNoSchema
+	}
+
+	_, err := c.db.Exec(createSchemaVersionSqls[c.db.DriverName()])
+	if err != nil {
+		log.Println("MigrateUp: failed creating schema_version:", err)
+		return nil, err
+	}
+
+	version, err := c.SchemaVersion()
+	if err != nil {
+		return nil, err
+	}
+
+	var applied []*Migration
+	for _, m := range migrations {
+		if m.Version <= version {
+			continue
+		}
+
+		err = c.migrate(m.Up, m.UpFunc, recordMigrationSql, m.Version, time.Now())
+		if err != nil {
+			return applied, fmt.Errorf("migration %d (%s) failed: %s", m.Version, m.Description, err)
+		}
+		applied = append(applied, m)
+	}
+
+	return applied, nil
+}
+
+// MigrateDown reverts the newest applied migration, and returns it.
+func (c *Client) MigrateDown() (*Migration, error) {
+	if c.db == nil {
+		return nil, errNoSchema
+	}
+
+	version, err := c.SchemaVersion()
+	if err != nil {
+		return nil, err
+	}
+
+	for _, m := range migrations {
+		if m.Version != version {
+			continue
+		}
+
+		err = c.migrate(m.Down, nil, forgetMigrationSql, m.Version)
+		if err != nil {
+			return nil, fmt.Errorf("reverting migration %d (%s) failed: %s", m.Version, m.Description, err)
+		}
+		return m, nil
+	}
+
+	return nil, fmt.Errorf("no migration to revert (schema version %d)", version)
+}
+
+// migrate runs one direction of a migration, and records the change in
+// schema_version, in a single transaction.
+func (c *Client) migrate(sqls map[string]string, fn func(tx Tx) error, record string, args ...interface{}) error {
+	query, ok := sqls[c.db.DriverName()]
+	if !ok {
+		return fmt.Errorf("no SQL for driver %q", c.db.DriverName())
+	}
+
+	tx, err := c.db.Begin()
+	if err != nil {
+		return err
+	}
+
+	if query != "" {
+		_, err = tx.Exec(query)
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+
+	if fn != nil {
+		err = fn(tx)
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+
+	_, err = tx.Exec(record, args...)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	return tx.Commit()
+}
@@ -0,0 +1,156 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestMigrateDownAndUp(t *testing.T) {
+	c, done := testSqliteClient(t)
+	defer done()
+
+	for version := LatestSchemaVersion(); version > 0; version-- {
+		m, err := c.MigrateDown()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if m.Version != version {
+			t.Fatalf("expected migration %d to be reverted, got %d", version, m.Version)
+		}
+
+		if err := c.CheckSchema(); err == nil {
+			t.Errorf("expected schema version %d to be out of date", version-1)
+		}
+	}
+
+	_, err := c.MigrateDown()
+	if err == nil {
+		t.Errorf("expected nothing to revert")
+	}
+
+	applied, err := c.MigrateUp()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(applied) != len(migrations) {
+		t.Errorf("expected %d migrations to be applied, got %d", len(migrations), len(applied))
+	}
+
+	err = c.CheckSchema()
+	if err != nil {
+		t.Error(err)
+	}
+}
+
+func TestHashSecrets(t *testing.T) {
+	c, done := testSqliteClient(t)
+	defer done()
+
+	user, err := c.Users.New(&UserParams{Email: "paul@example.com", Password: "hunter2"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	app, err := c.Apps.New(&ApplicationParams{
+		Name:                    "Test",
+		TokenEndpointAuthMethod: "client_secret_basic",
+		Scope:                   "openid",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	refresh, err := c.Tokens.New(&TokenParams{ClientId: app.Id, UserId: user.Id, Type: "refresh_token", Scope: "openid"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	code, err := c.Apps.NewAuthCode(app, user.Id, &AuthCodeParams{
+		RedirectUri: "https://app.example.com/cb",
+		Scope:       "openid",
+		AuthTime:    time.Now(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	device, err := c.Apps.NewDeviceCode(app, "openid")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Each secret, and how to look it up by its plain value.
+	cases := []struct {
+		table  string
+		column string
+		id     int64
+		value  string
+		lookup func() error
+	}{
+		{"applications", "registration_access_token", app.Id, app.RegistrationAccessToken, func() error {
+			found, err := c.Apps.FindById(app.Id)
+			if err == nil && !found.VerifyRegistrationAccessToken(app.RegistrationAccessToken) {
+				err = errors.New("registration access token doesn't verify")
+			}
+			return err
+		}},
+		{"oauth_tokens", "token", refresh.Id, refresh.Token, func() error {
+			_, err := c.Tokens.FindByValue("refresh_token", refresh.Token)
+			return err
+		}},
+		{"authorization_codes", "code", code.Id, code.Code, func() error {
+			_, _, err := c.Apps.ExchangeAuthCode(app, code.Code, code.RedirectUri, "")
+			return err
+		}},
+		{"device_codes", "device_code", device.Id, device.DeviceCode, func() error {
+			_, _, err := c.Apps.ExchangeDeviceCode(app, device.DeviceCode)
+			if err == ErrAuthorizationPending {
+				return nil
+			}
+			return err
+		}},
+	}
+
+	// Secrets are never stored in plain text.
+	for _, tc := range cases {
+		var stored string
+		err := c.db.Get(&stored, fmt.Sprintf("SELECT %s FROM %s WHERE id = $1", tc.column, tc.table), tc.id)
+		if err != nil {
+			t.Fatalf("%s: %s", tc.table, err)
+		}
+		if stored != HashToken(tc.value) {
+			t.Errorf("%s: expected %s to be stored hashed", tc.table, tc.column)
+		}
+	}
+
+	// Secrets stored in plain text by earlier versions are hashed by the
+	// migration, and can then be looked up as if they had been issued since.
+	for _, tc := range cases {
+		_, err := c.db.Exec(fmt.Sprintf("UPDATE %s SET %s = $2 WHERE id = $1", tc.table, tc.column), tc.id, tc.value)
+		if err != nil {
+			t.Fatalf("%s: %s", tc.table, err)
+		}
+	}
+
+	tx, err := c.db.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = hashSecrets(tx)
+	if err != nil {
+		tx.Rollback()
+		t.Fatal(err)
+	}
+	err = tx.Commit()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range cases {
+		if err := tc.lookup(); err != nil {
+			t.Errorf("%s: expected to find %s by its plain value after hashing: %s", tc.table, tc.column, err)
+		}
+	}
+}
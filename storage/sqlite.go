@@ -0,0 +1,151 @@
+package storage
+
+import (
+	"bytes"
+	"fmt"
+	"time"
+
+	"database/sql"
+
+	"github.com/jmoiron/sqlx"
+)
+
+func init() {
+	Register("sqlite", openSqlite)
+}
+
+// openSqlite opens the SQLite database file named by the database setting.
+// Writers wait for each other rather than failing, and transactions take the
+// write lock up front, so that two transactions can't deadlock upgrading
+// their read locks.
+func openSqlite(cfg *Config) (*Client, error) {
+	dsn := fmt.Sprintf("file:%s?_busy_timeout=5000&_txlock=immediate&_journal_mode=WAL", cfg.Database.Database)
+	lite, err := sqlx.Open("sqlite3", dsn)
+	if err != nil {
+		return nil, fmt.Errorf("Failed opening SQLite database: %s", err)
+	}
+
+	lite.SetMaxOpenConns(sqlitePoolSize(cfg))
+
+	err = lite.Ping()
+	if err != nil {
+		return nil, fmt.Errorf("Failed opening SQLite database: %s", err)
+	}
+
+	c := &Client{db: &SqliteDatabase{lite}}
+	c.Apps = &LocalApplicationsService{c}
+	c.Tokens = &LocalTokensService{c}
+	c.Users = &LocalUsersService{c}
+
+	return c, nil
+}
+
+// sqlitePoolSize returns the connection pool size for a SQLite database (0 is
+// unlimited). Every connection to an in-memory database gets a database of
+// its own, so those are limited to a single connection whatever the config
+// says.
+func sqlitePoolSize(cfg *Config) int {
+	if cfg.Database.Database == ":memory:" {
+		return 1
+	}
+
+	return cfg.Database.Pool
+}
+
+// SqliteDatabase runs the queries in this package, which are written for
+// Postgres, against SQLite.
+type SqliteDatabase struct {
+	*sqlx.DB
+}
+
+func (db *SqliteDatabase) Begin() (Tx, error) {
+	tx, err := db.Beginx()
+	if err != nil {
+		return nil, err
+	}
+
+	return &SqliteTx{tx}, nil
+}
+
+func (db *SqliteDatabase) Exec(query string, args ...interface{}) (sql.Result, error) {
+	return db.DB.Exec(sqliteQuery(query), sqliteArgs(args)...)
+}
+
+func (db *SqliteDatabase) Get(dest interface{}, query string, args ...interface{}) error {
+	return db.DB.Get(dest, sqliteQuery(query), sqliteArgs(args)...)
+}
+
+func (db *SqliteDatabase) QueryRow(query string, args ...interface{}) *sql.Row {
+	return db.DB.QueryRow(sqliteQuery(query), sqliteArgs(args)...)
+}
+
+func (db *SqliteDatabase) Select(dest interface{}, query string, args ...interface{}) error {
+	return db.DB.Select(dest, sqliteQuery(query), sqliteArgs(args)...)
+}
+
+type SqliteTx struct {
+	*sqlx.Tx
+}
+
+func (tx *SqliteTx) Exec(query string, args ...interface{}) (sql.Result, error) {
+	return tx.Tx.Exec(sqliteQuery(query), sqliteArgs(args)...)
+}
+
+func (tx *SqliteTx) Get(dest interface{}, query string, args ...interface{}) error {
+	return tx.Tx.Get(dest, sqliteQuery(query), sqliteArgs(args)...)
+}
+
+func (tx *SqliteTx) QueryRow(query string, args ...interface{}) *sql.Row {
+	return tx.Tx.QueryRow(sqliteQuery(query), sqliteArgs(args)...)
+}
+
+func (tx *SqliteTx) Select(dest interface{}, query string, args ...interface{}) error {
+	return tx.Tx.Select(dest, sqliteQuery(query), sqliteArgs(args)...)
+}
+
+// sqliteQuery rewrites Postgres placeholders ($1) as their SQLite equivalents
+// (?1). Both may be repeated within a query. Queries built with sqlx.In use
+// ? placeholders, which SQLite understands already. Dollar signs inside
+// string literals (like those in bcrypt hashes) are left alone.
+func sqliteQuery(query string) string {
+	var buf bytes.Buffer
+	quoted := false
+	for i := 0; i < len(query); i++ {
+		c := query[i]
+		switch {
+		case c == '\'':
+			quoted = !quoted
+		case c == '$' && !quoted && i+1 < len(query) && isDigit(query[i+1]):
+			c = '?'
+		}
+		buf.WriteByte(c)
+	}
+
+	return buf.String()
+}
+
+func isDigit(c byte) bool {
+	return '0' <= c && c <= '9'
+}
+
+// sqliteArgs converts times to UTC. SQLite stores them as text, and only
+// compares them correctly if they are all in the same zone.
+func sqliteArgs(args []interface{}) []interface{} {
+	converted := make([]interface{}, len(args))
+	for i, arg := range args {
+		switch arg := arg.(type) {
+		case time.Time:
+			converted[i] = arg.UTC()
+		case *time.Time:
+			if arg != nil {
+				converted[i] = arg.UTC()
+			} else {
+				converted[i] = nil
+			}
+		default:
+			converted[i] = arg
+		}
+	}
+
+	return converted
+}
@@ -0,0 +1,44 @@
+package storage
+
+import "testing"
+
+func TestSqliteQuery(t *testing.T) {
+	tests := []struct {
+		query, expected string
+	}{
+		{`SELECT $1`, `SELECT ?1`},
+		{`a = $1 AND b = $12 AND c = $1`, `a = ?1 AND b = ?12 AND c = ?1`},
+		{`SELECT ? IN (?)`, `SELECT ? IN (?)`},
+		{`password = '$2a$12$abc' AND id = $1`, `password = '$2a$12$abc' AND id = ?1`},
+		{`name = 'it''s $1' AND id = $2`, `name = 'it''s $1' AND id = ?2`},
+		{`price$ = $ 1`, `price$ = $ 1`},
+	}
+
+	for _, test := range tests {
+		if actual := sqliteQuery(test.query); actual != test.expected {
+			t.Errorf("sqliteQuery(%q): expected %q, got %q", test.query, test.expected, actual)
+		}
+	}
+}
+
+func TestSqlitePoolSize(t *testing.T) {
+	tests := []struct {
+		database string
+		pool     int
+		expected int
+	}{
+		{"/var/lib/registrar/registrar.db", 0, 0},
+		{"/var/lib/registrar/registrar.db", 4, 4},
+		{":memory:", 0, 1},
+		{":memory:", 4, 1},
+	}
+
+	for _, test := range tests {
+		cfg := &Config{}
+		cfg.Database.Database = test.database
+		cfg.Database.Pool = test.pool
+		if actual := sqlitePoolSize(cfg); actual != test.expected {
+			t.Errorf("sqlitePoolSize(%q, %d): expected %d, got %d", test.database, test.pool, test.expected, actual)
+		}
+	}
+}
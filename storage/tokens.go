@@ -2,13 +2,22 @@ package storage
 
 import (
 	"io"
+	"log"
+	"strings"
 	"time"
 
 	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+
+	"github.com/jmoiron/sqlx"
 )
 
 const maxTokenSize = 32
 
+// Access tokens are self-contained JWTs, so they are kept short-lived.
+const AccessTokenLifetime = time.Hour
+
 func RandomToken() (string, error) {
 	rawToken := make([]byte, maxTokenSize)
 	_, err := io.ReadFull(rand.Reader, rawToken)
@@ -19,55 +28,443 @@ func RandomToken() (string, error) {
 	return hexEncode(string(rawToken)), nil
 }
 
+// HashToken returns the digest under which a secret token is stored, so that
+// reading the database doesn't reveal usable credentials. Tokens are long and
+// random, so there is nothing to gain from a slow or salted hash.
+func HashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hexEncode(string(sum[:]))
+}
+
+// Token values are stored hashed (see HashToken). Tokens found by value or
+// newly issued carry the raw value; those loaded any other way carry the
+// digest.
 type Token struct {
-	Id        int
-	ClientId  int
-	UserId    int
+	Id        int64
+	ClientId  int64
+	UserId    int64
+	ParentId  int64
+	FamilyId  int64
 	Type      string
 	Token     string
-	ExpiresAt time.Time
+	Scope     string `db:"-"`
+	CreatedAt time.Time
+	AuthTime  *time.Time
+	ExpiresAt *time.Time
+	RotatedAt *time.Time
+	RevokedAt *time.Time
 }
 
+// TokenParams describes a token to issue. Zero ids are recorded as NULL.
 type TokenParams struct {
+	ClientId  int64
+	UserId    int64
+	ParentId  int64
+	FamilyId  int64
+	Type      string
+	Scope     string
+	AuthTime  *time.Time
+	ExpiresAt *time.Time
 }
 
 type TokensService interface {
-	FindById(userId, labelId int64) (*Token, error)
-	New(userId int64, params *TokenParams) (*Token, error)
+	FindByValue(typ, token string) (*Token, error)
+	New(params *TokenParams) (*Token, error)
+	NewAccessToken(clientId, userId int64, scope string, parent *Token) (*Token, error)
+	Refresh(a *Application, t *Token) (*Token, error)
+	Revoke(clientId int64, typ, token string) error
+	RevokeReused(clientId int64, token string) (bool, error)
+	RevokeUserTokens(userId, clientId int64) ([]int64, error)
 }
 
 type LocalTokensService struct {
 	client *Client
 }
 
-const (
-	labelsQuery                   = `SELECT * FROM labels WHERE user_id = $1`
-	findLabelByUserIdAndUidQuery  = `SELECT * FROM labels WHERE user_id = $1 AND uid = $2`
-	findLabelByUserIdAndNameQuery = `SELECT * FROM labels WHERE user_id = $1 AND name = $2`
-)
+const defaultTokenFields = `t.id, t.client_id, COALESCE(t.user_id, 0) AS user_id,
+COALESCE(t.parent_id, 0) AS parent_id, COALESCE(t.family_id, t.id) AS family_id,
+t.type, t.token, t.created_at, t.auth_time, t.expires_at, t.rotated_at, t.revoked_at`
+
+const liveTokenCondition = `t.rotated_at IS NULL AND t.revoked_at IS NULL
+  AND (t.expires_at IS NULL OR t.expires_at > $1)`
+
+const findTokenByValueSql = "SELECT " + defaultTokenFields + ` FROM oauth_tokens t
+WHERE t.type = $2 AND t.token = $3 AND ` + liveTokenCondition + `
+LIMIT 1`
+
+const tokenScopesSql = `SELECT a.oauth_token_id, s.name FROM scopes s
+INNER JOIN authorized_scopes a ON a.scope_id = s.id
+WHERE a.oauth_token_id IN (?) ORDER BY s.id`
+
+// loadTokenScopes fills in the authorized scopes of each token.
+func loadTokenScopes(db Database, tokens []*Token) error {
+	if len(tokens) == 0 {
+		return nil
+	}
+
+	byId := make(map[int64]*Token)
+	var ids []int64
+	for _, t := range tokens {
+		byId[t.Id] = t
+		ids = append(ids, t.Id)
+	}
+
+	query, args, err := sqlx.In(tokenScopesSql, ids)
+	if err != nil {
+		return err
+	}
+
+	var scopes []struct {
+		OauthTokenId int64
+		Name         string
+	}
+	err = db.Select(&scopes, db.Rebind(query), args...)
+	if err != nil {
+		return err
+	}
+
+	for _, s := range scopes {
+		t := byId[s.OauthTokenId]
+		t.Scope = strings.TrimSpace(t.Scope + " " + s.Name)
+	}
+
+	return nil
+}
+
+// FindByValue returns the live (unexpired and unrevoked) token of the given
+// type, along with its authorized scopes.
+func (s *LocalTokensService) FindByValue(typ, token string) (*Token, error) {
+	t := &Token{}
+	err := s.client.db.Get(t, findTokenByValueSql, time.Now(), typ, HashToken(token))
+	if err != nil {
+		log.Println("Tokens.FindByValue:", err)
+		return nil, err
+	}
+	t.Token = token
+
+	err = loadTokenScopes(s.client.db, []*Token{t})
+	if err != nil {
+		log.Println("Tokens.FindByValue: failed loading scopes:", err)
+		return nil, err
+	}
+
+	return t, nil
+}
+
+// New issues a token with a fresh random value. Only the requested scopes the
+// client is permitted are attached.
+func (s *LocalTokensService) New(params *TokenParams) (*Token, error) {
+	value, err := RandomToken()
+	if err != nil {
+		log.Println("Tokens.New: failed generating token:", err)
+		return nil, err
+	}
+
+	t := &Token{
+		ClientId:  params.ClientId,
+		UserId:    params.UserId,
+		ParentId:  params.ParentId,
+		FamilyId:  params.FamilyId,
+		Type:      params.Type,
+		Token:     value,
+		Scope:     params.Scope,
+		AuthTime:  params.AuthTime,
+		ExpiresAt: params.ExpiresAt,
+	}
 
-func (s *LocalTokensService) FindById(userId, labelId int64) (*Token, error) {
 	tx, err := s.client.db.Begin()
 	if err != nil {
+		log.Println("Tokens.New:", err)
 		return nil, err
 	}
 
-	t := new(Token)
-	err = tx.Get(t, findLabelByUserIdAndUidQuery, userId, labelId)
+	err = createToken(s.client.db, tx, t)
 	if err != nil {
 		tx.Rollback()
+		log.Println("Tokens.New: failed inserting token:", err)
 		return nil, err
 	}
 
 	err = tx.Commit()
 	if err != nil {
-		tx.Rollback()
+		log.Println("Tokens.New: failed committing transaction:", err)
 		return nil, err
 	}
 
 	return t, nil
 }
 
-func (s *LocalTokensService) New(userId int64, params *TokenParams) (*Token, error) {
-	return nil, nil
+// NewAccessToken records an access token issued to a user. The token value is
+// the JWT id (jti) of the access token the caller signs. Access tokens are
+// derived from the refresh token (if any) that was issued alongside them, so
+// that revoking the refresh token revokes them too.
+func (s *LocalTokensService) NewAccessToken(clientId, userId int64, scope string, parent *Token) (*Token, error) {
+	return s.New(accessTokenParams(clientId, userId, scope, parent))
+}
+
+func accessTokenParams(clientId, userId int64, scope string, parent *Token) *TokenParams {
+	expiresAt := time.Now().Add(AccessTokenLifetime)
+	params := &TokenParams{
+		ClientId:  clientId,
+		UserId:    userId,
+		Type:      "access_token",
+		Scope:     scope,
+		ExpiresAt: &expiresAt,
+	}
+	if parent != nil {
+		params.ParentId = parent.Id
+		params.AuthTime = parent.AuthTime
+	}
+
+	return params
+}
+
+const extendTokenSql = `UPDATE oauth_tokens SET expires_at = $2 WHERE id = $1`
+const rotateTokenSql = `UPDATE oauth_tokens SET rotated_at = $2
+WHERE id = $1 AND rotated_at IS NULL AND revoked_at IS NULL RETURNING id`
+
+// Refresh records the use of refresh token t by application a, and returns the
+// refresh token the client should hold from now on. If a rotates refresh
+// tokens, t is retired in favor of a new token in the same family; otherwise
+// t is returned, with its idle expiry pushed back.
+func (s *LocalTokensService) Refresh(a *Application, t *Token) (*Token, error) {
+	authTime := t.CreatedAt
+	if t.AuthTime != nil {
+		authTime = *t.AuthTime
+	}
+	expiresAt := a.RefreshTokenExpiry(authTime)
+
+	if !a.RefreshTokenRotation {
+		if expiresAt == nil && t.ExpiresAt == nil {
+			return t, nil
+		}
+
+		_, err := s.client.db.Exec(extendTokenSql, t.Id, expiresAt)
+		if err != nil {
+			log.Println("Tokens.Refresh: failed extending token:", err)
+			return nil, err
+		}
+		t.ExpiresAt = expiresAt
+		return t, nil
+	}
+
+	value, err := RandomToken()
+	if err != nil {
+		log.Println("Tokens.Refresh: failed generating token:", err)
+		return nil, err
+	}
+
+	tx, err := s.client.db.Begin()
+	if err != nil {
+		log.Println("Tokens.Refresh:", err)
+		return nil, err
+	}
+
+	// If we lose a race with a concurrent refresh, the token has already been
+	// rotated, and this use is treated like any other use of a stale token.
+	var id int64
+	err = tx.QueryRow(rotateTokenSql, t.Id, time.Now()).Scan(&id)
+	if err == sql.ErrNoRows {
+		tx.Rollback()
+		return nil, ErrInvalidGrant
+	} else if err != nil {
+		tx.Rollback()
+		log.Println("Tokens.Refresh: failed rotating token:", err)
+		return nil, err
+	}
+
+	n := &Token{
+		ClientId:  t.ClientId,
+		UserId:    t.UserId,
+		FamilyId:  t.FamilyId,
+		Type:      "refresh_token",
+		Token:     value,
+		Scope:     t.Scope,
+		AuthTime:  t.AuthTime,
+		ExpiresAt: expiresAt,
+	}
+	err = createToken(s.client.db, tx, n)
+	if err != nil {
+		tx.Rollback()
+		log.Println("Tokens.Refresh: failed inserting token:", err)
+		return nil, err
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		log.Println("Tokens.Refresh: failed committing transaction:", err)
+		return nil, err
+	}
+
+	return n, nil
+}
+
+const revokeUserTokensSql = `UPDATE oauth_tokens SET revoked_at = $3
+WHERE user_id = $1 AND client_id = $2 AND revoked_at IS NULL
+RETURNING client_id`
+const revokeAllUserTokensSql = `UPDATE oauth_tokens SET revoked_at = $2
+WHERE user_id = $1 AND revoked_at IS NULL
+RETURNING client_id`
+
+// RevokeUserTokens revokes every token the user has issued to the given
+// client, or to all clients if clientId is 0. It returns the ids of the
+// clients that lost tokens.
+func (s *LocalTokensService) RevokeUserTokens(userId, clientId int64) ([]int64, error) {
+	var revoked []int64
+	var err error
+	if clientId == 0 {
+		err = s.client.db.Select(&revoked, revokeAllUserTokensSql, userId, time.Now())
+	} else {
+		err = s.client.db.Select(&revoked, revokeUserTokensSql, userId, clientId, time.Now())
+	}
+	if err != nil {
+		log.Println("Tokens.RevokeUserTokens:", err)
+		return nil, err
+	}
+
+	var clientIds []int64
+	seen := make(map[int64]bool)
+	for _, id := range revoked {
+		if !seen[id] {
+			seen[id] = true
+			clientIds = append(clientIds, id)
+		}
+	}
+
+	return clientIds, nil
+}
+
+const findRotatedTokenFamilySql = `SELECT COALESCE(t.family_id, t.id) FROM oauth_tokens t
+WHERE t.client_id = $1 AND t.type = 'refresh_token' AND t.token = $2
+  AND t.rotated_at IS NOT NULL
+LIMIT 1`
+
+// RevokeReused checks whether token is a refresh token that has already been
+// rotated. If so, it must have leaked (the legitimate client only ever holds
+// the newest token in the family), so the whole family is revoked.
+func (s *LocalTokensService) RevokeReused(clientId int64, token string) (bool, error) {
+	var familyId int64
+	err := s.client.db.QueryRow(findRotatedTokenFamilySql, clientId, HashToken(token)).Scan(&familyId)
+	if err == sql.ErrNoRows {
+		return false, nil
+	} else if err != nil {
+		log.Println("Tokens.RevokeReused:", err)
+		return false, err
+	}
+
+	_, err = s.client.db.Exec(revokeTokenFamilySql, familyId, time.Now())
+	if err != nil {
+		log.Println("Tokens.RevokeReused: failed revoking token family:", err)
+		return false, err
+	}
+
+	return true, nil
+}
+
+const revokeTokenSql = `UPDATE oauth_tokens SET revoked_at = $4
+WHERE client_id = $1 AND type = $2 AND token = $3 AND revoked_at IS NULL
+RETURNING COALESCE(family_id, id)`
+
+// A token family is a refresh token plus every token it has been rotated
+// into, along with all the tokens derived from any of them, however
+// indirectly (e.g. access tokens obtained by exchanging a derived access
+// token). Tokens that aren't refresh tokens are in a family of their own.
+const revokeTokenFamilySql = `WITH RECURSIVE family(id) AS (
+  SELECT id FROM oauth_tokens WHERE id = $1 OR family_id = $1
+  UNION
+  SELECT t.id FROM oauth_tokens t INNER JOIN family f ON t.parent_id = f.id
+)
+UPDATE oauth_tokens SET revoked_at = $2
+WHERE revoked_at IS NULL AND id IN (SELECT id FROM family)`
+
+// Revoke revokes a token issued to the given client, along with the rest of
+// its family. Revoking a token that doesn't exist (or has already been
+// revoked) is not an error.
+func (s *LocalTokensService) Revoke(clientId int64, typ, token string) error {
+	tx, err := s.client.db.Begin()
+	if err != nil {
+		log.Println("Tokens.Revoke:", err)
+		return err
+	}
+
+	var familyId int64
+	err = tx.QueryRow(revokeTokenSql, clientId, typ, HashToken(token), time.Now()).Scan(&familyId)
+	if err == sql.ErrNoRows {
+		tx.Rollback()
+		return nil
+	} else if err != nil {
+		tx.Rollback()
+		log.Println("Tokens.Revoke: failed revoking token:", err)
+		return err
+	}
+
+	_, err = tx.Exec(revokeTokenFamilySql, familyId, time.Now())
+	if err != nil {
+		tx.Rollback()
+		log.Println("Tokens.Revoke: failed revoking derived tokens:", err)
+		return err
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		log.Println("Tokens.Revoke: failed committing transaction:", err)
+		return err
+	}
+
+	return nil
+}
+
+const createTokenSql = `INSERT INTO oauth_tokens
+(client_id, user_id, parent_id, family_id, type, token, auth_time, expires_at)
+VALUES ($1, $2, $3, $4, $5, $6, $7, $8) RETURNING id, created_at`
+const attachScopesSql = `INSERT INTO authorized_scopes (oauth_token_id, scope_id)
+SELECT ?, s.id FROM scopes s INNER JOIN permitted_scopes ps ON ps.scope_id = s.id
+WHERE s.name IN (?) AND ps.client_id = ?
+  AND (s.name <> 'admin' OR NOT EXISTS (SELECT 1 FROM users u WHERE u.id = ? AND NOT u.admin))`
+const attachedScopesSql = `SELECT s.name FROM scopes s
+INNER JOIN authorized_scopes a ON a.scope_id = s.id
+WHERE a.oauth_token_id = $1 ORDER BY s.id`
+
+// createToken inserts t inside tx, filling in its id, and attaches whichever
+// of its scopes the client is permitted to request. Tokens issued on behalf of
+// users only get the admin scope if the user is an admin. t.Scope is narrowed
+// to the scopes actually attached.
+func createToken(db Database, tx Tx, t *Token) error {
+	err := tx.QueryRow(createTokenSql, t.ClientId, nullId(t.UserId), nullId(t.ParentId), nullId(t.FamilyId), t.Type, HashToken(t.Token), t.AuthTime, t.ExpiresAt).Scan(&t.Id, &t.CreatedAt)
+	if err != nil {
+		return err
+	}
+
+	scopes := strings.Fields(t.Scope)
+	if len(scopes) == 0 {
+		return nil
+	}
+
+	query, args, err := sqlx.In(attachScopesSql, t.Id, scopes, t.ClientId, t.UserId)
+	if err != nil {
+		return err
+	}
+	query = db.Rebind(query)
+	_, err = tx.Exec(query, args...)
+	if err != nil {
+		return err
+	}
+
+	var attached []string
+	err = tx.Select(&attached, attachedScopesSql, t.Id)
+	if err != nil {
+		return err
+	}
+	t.Scope = strings.Join(attached, " ")
+
+	return nil
+}
+
+// nullId maps a zero id to NULL, e.g. for tokens issued to a client on its own
+// behalf, which have no user.
+func nullId(id int64) interface{} {
+	if id == 0 {
+		return nil
+	}
+	return id
 }
@@ -0,0 +1,153 @@
+package storage
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// testSqliteClient returns a freshly migrated SQLite client, and a function
+// that cleans up after it.
+func testSqliteClient(t *testing.T) (*Client, func()) {
+	dir, err := ioutil.TempDir("", "registrar-storage-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cfg := &Config{}
+	cfg.Database.Database = filepath.Join(dir, "test.db")
+	lite, err := openSqlite(cfg)
+	if err != nil {
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+
+	_, err = lite.MigrateUp()
+	if err != nil {
+		lite.Close()
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+
+	return lite, func() {
+		lite.Close()
+		os.RemoveAll(dir)
+	}
+}
+
+// testClients returns a memory client and a freshly migrated SQLite client,
+// so that tests can check the two backends agree. The returned function
+// cleans up after them.
+func testClients(t *testing.T) (map[string]*Client, func()) {
+	lite, done := testSqliteClient(t)
+
+	clients := map[string]*Client{
+		"memory": NewMemoryClient(),
+		"sqlite": lite,
+	}
+
+	return clients, done
+}
+
+func TestRevokeDerivedTokens(t *testing.T) {
+	clients, done := testClients(t)
+	defer done()
+
+	for name, c := range clients {
+		user, err := c.Users.New(&UserParams{Email: "paul@example.com", Password: "hunter2"})
+		if err != nil {
+			t.Fatalf("%s: %s", name, err)
+		}
+
+		app, err := c.Apps.New(&ApplicationParams{
+			Name:                    "Test",
+			TokenEndpointAuthMethod: "client_secret_basic",
+			Scope:                   "openid email",
+		})
+		if err != nil {
+			t.Fatalf("%s: %s", name, err)
+		}
+
+		refresh, err := c.Tokens.New(&TokenParams{
+			ClientId: app.Id,
+			UserId:   user.Id,
+			Type:     "refresh_token",
+			Scope:    "openid email admin",
+		})
+		if err != nil {
+			t.Fatalf("%s: %s", name, err)
+		}
+		if refresh.Scope != "openid email" {
+			t.Errorf("%s: expected scope narrowed to %q, got %q", name, "openid email", refresh.Scope)
+		}
+
+		access, err := c.Tokens.NewAccessToken(app.Id, user.Id, "openid", refresh)
+		if err != nil {
+			t.Fatalf("%s: %s", name, err)
+		}
+
+		// As issued by token exchange: derived from an access token rather
+		// than from the refresh token itself.
+		exchanged, err := c.Tokens.NewAccessToken(app.Id, user.Id, "openid admin", access)
+		if err != nil {
+			t.Fatalf("%s: %s", name, err)
+		}
+		if exchanged.Scope != "openid" {
+			t.Errorf("%s: expected scope narrowed to %q, got %q", name, "openid", exchanged.Scope)
+		}
+
+		err = c.Tokens.Revoke(app.Id, "refresh_token", refresh.Token)
+		if err != nil {
+			t.Fatalf("%s: %s", name, err)
+		}
+
+		for _, tok := range []*Token{access, exchanged} {
+			if _, err := c.Tokens.FindByValue("access_token", tok.Token); err == nil {
+				t.Errorf("%s: expected token %d to be revoked along with its family", name, tok.Id)
+			}
+		}
+	}
+}
+
+func TestAdminScopeRequiresAdmin(t *testing.T) {
+	clients, done := testClients(t)
+	defer done()
+
+	for name, c := range clients {
+		app, err := c.Apps.New(&ApplicationParams{
+			Name:                    "Test",
+			TokenEndpointAuthMethod: "client_secret_basic",
+			Scope:                   "openid admin",
+		})
+		if err != nil {
+			t.Fatalf("%s: %s", name, err)
+		}
+
+		user, err := c.Users.New(&UserParams{Email: "paul@example.com", Password: "hunter2"})
+		if err != nil {
+			t.Fatalf("%s: %s", name, err)
+		}
+
+		token, err := c.Tokens.NewAccessToken(app.Id, user.Id, "openid admin", nil)
+		if err != nil {
+			t.Fatalf("%s: %s", name, err)
+		}
+		if token.Scope != "openid" {
+			t.Errorf("%s: expected a non-admin to be denied the admin scope, got %q", name, token.Scope)
+		}
+
+		err = c.Users.SetAdmin(user, true)
+		if err != nil {
+			t.Fatalf("%s: %s", name, err)
+		}
+
+		token, err = c.Tokens.NewAccessToken(app.Id, user.Id, "openid admin", nil)
+		if err != nil {
+			t.Fatalf("%s: %s", name, err)
+		}
+		if token.Scope != "openid admin" {
+			t.Errorf("%s: expected an admin to be granted the admin scope, got %q", name, token.Scope)
+		}
+	}
+}
@@ -1,32 +1,49 @@
 package storage
 
 import (
-	"errors"
 	"log"
-	"strings"
+	"time"
 
-	"github.com/jmoiron/sqlx"
-	"github.com/lib/pq"
 	"golang.org/x/crypto/bcrypt"
 )
 
+// User holds a user's account and profile. The profile fields are the
+// OpenID Connect standard claims of the same names; empty means unknown.
+// Only admins are ever issued the admin scope.
 type User struct {
-	Id    int64  `json:"id"`
-	Email string `json:"email"`
+	Id            int64  `json:"id"`
+	Email         string `json:"email"`
+	Admin         bool   `json:"admin"`
+	EmailVerified bool   `json:"email_verified"` // false until addresses are verified
+	Name          string `json:"name"`
+	GivenName     string `json:"given_name"`
+	FamilyName    string `json:"family_name"`
+	Locale        string `json:"locale"`  // BCP 47 language tag, e.g. en-US
+	Picture       string `json:"picture"` // URL of a profile picture
 }
 
 type UserParams struct {
-	Email    string `json:"email"`
-	Password string `json:"password"`
+	Email      string `json:"email"`
+	Password   string `json:"password"`
+	Name       string `json:"name"`
+	GivenName  string `json:"given_name"`
+	FamilyName string `json:"family_name"`
+	Locale     string `json:"locale"`
+	Picture    string `json:"picture"`
 }
 
 type UsersService interface {
+	Authorizations(userId int64) ([]*Authorization, error)
+	Consent(userId, clientId int64) (string, error)
 	FindByCredentials(email, password string) (*User, error)
 	FindByEmail(email string) (*User, error)
-	FindByToken(token string) (*User, error)
-	FindByRefreshToken(clientId int64, token string) (*User, error)
+	FindById(id int64) (*User, error)
 	New(params *UserParams) (*User, error)
-	Authorize(userId, clientId int64, scope string, refresh bool) (string, error)
+	SetAdmin(u *User, admin bool) error
+	Update(u *User, params *UserParams) (*User, error)
+	Authorize(userId, clientId int64, scope string, refresh bool) (*Token, error)
+	RememberConsent(userId, clientId int64, scope string) error
+	RevokeAuthorization(userId, clientId int64) error
 }
 
 type LocalUsersService struct {
@@ -35,98 +52,63 @@ type LocalUsersService struct {
 
 const DefaultPasswordCost = 12
 
-const findUserByTokenSql = `SELECT u.id, u.email FROM users u
-JOIN oauth_tokens t ON t.user_id = u.id
-WHERE t.token = $1 AND t.type = 'access_token' AND t.expires_at > NOW() GROUP BY u.id LIMIT 1`
+const defaultUserFields = `u.id, u.email, u.admin, u.email_verified, u.name, u.given_name,
+u.family_name, u.locale, u.picture`
 
-func (s *LocalUsersService) FindByToken(token string) (u *User, err error) {
-	var id int64
-	var email string
-	err = s.client.db.QueryRow(findUserByTokenSql, token).Scan(&id, &email)
-	if err != nil {
-		log.Println("Users.FindByToken:", err)
-		return
-	}
-
-	return &User{id, email}, nil
-}
+const findUserByIdSql = `SELECT ` + defaultUserFields + ` FROM users u WHERE u.id = $1 LIMIT 1`
 
-const findUserByRefreshTokenSql = `SELECT u.id, u.email FROM users u
-JOIN oauth_tokens t ON t.user_id = u.id
-WHERE t.client_id = $1 AND t.token = $2 AND t.type = 'refresh_token'
-  AND (t.expires_at IS NULL OR t.expires_at > NOW())
-GROUP BY u.id LIMIT 1`
-
-func (s *LocalUsersService) FindByRefreshToken(clientId int64, token string) (u *User, err error) {
-	var id int64
-	var email string
-	err = s.client.db.QueryRow(findUserByRefreshTokenSql, clientId, token).Scan(&id, &email)
+func (s *LocalUsersService) FindById(id int64) (*User, error) {
+	u := &User{}
+	err := s.client.db.Get(u, findUserByIdSql, id)
 	if err != nil {
-		log.Println("db.FindUserByRefreshToken:", err)
-		return
+		log.Println("db.FindUserById:", err)
+		return nil, err
 	}
 
-	return &User{id, email}, nil
+	return u, nil
 }
 
-const findUserByEmailSql = `SELECT u.id FROM users u WHERE u.email = $1 LIMIT 1`
+const findUserByEmailSql = `SELECT ` + defaultUserFields + ` FROM users u WHERE u.email = $1 LIMIT 1`
 
-func (s *LocalUsersService) FindByEmail(email string) (u *User, err error) {
-	var id int64
-	err = s.client.db.QueryRow(findUserByEmailSql, email).Scan(&id)
+func (s *LocalUsersService) FindByEmail(email string) (*User, error) {
+	u := &User{}
+	err := s.client.db.Get(u, findUserByEmailSql, email)
 	if err != nil {
 		log.Println("db.FindUserByEmail:", err)
-		return
+		return nil, err
 	}
 
-	return &User{id, email}, nil
+	return u, nil
 }
 
-const findUserByEmailWithPasswordSql = `SELECT u.id, u.password FROM users u
+const findUserByEmailWithPasswordSql = `SELECT ` + defaultUserFields + `, u.password FROM users u
 WHERE u.email = $1 LIMIT 1`
 
-func (s *LocalUsersService) FindByCredentials(email, password string) (u *User, err error) {
-	var id int64
-	var hashed string
-	err = s.client.db.QueryRow(findUserByEmailWithPasswordSql, email).Scan(&id, &hashed)
+func (s *LocalUsersService) FindByCredentials(email, password string) (*User, error) {
+	var u struct {
+		User
+		Password string
+	}
+	err := s.client.db.Get(&u, findUserByEmailWithPasswordSql, email)
 	if err != nil {
 		log.Println("db.FindUserByCredentials:", err)
-		return
+		return nil, err
 	}
 
 	// NOTE: Timing attacks will reveal existence of users, since we only hash
 	// when we find a real user record in the database.
-	err = bcrypt.CompareHashAndPassword([]byte(hashed), []byte(password))
+	err = bcrypt.CompareHashAndPassword([]byte(u.Password), []byte(password))
 	if err != nil {
 		log.Println("db.FindUserByCredentials:", err)
-		return
+		return nil, err
 	}
 
-	return &User{id, email}, nil
+	return &u.User, nil
 }
 
-const createUserSql = `INSERT INTO users (email, password) VALUES ($1, $2) RETURNING id`
-
-var (
-	ErrNotUnique = errors.New("duplicate key value violates unique key constraint")
-)
-
-func translateError(err error) error {
-	switch err := err.(type) {
-	case nil:
-		return nil
-	case *pq.Error:
-		switch err.Code {
-		case "23505": // unique_violation
-			return ErrNotUnique
-		default:
-			log.Printf("returning raw PQ error (code %s)", err.Code)
-			return err
-		}
-	default:
-		return err
-	}
-}
+const createUserSql = `INSERT INTO users
+(email, password, name, given_name, family_name, locale, picture)
+VALUES ($1, $2, $3, $4, $5, $6, $7) RETURNING id`
 
 func (s *LocalUsersService) New(params *UserParams) (*User, error) {
 	crypted, err := bcrypt.GenerateFromPassword([]byte(params.Password), DefaultPasswordCost)
@@ -134,62 +116,79 @@ func (s *LocalUsersService) New(params *UserParams) (*User, error) {
 		return nil, translateError(err)
 	}
 
-	var id int64
-	err = s.client.db.QueryRow(createUserSql, params.Email, string(crypted)).Scan(&id)
+	u := &User{
+		Email:      params.Email,
+		Name:       params.Name,
+		GivenName:  params.GivenName,
+		FamilyName: params.FamilyName,
+		Locale:     params.Locale,
+		Picture:    params.Picture,
+	}
+	err = s.client.db.QueryRow(createUserSql, u.Email, string(crypted), u.Name, u.GivenName, u.FamilyName, u.Locale, u.Picture).Scan(&u.Id)
 	if err != nil {
 		return nil, translateError(err)
 	}
 
-	return &User{id, params.Email}, nil
+	return u, nil
 }
 
-const createTokenSql = `INSERT INTO oauth_tokens
-(client_id, user_id, type, token, expires_at)
-VALUES ($1, $2, $3, $4, $5) RETURNING id`
-const attachScopesSql = `INSERT INTO authorized_scopes (oauth_token_id, scope_id)
-SELECT ?, s.id FROM scopes s INNER JOIN permitted_scopes ps ON ps.scope_id = s.id
-WHERE s.name IN (?) AND ps.client_id = ?`
-
-func (s *LocalUsersService) Authorize(userId, clientId int64, scope string, refresh bool) (string, error) {
-	if !refresh {
-		return "", nil
-	}
-
-	tx, err := s.client.db.Begin()
+const updateUserSql = `UPDATE users SET name = $2, given_name = $3, family_name = $4,
+locale = $5, picture = $6 WHERE id = $1`
+
+// Update changes a user's profile. The email address (which identifies the
+// user to applications) and password can't be changed this way, so those
+// params are ignored.
+func (s *LocalUsersService) Update(u *User, params *UserParams) (*User, error) {
+	updated := *u
+	updated.Name = params.Name
+	updated.GivenName = params.GivenName
+	updated.FamilyName = params.FamilyName
+	updated.Locale = params.Locale
+	updated.Picture = params.Picture
+
+	_, err := s.client.db.Exec(updateUserSql, updated.Id, updated.Name, updated.GivenName, updated.FamilyName, updated.Locale, updated.Picture)
 	if err != nil {
-		log.Println("User.Authorize:", err)
-		return "", err
+		log.Println("Users.Update:", err)
+		return nil, err
 	}
 
-	refreshToken, err := RandomToken()
-	if err != nil {
-		log.Println("User.Authorize: failed generating token:", err)
-		return "", err
-	}
+	return &updated, nil
+}
 
-	var tokenId int
-	err = tx.QueryRow(createTokenSql, clientId, userId, "refresh_token", refreshToken, nil).Scan(&tokenId)
+const setUserAdminSql = `UPDATE users SET admin = $2 WHERE id = $1`
+
+// SetAdmin grants or revokes the admin role. Tokens already issued keep
+// whatever scopes they were issued with, but requireAdmin checks the role on
+// every request.
+func (s *LocalUsersService) SetAdmin(u *User, admin bool) error {
+	_, err := s.client.db.Exec(setUserAdminSql, u.Id, admin)
 	if err != nil {
-		tx.Rollback()
-		log.Println("User.Authorize: failed inserting token:", err)
-		return "", err
+		log.Println("Users.SetAdmin:", err)
+		return err
 	}
 
-	scopes := strings.Split(scope, " ")
-	query, args, err := sqlx.In(attachScopesSql, tokenId, scopes, clientId)
-	query = s.client.db.Rebind(query)
-	_, err = tx.Exec(query, args...)
-	if err != nil {
-		tx.Rollback()
-		log.Println("User.Authorize: failed attaching scopes:", err)
-		return "", err
+	return nil
+}
+
+func (s *LocalUsersService) Authorize(userId, clientId int64, scope string, refresh bool) (*Token, error) {
+	if !refresh {
+		return nil, nil
 	}
 
-	err = tx.Commit()
+	a, err := s.client.Apps.FindById(clientId)
 	if err != nil {
-		log.Println("User.Authorize: failed committing transaction:", err)
-		return "", err
+		log.Println("User.Authorize:", err)
+		return nil, err
 	}
 
-	return refreshToken, nil
+	// The user has just presented their credentials.
+	authTime := time.Now()
+	return s.client.Tokens.New(&TokenParams{
+		ClientId:  clientId,
+		UserId:    userId,
+		Type:      "refresh_token",
+		Scope:     scope,
+		AuthTime:  &authTime,
+		ExpiresAt: a.RefreshTokenExpiry(authTime),
+	})
 }
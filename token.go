@@ -3,6 +3,9 @@ package main
 import (
 	"time"
 
+	"crypto/sha256"
+	"encoding/base64"
+
 	"github.com/dgrijalva/jwt-go"
 )
 
@@ -18,11 +21,81 @@ func NewJWT(issuer, clientId, email string, seconds int) *jwt.Token {
 	return token
 }
 
+// NewIdToken builds an OpenID Connect ID token. The nonce and access token
+// hash (at_hash) claims are only included if nonce and accessToken are given.
+func NewIdToken(issuer, clientId, email string, seconds int, authTime *time.Time, nonce, accessToken string) *jwt.Token {
+	token := NewJWT(issuer, clientId, email, seconds)
+	if authTime != nil {
+		token.Claims["auth_time"] = authTime.Unix()
+	}
+	if nonce != "" {
+		token.Claims["nonce"] = nonce
+	}
+	if accessToken != "" {
+		token.Claims["at_hash"] = accessTokenHash(accessToken)
+	}
+
+	return token
+}
+
+// NewLogoutToken builds an OpenID Connect Back-Channel Logout token, telling
+// the client that the user has logged out.
+func NewLogoutToken(issuer, clientId, email, jti string) *jwt.Token {
+	token := jwt.New(jwt.SigningMethodRS256)
+	now := time.Now()
+	token.Claims["aud"] = clientId
+	token.Claims["events"] = map[string]interface{}{
+		"http://schemas.openid.net/event/backchannel-logout": map[string]interface{}{},
+	}
+	token.Claims["exp"] = now.Add(2 * time.Minute).Unix()
+	token.Claims["iat"] = now.Unix()
+	token.Claims["iss"] = issuer
+	token.Claims["jti"] = jti
+	token.Claims["sub"] = email
+
+	return token
+}
+
+// accessTokenHash computes the at_hash of an RS256-signed token: the left half
+// of its SHA-256 hash, base64url encoded.
+func accessTokenHash(accessToken string) string {
+	sum := sha256.Sum256([]byte(accessToken))
+	return base64.RawURLEncoding.EncodeToString(sum[:len(sum)/2])
+}
+
 type TokenResponse struct {
 	AccessToken  string `json:"access_token"`
 	TokenType    string `json:"token_type"`
 	ExpiresIn    int    `json:"expires_in,omitempty"`
 	RefreshToken string `json:"refresh_token,omitempty"`
 	Scope        string `json:"scope,omitempty"`
+	IdToken      string `json:"id_token,omitempty"`
 	State        string `json:"-"`
+
+	// Only set for token exchange (RFC 8693) responses.
+	IssuedTokenType string `json:"issued_token_type,omitempty"`
+}
+
+// DeviceAuthorizationResponse is returned to devices starting the device
+// authorization grant (RFC 8628).
+type DeviceAuthorizationResponse struct {
+	DeviceCode              string `json:"device_code"`
+	UserCode                string `json:"user_code"`
+	VerificationUri         string `json:"verification_uri"`
+	VerificationUriComplete string `json:"verification_uri_complete"`
+	ExpiresIn               int    `json:"expires_in"`
+	Interval                int    `json:"interval"`
+}
+
+// IntrospectionResponse describes a token, per RFC 7662. Inactive tokens are
+// described only by Active.
+type IntrospectionResponse struct {
+	Active    bool   `json:"active"`
+	Scope     string `json:"scope,omitempty"`
+	ClientId  string `json:"client_id,omitempty"`
+	Subject   string `json:"sub,omitempty"`
+	ExpiresAt int64  `json:"exp,omitempty"`
+	IssuedAt  int64  `json:"iat,omitempty"`
+	Audience  string `json:"aud,omitempty"`
+	TokenType string `json:"token_type,omitempty"`
 }